@@ -18,21 +18,44 @@ linux-monitor 客户端代理
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	stdnet "net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
@@ -40,20 +63,335 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 	"github.com/shirou/gopsutil/v3/net"
 	"github.com/shirou/gopsutil/v3/process"
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/yaml.v3"
 )
 
 // Config 配置结构体，保存代理的配置信息
 type Config struct {
-	ServerURL     string // WebSocket服务器URL
-	Interval      int    // 数据采集间隔（秒）
-	EncryptionKey string // AES加密密钥
-	AgentID       string // 代理唯一标识
+	ServerURLs    []string // WebSocket服务器URL，按优先级排列
+	Interval      int      // 数据采集间隔（秒）
+	EncryptionKey string   // AES加密密钥
+	AgentID       string   // 代理唯一标识
+
+	FSIncludeTypes []string // 只采集这些文件系统类型（为空表示不限制）
+	FSExcludeTypes []string // 忽略的文件系统类型
+	FSIncludePaths []string // 只采集匹配这些路径模式的挂载点（为空表示不限制）
+	FSExcludePaths []string // 忽略匹配这些路径模式的挂载点
+
+	DiskIOExclude []string // 忽略的块设备名称（支持通配符）
+
+	NetInclude []string // 只采集这些网卡（支持通配符，为空表示不限制）
+	NetExclude []string // 忽略的网卡（支持通配符）
+
+	TopProcesses int // 按CPU和内存分别上报的进程数量，0表示不采集
+
+	SysfsRoot string // sysfs挂载点，读取硬件传感器时使用
+
+	CgroupRoot string // cgroup v2挂载点
+
+	TextfileDir string // Prometheus文本格式（.prom）文件所在目录，为空表示不读取
+
+	StatsdAddr        string    // StatsD UDP监听地址，为空表示不监听
+	StatsdPercentiles []float64 // 计时器上报的百分位数
+
+	SystemdUnits  []string // 需要关注的systemd单元
+	SystemdFailed bool     // 是否同时上报所有处于failed状态的单元
+
+	SpoolDir     string        // 发送失败的指标暂存目录
+	SpoolMaxSize int64         // 暂存目录的最大字节数，0表示不暂存
+	SpoolMaxAge  time.Duration // 暂存指标的最长保留时间
+	SpoolFsync   bool          // 每次写入暂存文件后是否fsync
+
+	BatchSize   int           // 每帧最多包含的样本数，1表示不批量
+	BatchWait   time.Duration // 样本在批量中等待的最长时间
+	Compression string        // 请求的压缩算法：none、gzip或zstd
+
+	LegacyEncryption bool // 使用旧版AES-CFB格式加密，仅用于连接尚未升级的服务端
+
+	EnrollTokens []string // 注册令牌，首次连接时向服务端换取代理专属密钥；只有一个时用于所有服务器，否则与ServerURLs一一对应
+
+	TLSCA   string   // 校验服务端证书的CA证书文件，为空时使用系统CA
+	TLSCert string   // 客户端证书文件，用于双向TLS认证
+	TLSKey  string   // 客户端证书私钥文件
+	TLSPins []string // 允许的服务端证书公钥SHA-256指纹（十六进制）
+
+	Labels             map[string]string // 随指标上报的标签
+	DisabledCollectors []string          // 不启用的采集项
+
+	CollectorIntervals map[string]time.Duration // 单独配置的采集项采集间隔
+	CollectorTimeouts  map[string]time.Duration // 单独配置的采集项超时时间
+	CollectorTimeout   time.Duration            // 采集项的默认超时时间
+
+	CommandsDisabled bool   // 拒绝服务端触发的诊断命令
+	ScriptDir        string // 允许服务端按名称运行的脚本所在目录，为空表示不允许运行脚本
+
+	ServerMode       string        // 配置多个服务器时的工作模式：failover或fanout
+	FailbackInterval time.Duration // 重新尝试连接优先级更高或连接失败的服务器的间隔
+
+	ExecPlugins []ExecPlugin // 定时运行并把输出作为自定义指标上报的外部程序
+}
+
+// ExecPlugin 定时运行的外部程序
+type ExecPlugin struct {
+	Name      string            // 名称，用作采集项名称exec:<名称>和指标名称的前缀
+	Command   string            // 程序的绝对路径
+	Args      []string          // 命令行参数
+	Format    string            // 标准输出的格式：json或nagios
+	MaxOutput int               // 标准输出的最大字节数，超出时本次结果作废
+	Labels    map[string]string // 附加到该程序所有指标上的标签
+}
+
+// 可以通过配置文件或-disable-collectors关闭的采集项，由registerCollector登记；CPU、内存、根分区和负载等始终采集
+var knownCollectors []string
+
+// 环境变量前缀，参数名转为大写并把-替换为_，如LINUX_MONITOR_SERVER、LINUX_MONITOR_SPOOL_DIR
+const envPrefix = "LINUX_MONITOR_"
+
+// FileConfig 代理配置文件（YAML或JSON），每一项对应一个命令行参数，未设置的项使用参数的默认值
+type FileConfig struct {
+	Server           *string           `json:"server" yaml:"server"`
+	Servers          []string          `json:"servers" yaml:"servers"`
+	ServerMode       *string           `json:"server_mode" yaml:"server_mode"`
+	FailbackInterval *string           `json:"failback_interval" yaml:"failback_interval"`
+	Interval         *int              `json:"interval" yaml:"interval"`
+	Key              *string           `json:"key" yaml:"key"`
+	EnrollToken      *string           `json:"enroll_token" yaml:"enroll_token"`
+	Labels           map[string]string `json:"labels" yaml:"labels"`
+	Compression      *string           `json:"compression" yaml:"compression"`
+	LegacyEncryption *bool             `json:"legacy_encryption" yaml:"legacy_encryption"`
+
+	Collectors struct {
+		Filesystems struct {
+			Enabled      *bool    `json:"enabled" yaml:"enabled"`
+			IncludeTypes []string `json:"include_types" yaml:"include_types"`
+			ExcludeTypes []string `json:"exclude_types" yaml:"exclude_types"`
+			IncludePaths []string `json:"include_paths" yaml:"include_paths"`
+			ExcludePaths []string `json:"exclude_paths" yaml:"exclude_paths"`
+		} `json:"filesystems" yaml:"filesystems"`
+		DiskIO struct {
+			Enabled *bool    `json:"enabled" yaml:"enabled"`
+			Exclude []string `json:"exclude" yaml:"exclude"`
+		} `json:"diskio" yaml:"diskio"`
+		Network struct {
+			Enabled *bool    `json:"enabled" yaml:"enabled"`
+			Include []string `json:"include" yaml:"include"`
+			Exclude []string `json:"exclude" yaml:"exclude"`
+		} `json:"network" yaml:"network"`
+		Connections struct {
+			Enabled *bool `json:"enabled" yaml:"enabled"`
+		} `json:"connections" yaml:"connections"`
+		Pressure struct {
+			Enabled *bool `json:"enabled" yaml:"enabled"`
+		} `json:"pressure" yaml:"pressure"`
+		Processes struct {
+			Enabled *bool `json:"enabled" yaml:"enabled"`
+			Top     *int  `json:"top" yaml:"top"`
+		} `json:"processes" yaml:"processes"`
+		Sensors struct {
+			Enabled   *bool   `json:"enabled" yaml:"enabled"`
+			SysfsRoot *string `json:"sysfs_root" yaml:"sysfs_root"`
+		} `json:"sensors" yaml:"sensors"`
+		Cgroups struct {
+			Enabled *bool   `json:"enabled" yaml:"enabled"`
+			Root    *string `json:"root" yaml:"root"`
+		} `json:"cgroups" yaml:"cgroups"`
+		Systemd struct {
+			Enabled       *bool    `json:"enabled" yaml:"enabled"`
+			Units         []string `json:"units" yaml:"units"`
+			IncludeFailed *bool    `json:"include_failed" yaml:"include_failed"`
+		} `json:"systemd" yaml:"systemd"`
+		Textfile struct {
+			Enabled *bool   `json:"enabled" yaml:"enabled"`
+			Dir     *string `json:"dir" yaml:"dir"`
+		} `json:"textfile" yaml:"textfile"`
+		Statsd struct {
+			Enabled     *bool     `json:"enabled" yaml:"enabled"`
+			Addr        *string   `json:"addr" yaml:"addr"`
+			Percentiles []float64 `json:"percentiles" yaml:"percentiles"`
+		} `json:"statsd" yaml:"statsd"`
+
+		Timeout   *string           `json:"timeout" yaml:"timeout"`
+		Intervals map[string]string `json:"intervals" yaml:"intervals"`
+		Timeouts  map[string]string `json:"timeouts" yaml:"timeouts"`
+
+		Exec []ExecPluginConfig `json:"exec" yaml:"exec"`
+	} `json:"collectors" yaml:"collectors"`
+
+	Spool struct {
+		Dir       *string `json:"dir" yaml:"dir"`
+		MaxSizeMB *int64  `json:"max_size_mb" yaml:"max_size_mb"`
+		MaxAge    *string `json:"max_age" yaml:"max_age"`
+		Fsync     *bool   `json:"fsync" yaml:"fsync"`
+	} `json:"spool" yaml:"spool"`
+
+	Batch struct {
+		Size *int    `json:"size" yaml:"size"`
+		Wait *string `json:"wait" yaml:"wait"`
+	} `json:"batch" yaml:"batch"`
+
+	TLS struct {
+		CA   *string  `json:"ca" yaml:"ca"`
+		Cert *string  `json:"cert" yaml:"cert"`
+		Key  *string  `json:"key" yaml:"key"`
+		Pins []string `json:"pins" yaml:"pins"`
+	} `json:"tls" yaml:"tls"`
+
+	Commands struct {
+		Disabled  *bool   `json:"disabled" yaml:"disabled"`
+		ScriptDir *string `json:"script_dir" yaml:"script_dir"`
+	} `json:"commands" yaml:"commands"`
+}
+
+// ExecPluginConfig 配置文件中的外部程序，只能在本机配置
+type ExecPluginConfig struct {
+	Name      string            `json:"name" yaml:"name"`
+	Command   string            `json:"command" yaml:"command"`
+	Args      []string          `json:"args" yaml:"args"`
+	Format    string            `json:"format" yaml:"format"`
+	Interval  string            `json:"interval" yaml:"interval"`
+	Timeout   string            `json:"timeout" yaml:"timeout"`
+	MaxOutput int               `json:"max_output" yaml:"max_output"`
+	Labels    map[string]string `json:"labels" yaml:"labels"`
+}
+
+// 默认忽略的虚拟文件系统类型和挂载路径
+const (
+	defaultFSExcludeTypes = "tmpfs,devtmpfs,devfs,overlay,squashfs,proc,sysfs,cgroup,cgroup2,pstore,bpf,tracefs,debugfs,securityfs,configfs,fusectl,mqueue,hugetlbfs,autofs,binfmt_misc,nsfs,rpc_pipefs,ramfs,efivarfs"
+	defaultFSExcludePaths = "/proc,/sys,/dev,/run"
+	defaultDiskIOExclude  = "loop*,ram*,zram*,fd*,sr*"
+	defaultNetExclude     = "lo,veth*,docker*,br-*,virbr*,cni*,flannel*,cali*"
+)
+
+// 单个挂载点获取使用情况的超时时间，防止失联的NFS挂载阻塞采集
+const fsUsageTimeout = 2 * time.Second
+
+// 上报的进程命令行最大长度
+const maxCmdlineLength = 512
+
+// 内核压力阻塞信息（PSI）所在目录，需要4.20以上内核
+const pressureDir = "/proc/pressure"
+
+// 执行systemctl的超时时间
+const systemctlTimeout = 5 * time.Second
+
+// 服务端触发的命令的默认和最长执行时间，以及脚本返回给服务端的输出上限
+const (
+	defaultCommandTimeout = 30 * time.Second
+	maxCommandTimeout     = 5 * time.Minute
+	maxScriptOutput       = 64 * 1024
+)
+
+// 外部程序标准输出的默认和最大字节数，以及每次运行最多上报的指标数量
+const (
+	defaultExecMaxOutput = 64 * 1024
+	maxExecMaxOutput     = 1024 * 1024
+	maxExecMetrics       = 500
+)
+
+// 单个.prom文件的最大字节数，以及每次从目录中读取的最多指标数量
+const (
+	maxTextfileSize    = 1024 * 1024
+	maxTextfileMetrics = 1000
+)
+
+// StatsD每个采集周期最多聚合的指标数量（名称和标签的组合），以及每个计时器保留的样本数
+const (
+	maxStatsdMetrics      = 1000
+	maxStatsdTimerSamples = 10000
+	maxStatsdSetMembers   = 10000
+	maxStatsdNameLength   = 200
+	maxStatsdPacketSize   = 65535
+)
+
+// StatsD仪表盘连续多少个采集周期没有更新后不再上报，释放占用的指标名额
+const statsdGaugeExpiry = 5
+
+// 外部程序名称只能包含字母、数字、下划线和连字符
+var execNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_-]*$`)
+
+// 脚本名称只能包含字母、数字、点、下划线和连字符，不能指向脚本目录之外的文件
+var scriptNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// 每个采集周期最多补发的暂存指标数量，避免长时间断线后补发阻塞采集
+const spoolReplayBatch = 500
+
+// 序列号每次预留的数量，预留的上限写入文件，重启后从上限继续，避免每次发送都写磁盘
+const sequenceReserveBlock = 1000
+
+// 注册失败后的重试间隔
+const enrollRetryInterval = 10 * time.Second
+
+// 连接或注册某个服务器失败后的初始重试间隔，之后每次失败翻倍，最长为切回间隔
+const linkRetryDelay = 5 * time.Second
+
+// -once模式下基准采集与正式采集之间的间隔
+const localBaselineDelay = time.Second
+
+// 首次采集CPU时记录基准值后等待的时间
+const cpuBaselineDelay = 500 * time.Millisecond
+
+// 认证加密信封格式：魔数(2) | 版本(1) | 密钥ID(8) | nonce(12) | 密文和GCM认证标签
+// 魔数、版本和密钥ID作为附加认证数据参与校验
+const (
+	envelopeVersion   = 2
+	envelopeKeyIDSize = 8
+)
+
+var envelopeMagic = []byte("LM")
+
+// 与服务端握手时使用的HTTP头
+const (
+	compressionHeader = "X-Monitor-Compression" // 代理请求的压缩算法，服务端在响应中返回选定的算法
+	featuresHeader    = "X-Monitor-Features"    // 服务端支持的上报特性，逗号分隔
+)
+
+// Docker容器配置所在目录，用于把容器ID解析为容器名称
+const dockerContainersDir = "/var/lib/docker/containers"
+
+// 容器运行时创建的cgroup目录名，如docker-<id>.scope、cri-containerd-<id>.scope、crio-<id>.scope、libpod-<id>.scope
+var containerScopePattern = regexp.MustCompile(`^(docker|cri-containerd|crio|libpod)-([0-9a-f]{12,})\.scope$`)
+
+// ServerMessage 服务端通过WebSocket下发的消息，使用代理当前的密钥封装为信封
+type ServerMessage struct {
+	Type    string          `json:"type"`              // 消息类型，rotate_secret表示下发新的专属密钥，config表示下发期望配置，command表示诊断命令
+	Secret  string          `json:"secret,omitempty"`  // 新的专属密钥
+	Config  json.RawMessage `json:"config,omitempty"`  // 期望配置，格式与配置文件相同
+	Version string          `json:"version,omitempty"` // 期望配置的版本，为空表示清除服务端下发的配置
+
+	ID        string            `json:"id,omitempty"`         // 命令ID，结果中原样返回
+	Command   string            `json:"command,omitempty"`    // 命令名称：collect_now、top_processes、listening_ports或run_script
+	Args      map[string]string `json:"args,omitempty"`       // 命令参数
+	TimeoutMs int64             `json:"timeout_ms,omitempty"` // 服务端等待结果的时间（毫秒）
+}
+
+// CommandResult 诊断命令的执行结果，使用当前密钥封装为信封发送给服务端
+type CommandResult struct {
+	Type       string      `json:"type"`             // 固定为command_result，服务端据此与指标数据区分
+	AgentID    string      `json:"agent_id"`         // 代理ID
+	ID         string      `json:"id"`               // 命令ID
+	Command    string      `json:"command"`          // 命令名称
+	Status     string      `json:"status"`           // ok或error
+	Error      string      `json:"error,omitempty"`  // 失败原因
+	Result     interface{} `json:"result,omitempty"` // 命令的输出
+	DurationMs int64       `json:"duration_ms"`      // 执行耗时（毫秒）
+
+	link *serverLink // 返回结果的连接
+}
+
+// MetricsBatch 批量上报的指标信封，一帧中包含按采集顺序排列的多个样本
+type MetricsBatch struct {
+	AgentID string          `json:"agent_id"` // 代理ID
+	Batch   []SystemMetrics `json:"batch"`    // 指标样本
 }
 
 // SystemMetrics 系统指标结构体，存储采集的系统性能数据
 type SystemMetrics struct {
 	AgentID        string                 `json:"agent_id"`        // 代理ID
 	Timestamp      int64                  `json:"timestamp"`       // 时间戳
+	Backfill       bool                   `json:"backfill"`        // 是否为断线期间暂存后补发的数据
+	Sequence       uint64                 `json:"seq"`             // 发送时分配的单调递增序列号，服务端据此拒绝重放的数据
+	SentAt         int64                  `json:"sent_at"`         // 发送时间（毫秒），服务端据此计算时钟偏移
 	CPUUsage       float64                `json:"cpu_usage"`       // CPU使用率
 	MemoryInfo     map[string]interface{} `json:"memory_info"`     // 内存信息
 	DiskInfo       map[string]interface{} `json:"disk_info"`       // 磁盘信息
@@ -62,27 +400,389 @@ type SystemMetrics struct {
 	ProcessCount   int                    `json:"process_count"`   // 进程数量
 	SystemInfo     map[string]interface{} `json:"system_info"`     // 系统信息
 	UptimeSeconds  uint64                 `json:"uptime_seconds"`  // 系统运行时间(秒)
+	CPUStats       []CPUStat              `json:"cpu_stats"`       // 汇总及每个核心的CPU模式占比
+	Filesystems    []FilesystemInfo       `json:"filesystems"`     // 各挂载点的空间和inode使用情况
+	DiskIO         []DiskIOStat           `json:"disk_io"`         // 各块设备的IO速率
+	NetInterfaces  []NetInterfaceStat     `json:"net_interfaces"`  // 各网卡的流量速率、错误和丢包
+	ConnStates     []ConnStateCount       `json:"conn_states"`     // 按协议和状态统计的连接数
+	ListeningPorts []ListeningPort        `json:"listening_ports"` // 正在监听的端口及所属进程，为null表示本次没有采集
+	TopProcesses   []ProcessInfo          `json:"top_processes"`   // CPU和内存占用最高的进程
+	Memory         *MemoryStat            `json:"memory"`          // 内存和交换分区明细
+	Pressure       []PressureStat         `json:"pressure"`        // CPU、内存和IO的压力阻塞信息
+	Sensors        []SensorStat           `json:"sensors"`         // 温度和风扇传感器读数
+	Cgroups        []CgroupStat           `json:"cgroups"`         // 各容器、systemd服务和slice的资源占用
+	SystemdUnits   []UnitStat             `json:"systemd_units"`   // 关注的及处于failed状态的systemd单元
+
+	Labels        map[string]string `json:"labels,omitempty"`         // 代理配置的标签
+	ConfigVersion string            `json:"config_version,omitempty"` // 已应用的服务端下发配置版本
+	ConfigError   string            `json:"config_error,omitempty"`   // 拒绝服务端下发配置的原因
+
+	Collectors []CollectorStat `json:"collectors,omitempty"` // 各采集项最近一次采集的耗时和错误
+
+	CustomMetrics []CustomMetric `json:"custom_metrics,omitempty"` // 外部程序等来源的自定义指标
+}
+
+// CustomMetric 单个自定义指标，名称和标签相同的数据在服务端属于同一条曲线
+type CustomMetric struct {
+	Name   string            `json:"name"`             // 指标名称，外部程序的指标以“程序名称.”开头
+	Labels map[string]string `json:"labels,omitempty"` // 标签
+	Value  float64           `json:"value"`            // 数值
+	Unit   string            `json:"unit,omitempty"`   // 单位，如s、ms、%、B
+	Type   string            `json:"type,omitempty"`   // 指标类型，如counter、gauge，来自Prometheus文本格式的TYPE
+	Help   string            `json:"help,omitempty"`   // 指标说明，来自Prometheus文本格式的HELP
+	Source string            `json:"source,omitempty"` // 来源：textfile、statsd或exec:<程序名称>，服务端按来源和名称区分类型和说明
+}
+
+// CollectorStat 单个采集项最近一次采集的耗时和错误
+type CollectorStat struct {
+	Name       string  `json:"name"`            // 采集项名称
+	DurationMs float64 `json:"duration_ms"`     // 耗时（毫秒）
+	LastRun    int64   `json:"last_run"`        // 最近一次开始采集的时间戳，采集间隔长于上报间隔时早于本次上报
+	Error      string  `json:"error,omitempty"` // 采集失败或超时的原因
+}
+
+// UnitStat 单个systemd单元的状态
+type UnitStat struct {
+	Unit           string `json:"unit"`             // 单元名称，如nginx.service
+	LoadState      string `json:"load_state"`       // 加载状态：loaded、not-found等
+	ActiveState    string `json:"active_state"`     // 活动状态：active、inactive、failed等
+	SubState       string `json:"sub_state"`        // 子状态：running、exited、dead等
+	Restarts       int    `json:"restarts"`         // 自动重启次数（NRestarts）
+	StateChangedAt int64  `json:"state_changed_at"` // 最近一次状态变化的时间戳，未知时为0
+	Watched        bool   `json:"watched"`          // 是否为配置中关注的单元
+}
+
+// CgroupStat 单个cgroup（容器、systemd服务或顶层slice）的资源占用
+type CgroupStat struct {
+	Name               string  `json:"name"`                   // 容器名称或systemd单元名称
+	Kind               string  `json:"kind"`                   // 类型：container、service、slice
+	Path               string  `json:"path"`                   // 相对cgroup根目录的路径
+	ContainerID        string  `json:"container_id"`           // 容器ID，非容器为空
+	CPUPercent         float64 `json:"cpu_percent"`            // 两次采集之间的CPU占用，以单核为100%
+	MemoryCurrent      uint64  `json:"memory_current"`         // 当前内存占用（字节）
+	MemoryMax          uint64  `json:"memory_max"`             // 内存上限（字节），0表示不限制
+	OOMKills           uint64  `json:"oom_kills"`              // 累计OOM kill次数
+	IOReadBytes        uint64  `json:"io_read_bytes"`          // 累计读取字节数
+	IOWriteBytes       uint64  `json:"io_write_bytes"`         // 累计写入字节数
+	IOReadBytesPerSec  float64 `json:"io_read_bytes_per_sec"`  // 每秒读取字节数
+	IOWriteBytesPerSec float64 `json:"io_write_bytes_per_sec"` // 每秒写入字节数
+}
+
+// SensorStat 单个硬件传感器的读数
+type SensorStat struct {
+	Sensor   string  `json:"sensor"`   // 传感器标识，如coretemp/Package id 0、thermal/x86_pkg_temp
+	Type     string  `json:"type"`     // 传感器类型：temperature或fan
+	Value    float64 `json:"value"`    // 读数，温度单位为摄氏度，风扇单位为RPM
+	Critical float64 `json:"critical"` // 临界温度（摄氏度），未知或风扇传感器为0
+}
+
+// MemoryStat 内存和交换分区明细，容量单位为字节
+type MemoryStat struct {
+	Total         uint64  `json:"total"`            // 总内存
+	Used          uint64  `json:"used"`             // 已用内存
+	Available     uint64  `json:"available"`        // 可用内存（含可回收的缓存）
+	Cached        uint64  `json:"cached"`           // 页缓存
+	Buffers       uint64  `json:"buffers"`          // 块设备缓冲区
+	Dirty         uint64  `json:"dirty"`            // 等待写回磁盘的脏页
+	Slab          uint64  `json:"slab"`             // 内核slab
+	SwapTotal     uint64  `json:"swap_total"`       // 交换分区总量
+	SwapUsed      uint64  `json:"swap_used"`        // 已用交换分区
+	SwapInPerSec  float64 `json:"swap_in_per_sec"`  // 每秒换入字节数
+	SwapOutPerSec float64 `json:"swap_out_per_sec"` // 每秒换出字节数
+}
+
+// PressureStat 单个资源的压力阻塞信息，avg为对应时间窗口内任务被阻塞的时间占比
+type PressureStat struct {
+	Resource string  `json:"resource"` // 资源：cpu、memory、io
+	Kind     string  `json:"kind"`     // some表示至少一个任务被阻塞，full表示所有非空闲任务被阻塞
+	Avg10    float64 `json:"avg10"`    // 10秒平均值（百分比）
+	Avg60    float64 `json:"avg60"`    // 60秒平均值（百分比）
+	Avg300   float64 `json:"avg300"`   // 300秒平均值（百分比）
+	Total    uint64  `json:"total"`    // 累计阻塞时间（微秒）
+}
+
+// ProcessInfo 单个进程的资源占用
+type ProcessInfo struct {
+	PID        int32   `json:"pid"`         // 进程PID
+	Name       string  `json:"name"`        // 进程名称
+	Cmdline    string  `json:"cmdline"`     // 命令行，超长时截断
+	Username   string  `json:"username"`    // 运行用户
+	CPUPercent float64 `json:"cpu_percent"` // 两次采集之间的CPU占用，以单核为100%
+	RSS        uint64  `json:"rss"`         // 常驻内存（字节）
+	NumFDs     int32   `json:"num_fds"`     // 打开的文件描述符数，无权限时为-1
+	ReadBytes  uint64  `json:"read_bytes"`  // 累计读取字节数
+	WriteBytes uint64  `json:"write_bytes"` // 累计写入字节数
+	TopCPU     bool    `json:"top_cpu"`     // 是否属于CPU占用前N
+	TopMemory  bool    `json:"top_memory"`  // 是否属于内存占用前N
+}
+
+// FilesystemInfo 单个挂载点的空间和inode使用情况
+type FilesystemInfo struct {
+	Mountpoint        string  `json:"mountpoint"`          // 挂载点
+	Device            string  `json:"device"`              // 设备
+	Fstype            string  `json:"fstype"`              // 文件系统类型
+	Total             uint64  `json:"total"`               // 总空间
+	Used              uint64  `json:"used"`                // 已用空间
+	Free              uint64  `json:"free"`                // 可用空间
+	UsedPercent       float64 `json:"used_percent"`        // 空间使用率
+	InodesTotal       uint64  `json:"inodes_total"`        // inode总数
+	InodesUsed        uint64  `json:"inodes_used"`         // 已用inode
+	InodesFree        uint64  `json:"inodes_free"`         // 可用inode
+	InodesUsedPercent float64 `json:"inodes_used_percent"` // inode使用率
+}
+
+// CPUStat 单个CPU核心（或汇总）在两次采集之间各模式的时间占比，单位为百分比
+type CPUStat struct {
+	CPU     string  `json:"cpu"`     // CPU标识，cpu-total表示所有核心汇总
+	Usage   float64 `json:"usage"`   // 总使用率（不含idle和iowait）
+	User    float64 `json:"user"`    // 用户态
+	System  float64 `json:"system"`  // 内核态
+	Nice    float64 `json:"nice"`    // 低优先级用户态
+	Iowait  float64 `json:"iowait"`  // 等待IO
+	Irq     float64 `json:"irq"`     // 硬中断
+	Softirq float64 `json:"softirq"` // 软中断
+	Steal   float64 `json:"steal"`   // 被宿主机抢占
+	Guest   float64 `json:"guest"`   // 运行虚拟机
 }
 
 // 全局配置对象
 var config Config
 
-// 全局WebSocket连接和互斥锁
-var wsConnection *websocket.Conn
-var wsConnectionMutex = &sync.Mutex{}
+// DiskIOStat 单个块设备在两次采集之间的IO速率
+type DiskIOStat struct {
+	Device           string  `json:"device"`              // 设备名
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`  // 每秒读取字节数
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"` // 每秒写入字节数
+	ReadIOPS         float64 `json:"read_iops"`           // 每秒读次数
+	WriteIOPS        float64 `json:"write_iops"`          // 每秒写次数
+	ReadAwaitMs      float64 `json:"read_await_ms"`       // 读请求平均耗时（毫秒）
+	WriteAwaitMs     float64 `json:"write_await_ms"`      // 写请求平均耗时（毫秒）
+	AwaitMs          float64 `json:"await_ms"`            // 所有请求平均耗时（毫秒）
+	UtilPercent      float64 `json:"util_percent"`        // 设备繁忙时间占比
+}
+
+// NetInterfaceStat 单个网卡在两次采集之间的流量速率、错误和丢包
+type NetInterfaceStat struct {
+	Interface         string  `json:"interface"`            // 网卡名称
+	BytesSent         uint64  `json:"bytes_sent"`           // 累计发送字节数
+	BytesRecv         uint64  `json:"bytes_recv"`           // 累计接收字节数
+	BytesSentPerSec   float64 `json:"bytes_sent_per_sec"`   // 每秒发送字节数
+	BytesRecvPerSec   float64 `json:"bytes_recv_per_sec"`   // 每秒接收字节数
+	PacketsSentPerSec float64 `json:"packets_sent_per_sec"` // 每秒发送包数
+	PacketsRecvPerSec float64 `json:"packets_recv_per_sec"` // 每秒接收包数
+	ErrorsIn          uint64  `json:"errors_in"`            // 本周期接收错误数
+	ErrorsOut         uint64  `json:"errors_out"`           // 本周期发送错误数
+	DropsIn           uint64  `json:"drops_in"`             // 本周期接收丢包数
+	DropsOut          uint64  `json:"drops_out"`            // 本周期发送丢包数
+}
+
+// ConnStateCount 某一协议某一状态下的连接数
+type ConnStateCount struct {
+	Protocol string `json:"protocol"` // 协议：tcp4、tcp6、udp4、udp6
+	State    string `json:"state"`    // 连接状态，如ESTABLISHED、TIME_WAIT；UDP为NONE
+	Count    int    `json:"count"`    // 连接数
+}
+
+// ListeningPort 正在监听的端口
+type ListeningPort struct {
+	Protocol string `json:"protocol"` // 协议：tcp4、tcp6、udp4、udp6
+	Address  string `json:"address"`  // 监听地址
+	Port     uint32 `json:"port"`     // 监听端口
+	PID      int32  `json:"pid"`      // 所属进程PID，无权限时为0
+	Process  string `json:"process"`  // 所属进程名称
+}
+
+// 上一次采集的CPU时间，用于计算两次采集之间的各模式占比，键为CPU标识
+var lastCPUTimes = make(map[string]cpu.TimesStat)
+
+// 上一次采集的块设备IO计数及采集时间，用于计算IO速率
+var lastDiskIOCounters map[string]disk.IOCountersStat
+var lastDiskIOTime time.Time
+
+// 上一次采集的网卡计数及采集时间，用于计算网卡速率
+var lastNetIOCounters map[string]net.IOCountersStat
+var lastNetIOTime time.Time
+
+// 上一次采集时各cgroup的CPU累计时间（微秒）和IO累计字节数，键为cgroup相对路径
+var lastCgroupCPU map[string]uint64
+var lastCgroupIO map[string][2]uint64
+var lastCgroupTime time.Time
+
+// 上一次采集的交换分区换入换出累计字节数
+var lastSwapIn, lastSwapOut uint64
+var lastSwapTime time.Time
+
+// 上一次采集时各进程的CPU累计时间（秒）
+var lastProcCPUTimes map[int32]float64
+var lastProcTime time.Time
+
+// 进程采集项和top_processes命令可能同时计算进程CPU占用
+var lastProcMutex = &sync.Mutex{}
+
+// serverLink 与一个服务器的WebSocket连接、握手时协商的特性，以及代理在该服务器上的专属密钥和暂存目录
+type serverLink struct {
+	url     string
+	control bool // 是否接受该服务器下发的配置，fanout模式下只接受主服务器的
+
+	secret      string // 代理在该服务器上的专属密钥，为空时使用共享密钥，由agentSecretMutex保护
+	secretFile  string // 专属密钥文件，为空时不保存
+	enrollToken string // 向该服务器注册使用的令牌，为空表示不注册
+	spoolDir    string // 发送失败的样本暂存目录，fanout模式下每个服务器各有一个
+
+	mutex          sync.Mutex // 保护conn，读取消息的协程断开时会清空
+	conn           *websocket.Conn
+	writeMutex     sync.Mutex    // 主循环发送指标与其他协程发送命令结果时串行写入连接
+	// 以下字段只在主循环中读写
+	compression    string        // 握手时协商的压缩算法
+	batchSupported bool          // 服务端是否支持批量上报
+	retryAt        time.Time     // 连接或注册失败后，在此之前不再尝试
+	retryDelay     time.Duration // 当前的重试间隔
+}
+
+// 按优先级排列的服务器连接，只在主循环中读写
+var links []*serverLink
+
+// failover模式下当前使用的服务器序号，以及上次尝试切回优先级更高的服务器的时间
+var activeLink int
+var lastFailback time.Time
+
+// zstd编码器，创建开销较大，全局复用
+var zstdEncoder *zstd.Encoder
+
+// 发送序列号及已持久化的预留上限
+var sequence uint64
+var sequenceReserved uint64
+var sequenceFile string
+
+// 命令行参数
+var flags struct {
+	serverURL         *string
+	serverMode        *string
+	failbackInterval  *time.Duration
+	interval          *int
+	encryptionKey     *string
+	fsIncludeTypes    *string
+	fsExcludeTypes    *string
+	fsIncludePaths    *string
+	fsExcludePaths    *string
+	diskIOExclude     *string
+	netInclude        *string
+	netExclude        *string
+	topProcesses      *int
+	sysfsRoot         *string
+	cgroupRoot        *string
+	textfileDir       *string
+	statsdAddr        *string
+	statsdPercentiles *string
+	systemdUnits      *string
+	systemdFailed     *bool
+	spoolDir          *string
+	spoolMaxSize      *int64
+	spoolMaxAge       *time.Duration
+	spoolFsync        *bool
+	batchSize         *int
+	batchWait         *time.Duration
+	compression       *string
+	legacyEncryption  *bool
+	enrollToken       *string
+	tlsCA             *string
+	tlsCert           *string
+	tlsKey            *string
+	tlsPin            *string
+	labels            *string
+	disableCollectors *string
+	collectorTimeout  *time.Duration
+	collectorInterval *string
+	collectorTimeouts *string
+	configFile        *string
+	disableCommands   *bool
+	scriptDir         *string
+	once              *bool
+	dryRun            *bool
+	output            *string
+}
+
+// 命令行中显式指定的参数及其取值，以及配置文件路径
+var commandLineFlags = make(map[string]string)
+var configPath string
+
+// 是否以-once或-dry-run模式只在本机输出采集结果
+var localMode bool
+
+// 服务端下发的配置及其版本，优先于本机的所有设置，只在主循环中读写
+var remoteConfig *FileConfig
+var remoteConfigVersion string
+var remoteConfigError string
+var remoteConfigFile string
+
+// 读取消息的协程收到的服务端配置，由主循环应用
+var remoteConfigs = make(chan ServerMessage, 1)
+
+// 读取消息的协程收到的诊断命令，由主循环执行
+var commands = make(chan serverCommand, 16)
+
+// serverCommand 服务端触发的诊断命令，结果通过收到命令的连接返回
+type serverCommand struct {
+	ServerMessage
+	link *serverLink
+}
+
+// 等待下一次采集完成后返回结果的collect_now命令及其开始时间，只在主循环中读写
+var collectNowCommands []pendingCommand
+
+// pendingCommand 已收到但尚未返回结果的诊断命令
+type pendingCommand struct {
+	message serverCommand
+	start   time.Time
+}
+
+// 连接服务端使用的TLS配置，WebSocket和注册请求共用
+var tlsConfig *tls.Config
+
+// 专属密钥文件所在的目录，与代理ID文件相同
+var agentSecretDir string
+
+// 保护各服务器的专属密钥和config中的共享密钥，服务端轮换密钥时由读取消息的协程更新
+var agentSecretMutex = &sync.Mutex{}
 
 // main 主函数，代理程序入口
 func main() {
-	// 解析命令行参数
-	serverURL := flag.String("server", "ws://localhost:8080/ws", "WebSocket服务器URL")
-	interval := flag.Int("interval", 5, "数据采集间隔（秒）")
-	encryptionKey := flag.String("key", "default-encryption-key-change-me", "AES加密密钥")
+	// 解析命令行参数，配置文件和环境变量中的设置同样通过这些参数生效
+	defineFlags()
 	flag.Parse()
 
-	// 设置全局配置
-	config.ServerURL = *serverURL
-	config.Interval = *interval
-	config.EncryptionKey = *encryptionKey
+	// 记录命令行中显式指定的参数，这些参数优先于配置文件和环境变量
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = f.Value.String()
+	})
+	configPath = *flags.configFile
+	if configPath == "" {
+		configPath = os.Getenv(envPrefix + "CONFIG")
+	}
+	localMode = *flags.once || *flags.dryRun
+
+	// 加载并校验配置，上次应用的服务端配置在服务端下发新配置之前继续生效，只在本机输出时不使用
+	if !localMode {
+		loadRemoteConfig()
+	}
+	cfg, err := loadConfig()
+	if err != nil && remoteConfig != nil {
+		log.Printf("忽略上次应用的服务端配置: %v", err)
+		remoteConfig = nil
+		remoteConfigVersion = ""
+		cfg, err = loadConfig()
+	}
+	if err != nil {
+		log.Fatalf("配置无效: %v", err)
+	}
+	config = cfg
+
+	// 只在本机输出采集结果，不连接服务端，也不写入状态文件和监听StatsD端口
+	if localMode {
+		config.AgentID = localAgentID()
+		runLocal()
+		return
+	}
 
 	// 获取或生成代理ID
 	agentID, err := getOrCreateAgentID()
@@ -90,143 +790,3596 @@ func main() {
 		log.Fatalf("获取或创建代理ID失败: %v", err)
 	}
 	config.AgentID = agentID
+	updateStatsdListener()
+
+	// 加载TLS证书
+	tlsConfig, err = buildTLSConfig(config)
+	if err != nil {
+		log.Fatalf("加载TLS配置失败: %v", err)
+	}
 
+	// 恢复发送序列号
+	if err := initSequence(); err != nil {
+		log.Printf("读取序列号文件失败，将根据当前时间生成: %v", err)
+	}
+
+	// 读取代理在各服务器上的专属密钥，尚未向主服务器注册且提供了注册令牌时先注册，其他服务器在首次连接时注册
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		log.Fatalf("获取配置目录失败: %v", err)
+	}
+	agentSecretDir = filepath.Join(configDir, "linux-monitor")
 	log.Printf("代理已启动，ID: %s", agentID)
-	log.Printf("连接到服务器: %s", config.ServerURL)
+	initServerLinks()
+	if err := enrollPrimary(); err != nil {
+		log.Fatalf("代理注册失败: %v", err)
+	}
+	log.Printf("连接到服务器: %s", strings.Join(config.ServerURLs, ", "))
+	if len(config.ServerURLs) > 1 {
+		log.Printf("服务器模式: %s", config.ServerMode)
+	}
 	log.Printf("采集间隔: %d秒", config.Interval)
+	if configPath != "" {
+		log.Printf("配置文件: %s（发送SIGHUP重新加载）", configPath)
+	}
+
+	// 收到SIGHUP时重新加载配置
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// 等待批量发送的样本
+	var pending []SystemMetrics
+	var pendingSince time.Time
 
 	// 启动主采集循环
 	for {
-		// 采集系统指标
-		metrics, err := collectMetrics()
+		// 采集系统指标，收到collect_now时提前开始本次采集并忽略各采集项的采集间隔
+		collectNow := collectNowCommands
+		collectNowCommands = nil
+		metrics, err := collectMetrics(len(collectNow) > 0)
 		if err != nil {
 			log.Printf("采集指标出错: %v", err)
-			time.Sleep(time.Duration(config.Interval) * time.Second)
+			for _, command := range collectNow {
+				finishCommand(newCommandResult(command.message), command.start, nil, err)
+			}
+			waitInterval(reload)
 			continue
 		}
 
-		// 发送指标到服务器
-		err = sendMetrics(metrics)
-		if err != nil {
-			log.Printf("发送指标出错: %v", err)
+		// 攒够一批或等待超时后发送，失败时暂存到磁盘，成功后补发之前暂存的数据
+		// collect_now的样本与之前等待的样本按顺序一起立即发送
+		if len(pending) == 0 {
+			pendingSince = time.Now()
+		}
+		pending = append(pending, metrics)
+		if len(pending) >= config.BatchSize || time.Since(pendingSince) >= config.BatchWait || len(collectNow) > 0 {
+			sent, err := sendBatch(pending)
+			if err != nil {
+				// 逐个发送时前面的样本可能已经送达，只暂存未送达的部分，避免补发时重复存储
+				log.Printf("发送指标出错: %v", err)
+				for _, m := range pending[sent:] {
+					if err := spoolMetrics(config.SpoolDir, m); err != nil {
+						log.Printf("暂存指标出错: %v", err)
+					}
+				}
+			} else {
+				replaySpool(config.SpoolDir, sendPrimary)
+			}
+			metrics = pending[len(pending)-1] // 带上发送时分配的序列号
+			pending = nil
+		}
+		for _, command := range collectNow {
+			finishCommand(newCommandResult(command.message), command.start, metrics, nil)
 		}
 
 		// 等待下一个采集周期
-		time.Sleep(time.Duration(config.Interval) * time.Second)
+		waitInterval(reload)
 	}
 }
 
-// getOrCreateAgentID 从文件获取代理ID或创建新的ID
-func getOrCreateAgentID() (string, error) {
-	// 获取用户配置目录
-	configDir, err := os.UserConfigDir()
+// defineFlags 定义命令行参数
+func defineFlags() {
+	flags.serverURL = flag.String("server", "ws://localhost:8080/ws", "WebSocket服务器URL，多个地址用逗号分隔，按优先级排列")
+	flags.serverMode = flag.String("server-mode", "failover", "配置多个服务器时的工作模式：failover（按优先级使用一个可用的服务器）或fanout（同时发送到所有服务器）")
+	flags.failbackInterval = flag.Duration("failback-interval", time.Minute, "使用备用服务器时尝试切回优先级更高的服务器的间隔，fanout模式下为重新连接失败服务器的间隔")
+	flags.interval = flag.Int("interval", 5, "数据采集间隔（秒）")
+	flags.encryptionKey = flag.String("key", "default-encryption-key-change-me", "AES加密密钥")
+	flags.fsIncludeTypes = flag.String("fs-include-types", "", "只采集这些文件系统类型，逗号分隔（为空表示不限制）")
+	flags.fsExcludeTypes = flag.String("fs-exclude-types", defaultFSExcludeTypes, "忽略的文件系统类型，逗号分隔")
+	flags.fsIncludePaths = flag.String("fs-include-paths", "", "只采集匹配这些路径的挂载点，逗号分隔，支持通配符（为空表示不限制）")
+	flags.fsExcludePaths = flag.String("fs-exclude-paths", defaultFSExcludePaths, "忽略匹配这些路径的挂载点，逗号分隔，支持通配符")
+	flags.diskIOExclude = flag.String("diskio-exclude", defaultDiskIOExclude, "不采集IO速率的块设备名称，逗号分隔，支持通配符")
+	flags.netInclude = flag.String("net-include", "", "只采集这些网卡，逗号分隔，支持通配符（为空表示不限制）")
+	flags.netExclude = flag.String("net-exclude", defaultNetExclude, "忽略的网卡，逗号分隔，支持通配符")
+	flags.topProcesses = flag.Int("top-processes", 10, "按CPU和内存分别上报占用最高的进程数量，0表示不采集")
+	flags.sysfsRoot = flag.String("sysfs-root", "/sys", "sysfs挂载点，用于读取hwmon和thermal传感器")
+	flags.cgroupRoot = flag.String("cgroup-root", "/sys/fs/cgroup", "cgroup v2挂载点，用于采集容器和systemd服务的资源占用")
+	flags.textfileDir = flag.String("textfile-dir", "", "读取该目录下Prometheus文本格式的.prom文件并作为自定义指标上报，为空表示不读取")
+	flags.statsdAddr = flag.String("statsd-addr", "", "StatsD UDP监听地址，如127.0.0.1:8125，为空表示不监听")
+	flags.statsdPercentiles = flag.String("statsd-percentiles", "50,90,95,99", "StatsD计时器上报的百分位数，逗号分隔")
+	flags.systemdUnits = flag.String("systemd-units", "", "需要上报状态的systemd单元，逗号分隔，如nginx.service,docker.service")
+	flags.systemdFailed = flag.Bool("systemd-failed", true, "是否同时上报所有处于failed状态的systemd单元")
+	flags.spoolDir = flag.String("spool-dir", "", "发送失败的指标暂存目录（默认为配置目录下的linux-monitor/spool）")
+	flags.spoolMaxSize = flag.Int64("spool-max-size", 50, "暂存目录的最大容量（MB），超出时丢弃最旧的数据，0表示不暂存")
+	flags.spoolMaxAge = flag.Duration("spool-max-age", 24*time.Hour, "暂存指标的最长保留时间")
+	flags.spoolFsync = flag.Bool("spool-fsync", true, "每次写入暂存文件后是否调用fsync，关闭可减少磁盘写入但断电时可能丢失数据")
+	flags.batchSize = flag.Int("batch-size", 1, "每帧最多包含的样本数，大于1时批量上报（需服务端支持）")
+	flags.batchWait = flag.Duration("batch-wait", 20*time.Second, "批量上报时样本等待的最长时间，应小于服务端的离线判定时间")
+	flags.compression = flag.String("compress", "none", "上报数据的压缩算法：none、gzip或zstd（需服务端支持）")
+	flags.legacyEncryption = flag.Bool("legacy-encryption", false, "使用旧版AES-CFB格式加密，仅用于连接尚未升级的服务端")
+	flags.enrollToken = flag.String("enroll-token", "", "注册令牌，首次连接时换取代理专属密钥（已注册时忽略）；多个服务器使用不同的令牌时用逗号分隔，顺序与-server相同")
+	flags.tlsCA = flag.String("tls-ca", "", "校验服务端证书的CA证书文件（默认使用系统CA）")
+	flags.tlsCert = flag.String("tls-cert", "", "客户端证书文件，用于双向TLS认证")
+	flags.tlsKey = flag.String("tls-key", "", "客户端证书私钥文件")
+	flags.tlsPin = flag.String("tls-pin", "", "允许的服务端证书公钥SHA-256指纹，逗号分隔")
+	flags.configFile = flag.String("config", "", "配置文件路径，扩展名为.json时按JSON解析，否则按YAML解析（也可通过LINUX_MONITOR_CONFIG指定）")
+	flags.labels = flag.String("labels", "", "随指标上报的标签，格式为key=value，逗号分隔")
+	flags.disableCollectors = flag.String("disable-collectors", "", "不启用的采集项，逗号分隔，可选"+strings.Join(knownCollectors, "、"))
+	flags.collectorTimeout = flag.Duration("collector-timeout", 10*time.Second, "单个采集项的默认超时时间，超时的采集项本次上报不包含其数据")
+	flags.collectorInterval = flag.String("collector-intervals", "", "单独设置采集项的采集间隔，格式为采集项=时长，逗号分隔，如connections=1m,processes=30s")
+	flags.collectorTimeouts = flag.String("collector-timeouts", "", "单独设置采集项的超时时间，格式为采集项=时长，逗号分隔，如systemd=3s")
+	flags.disableCommands = flag.Bool("disable-commands", false, "拒绝服务端触发的诊断命令")
+	flags.scriptDir = flag.String("script-dir", "", "允许服务端按名称运行的脚本目录，为空表示不允许运行脚本")
+	flags.once = flag.Bool("once", false, "采集一次并把结果输出到标准输出后退出，不连接服务端")
+	flags.dryRun = flag.Bool("dry-run", false, "按采集间隔持续采集并输出到标准输出，不连接服务端")
+	flags.output = flag.String("output", "table", "-once和-dry-run模式的输出格式：table或json")
+}
+
+// loadConfig 按“参数默认值 < 配置文件 < 环境变量 < 命令行参数 < 服务端下发的配置”的优先级生成配置并校验
+func loadConfig() (Config, error) {
+	var errs []string
+
+	// 参数恢复为命令行中指定的值或默认值，重新加载时从配置文件中删除的项不会残留
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := commandLineFlags[f.Name]; ok {
+			f.Value.Set(value)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+	})
+
+	// 配置文件，外部程序没有对应的命令行参数，直接从配置文件读取
+	var execConfigs []ExecPluginConfig
+	if configPath != "" {
+		fileConfig, err := readConfigFile(configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		execConfigs = fileConfig.Collectors.Exec
+		for name, value := range fileConfig.flagValues() {
+			if _, ok := commandLineFlags[name]; ok {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("配置文件中%s的值无效: %v", name, err))
+			}
+		}
+	}
+
+	// 环境变量
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := commandLineFlags[f.Name]; ok || f.Name == "config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Sprintf("环境变量%s的值无效: %v", name, err))
+			}
+		}
+	})
+
+	// 服务端下发的配置，采集项的开关在本机设置的基础上调整
+	if remoteConfig != nil {
+		for name, value := range remoteConfig.flagValues() {
+			if name == "disable-collectors" {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				errs = append(errs, fmt.Sprintf("服务端下发的配置中%s的值无效: %v", name, err))
+			}
+		}
+		toggles := remoteConfig.collectorToggles()
+		var disabled []string
+		for _, name := range splitList(*flags.disableCollectors) {
+			if enabled, ok := toggles[name]; !ok || !enabled {
+				disabled = append(disabled, name)
+			}
+		}
+		for _, name := range knownCollectors {
+			if enabled, ok := toggles[name]; ok && !enabled && !containsString(disabled, name) {
+				disabled = append(disabled, name)
+			}
+		}
+		flag.Set("disable-collectors", strings.Join(disabled, ","))
+	}
+	if len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	var cfg Config
+	cfg.ServerURLs = splitList(*flags.serverURL)
+	cfg.ServerMode = strings.ToLower(*flags.serverMode)
+	cfg.FailbackInterval = *flags.failbackInterval
+	cfg.Interval = *flags.interval
+	cfg.EncryptionKey = *flags.encryptionKey
+	cfg.FSIncludeTypes = splitList(*flags.fsIncludeTypes)
+	cfg.FSExcludeTypes = splitList(*flags.fsExcludeTypes)
+	cfg.FSIncludePaths = splitList(*flags.fsIncludePaths)
+	cfg.FSExcludePaths = splitList(*flags.fsExcludePaths)
+	cfg.DiskIOExclude = splitList(*flags.diskIOExclude)
+	cfg.NetInclude = splitList(*flags.netInclude)
+	cfg.NetExclude = splitList(*flags.netExclude)
+	cfg.TopProcesses = *flags.topProcesses
+	cfg.SysfsRoot = *flags.sysfsRoot
+	cfg.CgroupRoot = *flags.cgroupRoot
+	cfg.TextfileDir = *flags.textfileDir
+	cfg.StatsdAddr = *flags.statsdAddr
+	cfg.SystemdUnits = splitList(*flags.systemdUnits)
+	cfg.SystemdFailed = *flags.systemdFailed
+	cfg.SpoolDir = *flags.spoolDir
+	cfg.SpoolMaxSize = *flags.spoolMaxSize * 1024 * 1024
+	cfg.SpoolMaxAge = *flags.spoolMaxAge
+	cfg.SpoolFsync = *flags.spoolFsync
+	cfg.BatchSize = *flags.batchSize
+	cfg.BatchWait = *flags.batchWait
+	cfg.Compression = strings.ToLower(*flags.compression)
+	cfg.LegacyEncryption = *flags.legacyEncryption
+	cfg.EnrollTokens = splitList(*flags.enrollToken)
+	cfg.TLSCA = *flags.tlsCA
+	cfg.TLSCert = *flags.tlsCert
+	cfg.TLSKey = *flags.tlsKey
+	for _, pin := range splitList(*flags.tlsPin) {
+		cfg.TLSPins = append(cfg.TLSPins, strings.ToLower(strings.ReplaceAll(pin, ":", "")))
+	}
+	cfg.DisabledCollectors = splitList(*flags.disableCollectors)
+	cfg.CollectorTimeout = *flags.collectorTimeout
+	cfg.CommandsDisabled = *flags.disableCommands
+	cfg.ScriptDir = *flags.scriptDir
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+
+	// 校验配置
+	if len(cfg.ServerURLs) == 0 {
+		errs = append(errs, "至少需要配置一个服务端地址")
+	}
+	for i, serverURL := range cfg.ServerURLs {
+		if u, err := url.Parse(serverURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("服务端地址无效: %q，应为ws://或wss://开头的地址", serverURL))
+		} else if containsString(cfg.ServerURLs[:i], serverURL) {
+			errs = append(errs, fmt.Sprintf("服务端地址重复: %s", serverURL))
+		}
+	}
+	if len(cfg.EnrollTokens) > 1 && len(cfg.EnrollTokens) != len(cfg.ServerURLs) {
+		errs = append(errs, fmt.Sprintf("注册令牌的数量（%d个）应为1个或与服务端地址的数量（%d个）相同", len(cfg.EnrollTokens), len(cfg.ServerURLs)))
+	}
+	switch cfg.ServerMode {
+	case "failover", "fanout":
+	default:
+		errs = append(errs, fmt.Sprintf("不支持的服务器模式: %s，应为failover或fanout", cfg.ServerMode))
+	}
+	if cfg.FailbackInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("切回间隔必须大于0: %v", cfg.FailbackInterval))
+	}
+	if cfg.Interval < 1 {
+		errs = append(errs, fmt.Sprintf("采集间隔必须大于0: %d", cfg.Interval))
+	}
+	if cfg.TopProcesses < 0 {
+		errs = append(errs, fmt.Sprintf("进程数量不能为负数: %d", cfg.TopProcesses))
+	}
+	if cfg.SpoolMaxSize < 0 {
+		errs = append(errs, fmt.Sprintf("暂存目录容量不能为负数: %d", *flags.spoolMaxSize))
+	}
+	if cfg.SpoolMaxAge <= 0 {
+		errs = append(errs, fmt.Sprintf("暂存指标保留时间必须大于0: %v", cfg.SpoolMaxAge))
+	}
+	if cfg.BatchWait < 0 {
+		errs = append(errs, fmt.Sprintf("批量等待时间不能为负数: %v", cfg.BatchWait))
+	}
+	switch cfg.Compression {
+	case "none", "gzip", "zstd":
+	default:
+		errs = append(errs, fmt.Sprintf("不支持的压缩算法: %s", cfg.Compression))
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		errs = append(errs, "客户端证书和私钥必须同时配置")
+	}
+	for _, name := range cfg.DisabledCollectors {
+		if !containsString(knownCollectors, name) {
+			errs = append(errs, fmt.Sprintf("未知的采集项: %s", name))
+		}
+	}
+	if cfg.ScriptDir != "" {
+		if info, err := os.Stat(cfg.ScriptDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("脚本目录不存在: %s", cfg.ScriptDir))
+		}
+	}
+	if cfg.CollectorTimeout <= 0 {
+		errs = append(errs, fmt.Sprintf("采集项超时时间必须大于0: %v", cfg.CollectorTimeout))
+	}
+	intervals, err := parseCollectorDurations(*flags.collectorInterval)
 	if err != nil {
-		return "", err
+		errs = append(errs, fmt.Sprintf("采集项间隔无效: %v", err))
+	}
+	// 不能关闭的采集项写入上报的主要指标，每次上报都需要
+	for _, state := range registeredCollectors {
+		if _, ok := intervals[state.collector.Name()]; ok && !state.optional {
+			errs = append(errs, fmt.Sprintf("采集项%s每次上报都需要采集，不能单独设置采集间隔", state.collector.Name()))
+		}
+	}
+	cfg.CollectorIntervals = intervals
+	timeouts, err := parseCollectorDurations(*flags.collectorTimeouts)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("采集项超时时间无效: %v", err))
+	}
+	cfg.CollectorTimeouts = timeouts
+	if cfg.StatsdAddr != "" {
+		if _, err := stdnet.ResolveUDPAddr("udp", cfg.StatsdAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("StatsD监听地址无效: %v", err))
+		}
+	}
+	for _, s := range splitList(*flags.statsdPercentiles) {
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p <= 0 || p > 100 {
+			errs = append(errs, fmt.Sprintf("StatsD百分位数无效: %q，应在0到100之间", s))
+			continue
+		}
+		cfg.StatsdPercentiles = append(cfg.StatsdPercentiles, p)
+	}
+	plugins, err := parseExecPlugins(execConfigs, &cfg)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	cfg.ExecPlugins = plugins
+	labels, err := parseLabels(*flags.labels)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	cfg.Labels = labels
+	if len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s", strings.Join(errs, "; "))
 	}
 
-	// 创建代理配置目录
-	agentDir := filepath.Join(configDir, "linux-monitor")
-	err = os.MkdirAll(agentDir, 0755)
+	if cfg.Compression == "zstd" && zstdEncoder == nil {
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return Config{}, fmt.Errorf("创建zstd编码器失败: %v", err)
+		}
+		zstdEncoder = encoder
+	}
+	if cfg.SpoolDir == "" {
+		if configDir, err := os.UserConfigDir(); err == nil {
+			cfg.SpoolDir = filepath.Join(configDir, "linux-monitor", "spool")
+		}
+	}
+	// 只在本机输出时不暂存，也不创建暂存目录
+	if cfg.SpoolMaxSize > 0 && cfg.SpoolDir != "" && !localMode {
+		if err := os.MkdirAll(cfg.SpoolDir, 0755); err != nil {
+			log.Printf("创建暂存目录失败，发送失败的指标将被丢弃: %v", err)
+			cfg.SpoolMaxSize = 0
+		}
+	}
+	return cfg, nil
+}
+
+// readConfigFile 读取配置文件，不认识的配置项视为错误
+func readConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
 	}
 
-	// ID文件路径
-	idFilePath := filepath.Join(agentDir, "agent-id")
-	
-	// 检查文件是否存在
-	if _, err := os.Stat(idFilePath); err == nil {
-		// 从文件读取ID
-		data, err := os.ReadFile(idFilePath)
+	var fileConfig FileConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&fileConfig)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&fileConfig)
+	}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// 只保留行号和字段名，去掉Go类型信息
+		messages := make([]string, 0, len(typeErr.Errors))
+		for _, message := range typeErr.Errors {
+			if i := strings.Index(message, " in type "); i >= 0 {
+				message = message[:i]
+			}
+			messages = append(messages, message)
+		}
+		err = fmt.Errorf("%s", strings.Join(messages, "; "))
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("解析配置文件%s失败: %v", path, err)
+	}
+	return &fileConfig, nil
+}
+
+// flagValues 把配置文件中设置了的项转换为对应的命令行参数值
+func (fc *FileConfig) flagValues() map[string]string {
+	values := make(map[string]string)
+	setString := func(name string, v *string) {
+		if v != nil {
+			values[name] = *v
+		}
+	}
+	setList := func(name string, v []string) {
+		if v != nil {
+			values[name] = strings.Join(v, ",")
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			values[name] = strconv.FormatBool(*v)
+		}
+	}
+	setInt := func(name string, v *int) {
+		if v != nil {
+			values[name] = strconv.Itoa(*v)
+		}
+	}
+
+	setString("server", fc.Server)
+	setList("server", fc.Servers)
+	setString("server-mode", fc.ServerMode)
+	setString("failback-interval", fc.FailbackInterval)
+	setInt("interval", fc.Interval)
+	setString("key", fc.Key)
+	setString("enroll-token", fc.EnrollToken)
+	setString("compress", fc.Compression)
+	setBool("legacy-encryption", fc.LegacyEncryption)
+	setMap := func(name string, v map[string]string) {
+		if v != nil {
+			pairs := make([]string, 0, len(v))
+			for k, value := range v {
+				pairs = append(pairs, k+"="+value)
+			}
+			sort.Strings(pairs)
+			values[name] = strings.Join(pairs, ",")
+		}
+	}
+	setMap("labels", fc.Labels)
+
+	c := &fc.Collectors
+	setList("fs-include-types", c.Filesystems.IncludeTypes)
+	setList("fs-exclude-types", c.Filesystems.ExcludeTypes)
+	setList("fs-include-paths", c.Filesystems.IncludePaths)
+	setList("fs-exclude-paths", c.Filesystems.ExcludePaths)
+	setList("diskio-exclude", c.DiskIO.Exclude)
+	setList("net-include", c.Network.Include)
+	setList("net-exclude", c.Network.Exclude)
+	setInt("top-processes", c.Processes.Top)
+	setString("sysfs-root", c.Sensors.SysfsRoot)
+	setString("cgroup-root", c.Cgroups.Root)
+	setString("textfile-dir", c.Textfile.Dir)
+	setString("statsd-addr", c.Statsd.Addr)
+	if c.Statsd.Percentiles != nil {
+		percentiles := make([]string, 0, len(c.Statsd.Percentiles))
+		for _, p := range c.Statsd.Percentiles {
+			percentiles = append(percentiles, strconv.FormatFloat(p, 'f', -1, 64))
+		}
+		values["statsd-percentiles"] = strings.Join(percentiles, ",")
+	}
+	setList("systemd-units", c.Systemd.Units)
+	setBool("systemd-failed", c.Systemd.IncludeFailed)
+	setString("collector-timeout", c.Timeout)
+	setMap("collector-intervals", c.Intervals)
+	setMap("collector-timeouts", c.Timeouts)
+
+	var disabled []string
+	toggles := fc.collectorToggles()
+	for _, name := range knownCollectors {
+		if enabled, ok := toggles[name]; ok && !enabled {
+			disabled = append(disabled, name)
+		}
+	}
+	if len(disabled) > 0 {
+		values["disable-collectors"] = strings.Join(disabled, ",")
+	}
+
+	setString("spool-dir", fc.Spool.Dir)
+	if fc.Spool.MaxSizeMB != nil {
+		values["spool-max-size"] = strconv.FormatInt(*fc.Spool.MaxSizeMB, 10)
+	}
+	setString("spool-max-age", fc.Spool.MaxAge)
+	setBool("spool-fsync", fc.Spool.Fsync)
+	setInt("batch-size", fc.Batch.Size)
+	setString("batch-wait", fc.Batch.Wait)
+
+	setString("tls-ca", fc.TLS.CA)
+	setString("tls-cert", fc.TLS.Cert)
+	setString("tls-key", fc.TLS.Key)
+	setList("tls-pin", fc.TLS.Pins)
+
+	setBool("disable-commands", fc.Commands.Disabled)
+	setString("script-dir", fc.Commands.ScriptDir)
+	return values
+}
+
+// collectorToggles 返回配置中显式启用或关闭的采集项
+func (fc *FileConfig) collectorToggles() map[string]bool {
+	c := &fc.Collectors
+	toggles := make(map[string]bool)
+	for _, collector := range []struct {
+		name    string
+		enabled *bool
+	}{
+		{"filesystems", c.Filesystems.Enabled},
+		{"diskio", c.DiskIO.Enabled},
+		{"network", c.Network.Enabled},
+		{"connections", c.Connections.Enabled},
+		{"pressure", c.Pressure.Enabled},
+		{"processes", c.Processes.Enabled},
+		{"sensors", c.Sensors.Enabled},
+		{"cgroups", c.Cgroups.Enabled},
+		{"systemd", c.Systemd.Enabled},
+		{"textfile", c.Textfile.Enabled},
+		{"statsd", c.Statsd.Enabled},
+	} {
+		if collector.enabled != nil {
+			toggles[collector.name] = *collector.enabled
+		}
+	}
+	return toggles
+}
+
+// parseCollectorDurations 解析“采集项=时长”形式的列表，采集项必须已注册
+func parseCollectorDurations(s string) (map[string]time.Duration, error) {
+	var durations map[string]time.Duration
+	for _, pair := range splitList(s) {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("格式无效: %q，应为采集项=时长", pair)
+		}
+		if !collectorRegistered(name) {
+			return nil, fmt.Errorf("未知的采集项: %s", name)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s的时长无效: %q", name, value)
+		}
+		if durations == nil {
+			durations = make(map[string]time.Duration)
+		}
+		durations[name] = d
+	}
+	return durations, nil
+}
+
+// parseExecPlugins 校验配置文件中的外部程序，单独设置的采集间隔和超时时间写入cfg中对应的采集项
+func parseExecPlugins(list []ExecPluginConfig, cfg *Config) ([]ExecPlugin, error) {
+	var plugins []ExecPlugin
+	var errs []string
+	for i, pc := range list {
+		plugin := ExecPlugin{
+			Name:      pc.Name,
+			Command:   pc.Command,
+			Args:      pc.Args,
+			Format:    strings.ToLower(pc.Format),
+			MaxOutput: pc.MaxOutput,
+			Labels:    pc.Labels,
+		}
+		if !execNamePattern.MatchString(plugin.Name) {
+			errs = append(errs, fmt.Sprintf("第%d个外部程序的名称无效: %q，只能包含字母、数字、下划线和连字符", i+1, plugin.Name))
+			continue
+		}
+		name := "exec:" + plugin.Name
+		for _, p := range plugins {
+			if p.Name == plugin.Name {
+				errs = append(errs, fmt.Sprintf("外部程序名称重复: %s", plugin.Name))
+			}
+		}
+		if !filepath.IsAbs(plugin.Command) {
+			errs = append(errs, fmt.Sprintf("外部程序%s的路径必须是绝对路径: %q", plugin.Name, plugin.Command))
+		}
+		if plugin.Format == "" {
+			plugin.Format = "json"
+		}
+		if plugin.Format != "json" && plugin.Format != "nagios" {
+			errs = append(errs, fmt.Sprintf("外部程序%s的输出格式不支持: %s，应为json或nagios", plugin.Name, pc.Format))
+		}
+		if plugin.MaxOutput == 0 {
+			plugin.MaxOutput = defaultExecMaxOutput
+		}
+		if plugin.MaxOutput < 0 || plugin.MaxOutput > maxExecMaxOutput {
+			errs = append(errs, fmt.Sprintf("外部程序%s的输出上限无效: %d，最大为%d字节", plugin.Name, pc.MaxOutput, maxExecMaxOutput))
+		}
+		setDuration := func(durations *map[string]time.Duration, value string) {
+			if value == "" {
+				return
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				errs = append(errs, fmt.Sprintf("外部程序%s的时长无效: %q", plugin.Name, value))
+				return
+			}
+			if *durations == nil {
+				*durations = make(map[string]time.Duration)
+			}
+			(*durations)[name] = d
+		}
+		setDuration(&cfg.CollectorIntervals, pc.Interval)
+		setDuration(&cfg.CollectorTimeouts, pc.Timeout)
+		plugins = append(plugins, plugin)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return plugins, nil
+}
+
+// parseLabels 解析key=value形式的标签列表
+func parseLabels(s string) (map[string]string, error) {
+	var labels map[string]string
+	for _, pair := range splitList(s) {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("标签格式无效: %q，应为key=value", pair)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[key] = strings.TrimSpace(value)
+	}
+	return labels, nil
+}
+
+// reloadConfig 收到SIGHUP时重新加载配置，配置无效时继续使用原配置
+func reloadConfig() {
+	newConfig, err := loadConfig()
+	if err == nil {
+		err = applyConfig(newConfig)
+	}
+	if err != nil {
+		log.Printf("重新加载配置失败，继续使用原配置: %v", err)
+		return
+	}
+	log.Printf("配置已重新加载，采集间隔: %d秒", config.Interval)
+}
+
+// applyConfig 切换到新的配置，只有服务端地址、服务器模式、注册令牌、暂存目录、压缩算法或TLS设置变化时才重新连接
+func applyConfig(newConfig Config) error {
+	newConfig.AgentID = config.AgentID
+
+	reconnect := strings.Join(newConfig.ServerURLs, ",") != strings.Join(config.ServerURLs, ",") ||
+		newConfig.ServerMode != config.ServerMode ||
+		strings.Join(newConfig.EnrollTokens, ",") != strings.Join(config.EnrollTokens, ",") ||
+		newConfig.SpoolDir != config.SpoolDir ||
+		newConfig.Compression != config.Compression ||
+		newConfig.TLSCA != config.TLSCA ||
+		newConfig.TLSCert != config.TLSCert ||
+		newConfig.TLSKey != config.TLSKey ||
+		strings.Join(newConfig.TLSPins, ",") != strings.Join(config.TLSPins, ",")
+	var newTLSConfig *tls.Config
+	if reconnect {
+		var err error
+		newTLSConfig, err = buildTLSConfig(newConfig)
+		if err != nil {
+			return fmt.Errorf("加载TLS配置失败: %v", err)
+		}
+	}
+
+	// 读取服务端消息的协程通过serverLink的encryptionKey方法读取共享密钥，与它使用同一把锁
+	agentSecretMutex.Lock()
+	config = newConfig
+	agentSecretMutex.Unlock()
+	if localMode {
+		return nil
+	}
+	updateStatsdListener()
+
+	if reconnect {
+		tlsConfig = newTLSConfig
+		initServerLinks()
+		log.Printf("连接设置已变化，重新连接到服务器: %s", strings.Join(config.ServerURLs, ", "))
+	}
+	return nil
+}
+
+// parseRemoteConfig 解析服务端下发的配置，服务端只能修改采集相关的设置，连接、密钥、TLS和标签只能在本机配置
+func parseRemoteConfig(data []byte) (*FileConfig, error) {
+	var fc FileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("解析配置失败: %v", err)
+	}
+
+	var forbidden []string
+	for _, item := range []struct {
+		name string
+		set  bool
+	}{
+		{"server", fc.Server != nil},
+		{"servers", fc.Servers != nil},
+		{"server_mode", fc.ServerMode != nil},
+		{"failback_interval", fc.FailbackInterval != nil},
+		{"key", fc.Key != nil},
+		{"enroll_token", fc.EnrollToken != nil},
+		{"labels", fc.Labels != nil},
+		{"compression", fc.Compression != nil},
+		{"legacy_encryption", fc.LegacyEncryption != nil},
+		{"spool.dir", fc.Spool.Dir != nil},
+		{"tls", fc.TLS.CA != nil || fc.TLS.Cert != nil || fc.TLS.Key != nil || fc.TLS.Pins != nil},
+		{"commands", fc.Commands.Disabled != nil || fc.Commands.ScriptDir != nil},
+		{"collectors.exec", fc.Collectors.Exec != nil},
+		{"collectors.statsd.addr", fc.Collectors.Statsd.Addr != nil},
+	} {
+		if item.set {
+			forbidden = append(forbidden, item.name)
+		}
+	}
+	if len(forbidden) > 0 {
+		return nil, fmt.Errorf("服务端不能修改这些配置项: %s", strings.Join(forbidden, ", "))
+	}
+	return &fc, nil
+}
+
+// loadRemoteConfig 读取上次应用的服务端配置
+func loadRemoteConfig() {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return
+	}
+	remoteConfigFile = filepath.Join(configDir, "linux-monitor", "remote-config.json")
+
+	data, err := os.ReadFile(remoteConfigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取服务端配置失败: %v", err)
+		}
+		return
+	}
+	var message ServerMessage
+	if err := json.Unmarshal(data, &message); err != nil || message.Version == "" {
+		log.Printf("忽略无效的服务端配置文件: %s", remoteConfigFile)
+		return
+	}
+	fc, err := parseRemoteConfig(message.Config)
+	if err != nil {
+		log.Printf("忽略无效的服务端配置: %v", err)
+		return
+	}
+	remoteConfig = fc
+	remoteConfigVersion = message.Version
+	log.Printf("使用上次应用的服务端配置，版本: %s", remoteConfigVersion)
+}
+
+// saveRemoteConfig 保存已应用的服务端配置，重启后继续生效；服务端清除配置时删除文件
+func saveRemoteConfig(message ServerMessage) error {
+	if remoteConfigFile == "" {
+		return nil
+	}
+	if message.Version == "" {
+		if err := os.Remove(remoteConfigFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	tmp := remoteConfigFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, remoteConfigFile)
+}
+
+// applyRemoteConfig 应用服务端下发的配置，已应用的版本随下一次上报发送给服务端
+// 配置无效时继续使用原配置，并在上报中告知服务端拒绝的原因
+func applyRemoteConfig(message ServerMessage) {
+	var fc *FileConfig
+	if message.Version != "" {
+		parsed, err := parseRemoteConfig(message.Config)
+		if err != nil {
+			remoteConfigError = fmt.Sprintf("版本%s: %v", message.Version, err)
+			log.Printf("拒绝服务端下发的配置，%s", remoteConfigError)
+			return
+		}
+		fc = parsed
+	}
+
+	previous := remoteConfig
+	remoteConfig = fc
+	newConfig, err := loadConfig()
+	if err == nil {
+		err = applyConfig(newConfig)
+	}
+	if err != nil {
+		remoteConfig = previous
+		remoteConfigError = fmt.Sprintf("版本%s: %v", message.Version, err)
+		log.Printf("拒绝服务端下发的配置，%s", remoteConfigError)
+		return
+	}
+
+	remoteConfigVersion = message.Version
+	remoteConfigError = ""
+	if err := saveRemoteConfig(message); err != nil {
+		log.Printf("保存服务端下发的配置失败: %v", err)
+	}
+	if message.Version == "" {
+		log.Printf("服务端已清除下发的配置，采集间隔: %d秒", config.Interval)
+	} else {
+		log.Printf("已应用服务端下发的配置，版本: %s，采集间隔: %d秒", message.Version, config.Interval)
+	}
+}
+
+// waitInterval 等待下一个采集周期，收到SIGHUP或服务端下发的配置时应用新配置并立即开始下一次采集
+// 服务端触发的诊断命令在等待期间执行，不影响采集周期；收到collect_now时立即开始下一次采集
+func waitInterval(reload <-chan os.Signal) {
+	timer := time.NewTimer(time.Duration(config.Interval) * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-reload:
+			reloadConfig()
+			return
+		case message := <-remoteConfigs:
+			applyRemoteConfig(message)
+			return
+		case message := <-commands:
+			handleCommand(message)
+			if len(collectNowCommands) > 0 {
+				return
+			}
+		}
+	}
+}
+
+// collectorEnabled 判断采集项是否启用
+func collectorEnabled(name string) bool {
+	return !containsString(config.DisabledCollectors, name)
+}
+
+// initSequence 从代理ID旁的agent-seq文件恢复序列号，文件不存在时以当前毫秒时间为起点
+func initSequence() error {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		sequence = uint64(time.Now().UnixMilli())
+		return err
+	}
+	sequenceFile = filepath.Join(configDir, "linux-monitor", "agent-seq")
+
+	// 取文件记录的预留上限和当前毫秒时间中较大的一个，文件丢失或时钟回拨时都不会重复使用序列号
+	sequence = uint64(time.Now().UnixMilli())
+	data, err := os.ReadFile(sequenceFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	reserved, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return err
+	}
+	if reserved > sequence {
+		sequence = reserved
+	}
+	return nil
+}
+
+// nextSequence 返回下一个序列号，用完预留的序列号时预留下一段并写入文件
+func nextSequence() uint64 {
+	sequence++
+	if sequence > sequenceReserved {
+		sequenceReserved = sequence + sequenceReserveBlock
+		if sequenceFile != "" {
+			if err := os.WriteFile(sequenceFile, []byte(strconv.FormatUint(sequenceReserved, 10)), 0644); err != nil {
+				log.Printf("保存序列号失败: %v", err)
+			}
+		}
+	}
+	return sequence
+}
+
+// buildTLSConfig 根据配置加载CA、客户端证书和证书指纹，均未配置时返回nil使用默认设置
+func buildTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCA == "" && cfg.TLSCert == "" && cfg.TLSKey == "" && len(cfg.TLSPins) == 0 {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.TLSCA != "" {
+		caPEM, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("CA证书文件中没有有效的证书: %s", cfg.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("加载客户端证书失败: %v", err)
+		}
+		// 服务端用证书中的代理ID识别代理，与本机代理ID不一致时上报的数据会被拒绝
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			if id := certificateAgentID(leaf); id != cfg.AgentID {
+				log.Printf("警告: 客户端证书属于代理 %s，与本机代理ID %s 不一致", id, cfg.AgentID)
+			}
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.TLSPins) > 0 {
+		// 只配置指纹时不校验证书链，用于自签名证书；同时配置CA时两者都必须通过
+		if cfg.TLSCA == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("服务端未提供证书")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			fingerprint := hex.EncodeToString(sum[:])
+			if !containsString(cfg.TLSPins, fingerprint) {
+				return fmt.Errorf("服务端证书指纹 %s 不在允许列表中", fingerprint)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// certificateAgentID 从证书得到代理ID，规则与服务端一致：优先使用agent:<ID>形式的URI SAN，否则使用Common Name
+func certificateAgentID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "agent" && uri.Opaque != "" {
+			return uri.Opaque
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// enrollPrimary 尚未向主服务器注册且提供了注册令牌时注册，服务端暂时不可用时持续重试，令牌无效等客户端错误直接返回
+func enrollPrimary() error {
+	link := links[0]
+	if link.enrollToken == "" || link.enrolled() {
+		return nil
+	}
+	for {
+		retry, err := link.enroll()
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return err
+		}
+		log.Printf("代理注册失败，%v后重试: %v", enrollRetryInterval, err)
+		time.Sleep(enrollRetryInterval)
+	}
+}
+
+// enroll 使用注册令牌向该服务器换取专属密钥并保存，返回的retry表示错误是否可以重试
+func (l *serverLink) enroll() (bool, error) {
+	secret, retry, err := enrollAgent(l.url, l.enrollToken)
+	if err != nil {
+		return retry, err
+	}
+	if err := l.saveSecret(secret); err != nil {
+		return false, err
+	}
+	log.Printf("已在%s上注册，专属密钥已保存到 %s", l.url, l.secretFile)
+	return false, nil
+}
+
+// enrollAgent 使用注册令牌向服务器换取专属密钥，返回的retry表示错误是否可以重试
+func enrollAgent(serverURL, token string) (string, bool, error) {
+	endpoint, err := enrollURL(serverURL)
+	if err != nil {
+		return "", false, err
+	}
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(map[string]string{
+		"token":    token,
+		"agent_id": config.AgentID,
+		"hostname": hostname,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Secret string `json:"secret"`
+		Error  string `json:"error"`
+		Detail string `json:"detail"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return "", resp.StatusCode >= 500, fmt.Errorf("服务端返回%d，解析响应失败: %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode >= 500, fmt.Errorf("服务端返回%d: %s %s", resp.StatusCode, result.Error, result.Detail)
+	}
+	if result.Secret == "" {
+		return "", false, fmt.Errorf("服务端未返回专属密钥")
+	}
+	return result.Secret, false, nil
+}
+
+// enrollURL 根据WebSocket地址得到注册接口地址，ws对应http，wss对应https
+func enrollURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/ws") + "/api/enroll"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// serverKey 根据服务器地址生成用于文件名的标识
+func serverKey(serverURL string) string {
+	sum := sha256.Sum256([]byte(serverURL))
+	return hex.EncodeToString(sum[:6])
+}
+
+// loadSecret 读取代理在该服务器上的专属密钥，文件名由服务器地址决定，调整服务器顺序后仍能对应；
+// 主服务器在按地址命名的文件不存在时沿用旧版本的agent-secret文件
+func (l *serverLink) loadSecret(primary bool) {
+	if agentSecretDir == "" {
+		return
+	}
+	l.secretFile = filepath.Join(agentSecretDir, "agent-secret-"+serverKey(l.url))
+	if _, err := os.Stat(l.secretFile); os.IsNotExist(err) && primary {
+		legacy := filepath.Join(agentSecretDir, "agent-secret")
+		if _, err := os.Stat(legacy); err == nil {
+			l.secretFile = legacy
+		}
+	}
+
+	data, err := os.ReadFile(l.secretFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("读取%s的专属密钥失败: %v", l.url, err)
+		}
+		return
+	}
+	l.secret = strings.TrimSpace(string(data))
+	log.Printf("使用在%s上注册的专属密钥", l.url)
+	if config.LegacyEncryption {
+		log.Printf("已在%s上注册，发送到该服务器时忽略-legacy-encryption", l.url)
+	}
+}
+
+// saveSecret 保存代理在该服务器上的专属密钥并立即切换使用，文件只允许当前用户读写
+func (l *serverLink) saveSecret(secret string) error {
+	if l.secretFile != "" {
+		tmp := l.secretFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(secret), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, l.secretFile); err != nil {
+			return err
+		}
+	}
+
+	agentSecretMutex.Lock()
+	l.secret = secret
+	agentSecretMutex.Unlock()
+	return nil
+}
+
+// enrolled 判断代理是否已在该服务器上注册
+func (l *serverLink) enrolled() bool {
+	agentSecretMutex.Lock()
+	defer agentSecretMutex.Unlock()
+	return l.secret != ""
+}
+
+// encryptionKey 返回与该服务器通信使用的密钥，已注册时为专属密钥，否则为共享密钥
+func (l *serverLink) encryptionKey() string {
+	agentSecretMutex.Lock()
+	defer agentSecretMutex.Unlock()
+	if l.secret != "" {
+		return l.secret
+	}
+	return config.EncryptionKey
+}
+
+// getOrCreateAgentID 从文件获取代理ID或创建新的ID
+func getOrCreateAgentID() (string, error) {
+	// 获取用户配置目录
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	// 创建代理配置目录
+	agentDir := filepath.Join(configDir, "linux-monitor")
+	err = os.MkdirAll(agentDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// ID文件路径
+	idFilePath := filepath.Join(agentDir, "agent-id")
+	
+	// 检查文件是否存在
+	if _, err := os.Stat(idFilePath); err == nil {
+		// 从文件读取ID
+		data, err := os.ReadFile(idFilePath)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	// 生成新的UUID
+	newID := uuid.New().String()
+	
+	// 写入文件
+	err = os.WriteFile(idFilePath, []byte(newID), 0644)
+	if err != nil {
+		return "", err
+	}
+	
+	return newID, nil
+}
+
+// localAgentID 读取已有的代理ID，不存在时使用临时生成的ID，不创建目录和文件
+func localAgentID() string {
+	if configDir, err := os.UserConfigDir(); err == nil {
+		if data, err := os.ReadFile(filepath.Join(configDir, "linux-monitor", "agent-id")); err == nil {
+			return string(data)
+		}
+	}
+	return uuid.New().String()
+}
+
+// runLocal 在-once和-dry-run模式下采集指标并输出到标准输出，用于接入服务端之前检查各采集项
+// CPU使用率和速率类指标需要两次采集才能计算，-once模式下先采集一次作为基准，间隔一秒后再采集并输出
+func runLocal() {
+	output := strings.ToLower(*flags.output)
+	if output != "table" && output != "json" {
+		log.Fatalf("不支持的输出格式: %s，应为table或json", *flags.output)
+	}
+	if *flags.once {
+		collectMetrics(true)
+		time.Sleep(localBaselineDelay)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		metrics, err := collectMetrics(*flags.once)
+		if err != nil {
+			log.Printf("采集指标出错: %v", err)
+		} else if output == "json" {
+			data, err := json.MarshalIndent(struct {
+				Metrics    SystemMetrics   `json:"metrics"`
+				Collectors []CollectorStat `json:"collectors"`
+			}{metrics, metrics.Collectors}, "", "  ")
+			if err != nil {
+				log.Fatalf("序列化指标失败: %v", err)
+			}
+			fmt.Println(string(data))
+		} else {
+			printMetrics(os.Stdout, metrics)
+		}
+
+		// 只采集一次时，有采集项失败则以非零状态退出，便于在部署脚本中检查
+		if *flags.once {
+			if err != nil {
+				os.Exit(1)
+			}
+			for _, stat := range metrics.Collectors {
+				if stat.Error != "" {
+					os.Exit(1)
+				}
+			}
+			return
+		}
+		waitInterval(reload)
+	}
+}
+
+// printMetrics 以表格形式输出采集结果，没有数据的部分不输出
+func printMetrics(out io.Writer, metrics SystemMetrics) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	table := func(title string, header string, rows [][]string) {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s\n%s\n", title, header)
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+	}
+	percent := func(v float64) string { return fmt.Sprintf("%.1f%%", v) }
+	rate := func(v float64) string { return formatBytes(v) + "/s" }
+
+	var labels []string
+	for k, v := range metrics.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(w, "Agent ID:\t%s\n", metrics.AgentID)
+	fmt.Fprintf(w, "Hostname:\t%v (%v %v, kernel %v)\n", metrics.SystemInfo["hostname"], metrics.SystemInfo["os"], metrics.SystemInfo["platform"], metrics.SystemInfo["kernel_version"])
+	fmt.Fprintf(w, "Time:\t%s (uptime %v)\n", time.Unix(metrics.Timestamp, 0).Format("2006-01-02 15:04:05"), time.Duration(metrics.UptimeSeconds)*time.Second)
+	if len(labels) > 0 {
+		fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(labels, ","))
+	}
+	if metrics.ConfigVersion != "" || metrics.ConfigError != "" {
+		fmt.Fprintf(w, "Remote config:\t%s %s\n", metrics.ConfigVersion, metrics.ConfigError)
+	}
+	fmt.Fprintf(w, "CPU:\t%s\n", percent(metrics.CPUUsage))
+	if m := metrics.Memory; m != nil {
+		fmt.Fprintf(w, "Memory:\t%s / %s (%s), available %s\n", formatBytes(float64(m.Used)), formatBytes(float64(m.Total)), percent(metrics.MemoryInfo["percent"].(float64)), formatBytes(float64(m.Available)))
+		fmt.Fprintf(w, "Swap:\t%s / %s\n", formatBytes(float64(m.SwapUsed)), formatBytes(float64(m.SwapTotal)))
+	}
+	if total, ok := metrics.DiskInfo["total"].(uint64); ok {
+		fmt.Fprintf(w, "Root disk:\t%s / %s (%s)\n", formatBytes(float64(metrics.DiskInfo["used"].(uint64))), formatBytes(float64(total)), percent(metrics.DiskInfo["percent"].(float64)))
+	}
+	if len(metrics.LoadAverage) > 0 {
+		fmt.Fprintf(w, "Load:\t%.2f %.2f %.2f\n", metrics.LoadAverage["load1"], metrics.LoadAverage["load5"], metrics.LoadAverage["load15"])
+	}
+	fmt.Fprintf(w, "Processes:\t%d\n", metrics.ProcessCount)
+	if sent, ok := metrics.NetworkInfo["bytes_sent"].(uint64); ok {
+		fmt.Fprintf(w, "Network:\tsent %s, received %s\n", formatBytes(float64(sent)), formatBytes(float64(metrics.NetworkInfo["bytes_recv"].(uint64))))
+	}
+	if tcp, ok := metrics.NetworkInfo["tcp_connections"].(int); ok {
+		fmt.Fprintf(w, "Connections:\ttcp %d, udp %d\n", tcp, metrics.NetworkInfo["udp_connections"])
+	}
+
+	var rows [][]string
+	for _, s := range metrics.CPUStats {
+		rows = append(rows, []string{s.CPU, percent(s.Usage), percent(s.User), percent(s.System), percent(s.Iowait), percent(s.Steal)})
+	}
+	table("CPU", "CPU\tUSAGE\tUSER\tSYSTEM\tIOWAIT\tSTEAL", rows)
+
+	rows = nil
+	for _, p := range metrics.Pressure {
+		rows = append(rows, []string{p.Resource, p.Kind, percent(p.Avg10), percent(p.Avg60), percent(p.Avg300)})
+	}
+	table("PRESSURE", "RESOURCE\tKIND\tAVG10\tAVG60\tAVG300", rows)
+
+	rows = nil
+	for _, fs := range metrics.Filesystems {
+		rows = append(rows, []string{fs.Mountpoint, fs.Device, fs.Fstype, formatBytes(float64(fs.Total)), percent(fs.UsedPercent), percent(fs.InodesUsedPercent)})
+	}
+	table("FILESYSTEMS", "MOUNTPOINT\tDEVICE\tTYPE\tSIZE\tUSED\tINODES USED", rows)
+
+	rows = nil
+	for _, d := range metrics.DiskIO {
+		rows = append(rows, []string{d.Device, rate(d.ReadBytesPerSec), rate(d.WriteBytesPerSec), fmt.Sprintf("%.1f", d.ReadIOPS), fmt.Sprintf("%.1f", d.WriteIOPS), fmt.Sprintf("%.2fms", d.AwaitMs), percent(d.UtilPercent)})
+	}
+	table("DISK IO", "DEVICE\tREAD\tWRITE\tREAD IOPS\tWRITE IOPS\tAWAIT\tUTIL", rows)
+
+	rows = nil
+	for _, n := range metrics.NetInterfaces {
+		rows = append(rows, []string{n.Interface, rate(n.BytesSentPerSec), rate(n.BytesRecvPerSec), fmt.Sprintf("%d/%d", n.ErrorsIn, n.ErrorsOut), fmt.Sprintf("%d/%d", n.DropsIn, n.DropsOut)})
+	}
+	table("NETWORK INTERFACES", "INTERFACE\tSENT\tRECEIVED\tERRORS IN/OUT\tDROPS IN/OUT", rows)
+
+	rows = nil
+	for _, p := range metrics.ListeningPorts {
+		rows = append(rows, []string{p.Protocol, p.Address, strconv.FormatUint(uint64(p.Port), 10), strconv.Itoa(int(p.PID)), p.Process})
+	}
+	table("LISTENING PORTS", "PROTO\tADDRESS\tPORT\tPID\tPROCESS", rows)
+
+	rows = nil
+	for _, p := range metrics.TopProcesses {
+		rows = append(rows, []string{strconv.Itoa(int(p.PID)), p.Name, p.Username, percent(p.CPUPercent), formatBytes(float64(p.RSS))})
+	}
+	table("TOP PROCESSES", "PID\tNAME\tUSER\tCPU\tRSS", rows)
+
+	rows = nil
+	for _, s := range metrics.Sensors {
+		rows = append(rows, []string{s.Sensor, s.Type, fmt.Sprintf("%.1f", s.Value), fmt.Sprintf("%.1f", s.Critical)})
+	}
+	table("SENSORS", "SENSOR\tTYPE\tVALUE\tCRITICAL", rows)
+
+	rows = nil
+	for _, c := range metrics.Cgroups {
+		rows = append(rows, []string{c.Name, c.Kind, percent(c.CPUPercent), formatBytes(float64(c.MemoryCurrent)), strconv.FormatUint(c.OOMKills, 10)})
+	}
+	table("CGROUPS", "NAME\tKIND\tCPU\tMEMORY\tOOM KILLS", rows)
+
+	rows = nil
+	for _, u := range metrics.SystemdUnits {
+		rows = append(rows, []string{u.Unit, u.LoadState, u.ActiveState, u.SubState, strconv.Itoa(u.Restarts)})
+	}
+	table("SYSTEMD UNITS", "UNIT\tLOAD\tACTIVE\tSUB\tRESTARTS", rows)
+
+	rows = nil
+	for _, c := range metrics.CustomMetrics {
+		var labels []string
+		for k, v := range c.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		rows = append(rows, []string{c.Name, strings.Join(labels, ","), strconv.FormatFloat(c.Value, 'f', -1, 64), c.Unit})
+	}
+	table("CUSTOM METRICS", "NAME\tLABELS\tVALUE\tUNIT", rows)
+
+	rows = nil
+	for _, c := range metrics.Collectors {
+		status := "ok"
+		if c.Error != "" {
+			status = c.Error
+		}
+		rows = append(rows, []string{c.Name, fmt.Sprintf("%.1fms", c.DurationMs), status})
+	}
+	table("COLLECTORS", "COLLECTOR\tDURATION\tSTATUS", rows)
+	fmt.Fprintln(w)
+}
+
+// formatBytes 把字节数格式化为带二进制单位的字符串
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", b, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", b, units[i])
+}
+
+// Collector 采集项，Collect在单独的协程中运行，cfg为本次采集开始时的配置，返回的函数把采集结果写入上报的指标
+// 采集项按各自的间隔运行，结果只写入启动它的那次上报，未到采集时间的上报中不包含该项数据
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context, cfg Config) (func(*SystemMetrics), error)
+}
+
+// collectorFunc 用函数实现的采集项
+type collectorFunc struct {
+	name    string
+	collect func(ctx context.Context, cfg Config) (func(*SystemMetrics), error)
+}
+
+// Name 返回采集项名称
+func (c collectorFunc) Name() string {
+	return c.name
+}
+
+// Collect 执行采集
+func (c collectorFunc) Collect(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	return c.collect(ctx, cfg)
+}
+
+// collectorState 已注册采集项的调度状态和最近一次的结果
+// running、apply和stat由采集协程在完成时更新，nextRun只在主循环中读写；apply写入上报后清空
+type collectorState struct {
+	collector Collector
+	optional  bool
+	nextRun   time.Time
+
+	mutex    sync.Mutex
+	running  bool
+	timedOut bool // 本次采集已超时，结束后丢弃结果
+	apply    func(*SystemMetrics)
+	stat     CollectorStat
+}
+
+// 按上报顺序注册的采集项
+var registeredCollectors []*collectorState
+
+// registerCollector 注册采集项，optional为true的可以通过配置文件或-disable-collectors关闭
+func registerCollector(c Collector, optional bool) {
+	registeredCollectors = append(registeredCollectors, &collectorState{collector: c, optional: optional})
+	if optional {
+		knownCollectors = append(knownCollectors, c.Name())
+	}
+}
+
+// init 注册内置的采集项
+func init() {
+	registerCollector(collectorFunc{"cpu", collectCPU}, false)
+	registerCollector(collectorFunc{"memory", collectMemory}, false)
+	registerCollector(collectorFunc{"pressure", collectPressureMetrics}, true)
+	registerCollector(collectorFunc{"disk", collectRootDisk}, false)
+	registerCollector(collectorFunc{"filesystems", collectFilesystemMetrics}, true)
+	registerCollector(collectorFunc{"diskio", collectDiskIOMetrics}, true)
+	registerCollector(collectorFunc{"netio", collectNetIO}, false)
+	registerCollector(collectorFunc{"network", collectNetInterfaceMetrics}, true)
+	registerCollector(collectorFunc{"connections", collectConnectionMetrics}, true)
+	registerCollector(collectorFunc{"load", collectLoad}, false)
+	registerCollector(collectorFunc{"process_count", collectProcessCount}, false)
+	registerCollector(collectorFunc{"processes", collectProcessMetrics}, true)
+	registerCollector(collectorFunc{"sensors", collectSensorMetrics}, true)
+	registerCollector(collectorFunc{"cgroups", collectCgroupMetrics}, true)
+	registerCollector(collectorFunc{"systemd", collectSystemdMetrics}, true)
+	registerCollector(collectorFunc{"textfile", collectTextfileMetrics}, true)
+	registerCollector(collectorFunc{"statsd", collectStatsdMetrics}, true)
+	registerCollector(collectorFunc{"host", collectHost}, false)
+}
+
+// 根据配置中的外部程序生成的采集项，只在主循环中读写
+var execCollectors []*collectorState
+
+// updateExecCollectors 根据当前配置更新外部程序采集项，定义未变化的沿用原来的调度状态和最近一次的结果
+func updateExecCollectors() {
+	previous := make(map[string]*collectorState, len(execCollectors))
+	for _, state := range execCollectors {
+		previous[state.collector.Name()] = state
+	}
+	execCollectors = nil
+	for _, plugin := range config.ExecPlugins {
+		c := &execCollector{plugin: plugin}
+		if state, ok := previous[c.Name()]; ok && reflect.DeepEqual(state.collector.(*execCollector).plugin, plugin) {
+			execCollectors = append(execCollectors, state)
+			continue
+		}
+		execCollectors = append(execCollectors, &collectorState{collector: c})
+	}
+}
+
+// collectorRegistered 判断是否存在该名称的采集项
+func collectorRegistered(name string) bool {
+	for _, state := range registeredCollectors {
+		if state.collector.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collectorInterval 返回采集项的采集间隔，未单独配置或短于全局采集间隔时使用全局采集间隔
+func collectorInterval(name string) time.Duration {
+	interval := time.Duration(config.Interval) * time.Second
+	if d, ok := config.CollectorIntervals[name]; ok && d > interval {
+		return d
+	}
+	return interval
+}
+
+// collectorTimeout 返回采集项的超时时间
+func collectorTimeout(name string) time.Duration {
+	if d, ok := config.CollectorTimeouts[name]; ok {
+		return d
+	}
+	return config.CollectorTimeout
+}
+
+// run 使用配置快照运行采集项并保存结果，采集项发生panic时视为采集失败；超时后才结束的采集结果被丢弃
+func (s *collectorState) run(cfg Config, timeout time.Duration, done chan<- struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	apply, err := func() (apply func(*SystemMetrics), err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				apply, err = nil, fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return s.collector.Collect(ctx, cfg)
+	}()
+	stat := CollectorStat{Name: s.collector.Name(), DurationMs: float64(time.Since(start).Microseconds()) / 1000, LastRun: start.Unix()}
+	if err != nil {
+		stat.Error = err.Error()
+		log.Printf("采集%s出错: %v", stat.Name, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running = false
+	// 超时的那次上报已经记录了错误，迟到的结果时间戳不对，不再写入之后的上报
+	if s.timedOut {
+		s.timedOut = false
+		log.Printf("采集%s在超时后才结束（耗时%v），丢弃结果", stat.Name, time.Since(start).Round(time.Millisecond))
+		return
+	}
+	s.apply = apply
+	s.stat = stat
+}
+
+// collectMetrics 并发运行到期的采集项，并把本次完成的结果汇总为一次上报的指标，各采集项的状态使用最近一次的
+// all为true时忽略各采集项的采集间隔，全部立即采集；超时未完成的采集项不再等待，本次上报中不包含它的数据，状态中记录超时错误
+func collectMetrics(all bool) (SystemMetrics, error) {
+	// 初始化指标结构体
+	metrics := SystemMetrics{
+		AgentID:       config.AgentID,
+		Timestamp:     time.Now().Unix(),
+		Labels:        config.Labels,
+		ConfigVersion: remoteConfigVersion,
+		ConfigError:   remoteConfigError,
+		MemoryInfo:    make(map[string]interface{}),
+		DiskInfo:      make(map[string]interface{}),
+		NetworkInfo:   make(map[string]interface{}),
+		LoadAverage:   make(map[string]interface{}),
+		SystemInfo:    make(map[string]interface{}),
+	}
+
+	// 启动到期的采集项，上次采集仍未结束的（之前超时）不重复启动
+	type pendingRun struct {
+		state   *collectorState
+		timeout time.Duration
+		done    chan struct{}
+	}
+	updateExecCollectors()
+	collectors := append(append([]*collectorState(nil), registeredCollectors...), execCollectors...)
+	cfg := config
+	start := time.Now()
+	var runs []pendingRun
+	for _, state := range collectors {
+		name := state.collector.Name()
+		if !collectorEnabled(name) {
+			state.nextRun = time.Time{}
+			continue
+		}
+		if !all && start.Before(state.nextRun) {
+			continue
+		}
+
+		state.mutex.Lock()
+		running := state.running
+		if running {
+			state.apply = nil
+			state.stat = CollectorStat{Name: name, LastRun: state.stat.LastRun, Error: "上次采集尚未结束"}
+		} else {
+			state.running = true
+		}
+		state.mutex.Unlock()
+		if running {
+			continue
+		}
+
+		state.nextRun = start.Add(collectorInterval(name))
+		run := pendingRun{state: state, timeout: collectorTimeout(name), done: make(chan struct{})}
+		go state.run(cfg, run.timeout, run.done)
+		runs = append(runs, run)
+	}
+
+	// 等待本次启动的采集项完成，各采集项同时开始，按各自的超时时间计算截止时间
+	for _, run := range runs {
+		timer := time.NewTimer(time.Until(start.Add(run.timeout)))
+		select {
+		case <-run.done:
+		case <-timer.C:
+			run.state.mutex.Lock()
+			if run.state.running {
+				name := run.state.collector.Name()
+				run.state.timedOut = true
+				run.state.apply = nil
+				run.state.stat = CollectorStat{Name: name, DurationMs: float64(run.timeout.Milliseconds()), LastRun: start.Unix(), Error: fmt.Sprintf("采集超时（%v）", run.timeout)}
+				log.Printf("采集%s超时（%v），本次上报不包含该项数据", name, run.timeout)
+			}
+			run.state.mutex.Unlock()
+		}
+		timer.Stop()
+	}
+
+	// 按注册顺序写入本次完成的结果，外部程序在内置采集项之后；结果只写入一次，避免服务端重复存储
+	for _, state := range collectors {
+		if !collectorEnabled(state.collector.Name()) {
+			continue
+		}
+		state.mutex.Lock()
+		if state.apply != nil {
+			state.apply(&metrics)
+			state.apply = nil
+		}
+		if state.stat.Name != "" {
+			metrics.Collectors = append(metrics.Collectors, state.stat)
+		}
+		state.mutex.Unlock()
+	}
+
+	return metrics, nil
+}
+
+// collectCPU 根据两次采集之间的CPU时间计算总使用率和各模式占比
+// 只有首次采集时先记录基准值并等待一小段时间，之后不再阻塞
+func collectCPU(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	stats, err := collectCPUStats()
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		select {
+		case <-time.After(cpuBaselineDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if stats, err = collectCPUStats(); err != nil {
+			return nil, err
+		}
+	}
+	var usage float64
+	for _, s := range stats {
+		if s.CPU == "cpu-total" {
+			usage = s.Usage
+		}
+	}
+	return func(m *SystemMetrics) {
+		m.CPUUsage = usage
+		m.CPUStats = stats
+	}, nil
+}
+
+// collectMemory 采集内存信息
+func collectMemory(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	memInfo, err := mem.VirtualMemoryWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stat := collectMemoryStat(memInfo)
+	return func(m *SystemMetrics) {
+		m.MemoryInfo["total"] = memInfo.Total         // 总内存
+		m.MemoryInfo["used"] = memInfo.Used           // 已用内存
+		m.MemoryInfo["percent"] = memInfo.UsedPercent // 内存使用率
+		m.Memory = stat
+	}, nil
+}
+
+// collectPressureMetrics 采集CPU、内存和IO的压力阻塞信息
+func collectPressureMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	pressure, err := collectPressure(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.Pressure = pressure }, nil
+}
+
+// collectRootDisk 采集根分区的使用情况
+func collectRootDisk(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	diskInfo, err := disk.UsageWithContext(ctx, "/")
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) {
+		m.DiskInfo["total"] = diskInfo.Total         // 总磁盘空间
+		m.DiskInfo["used"] = diskInfo.Used           // 已用空间
+		m.DiskInfo["percent"] = diskInfo.UsedPercent // 磁盘使用率
+	}, nil
+}
+
+// collectFilesystemMetrics 采集各挂载点的文件系统信息
+func collectFilesystemMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	filesystems, err := collectFilesystems(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.Filesystems = filesystems }, nil
+}
+
+// collectDiskIOMetrics 采集各块设备的IO速率
+func collectDiskIOMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	stats, err := collectDiskIO(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.DiskIO = stats }, nil
+}
+
+// collectNetIO 采集所有网卡的累计流量
+func collectNetIO(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	netIO, err := net.IOCountersWithContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) {
+		if len(netIO) > 0 {
+			m.NetworkInfo["bytes_sent"] = netIO[0].BytesSent // 发送字节数
+			m.NetworkInfo["bytes_recv"] = netIO[0].BytesRecv // 接收字节数
+		}
+	}, nil
+}
+
+// collectNetInterfaceMetrics 采集各网卡的流量速率、错误和丢包
+func collectNetInterfaceMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	stats, err := collectNetInterfaces(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.NetInterfaces = stats }, nil
+}
+
+// collectConnectionMetrics 采集TCP/UDP连接状态和监听端口，部分协议失败时仍上报已采集到的连接状态
+func collectConnectionMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	states, listening, err := collectConnections(ctx)
+	protocolCounts := map[string]int{"tcp4": 0, "tcp6": 0, "udp4": 0, "udp6": 0}
+	for _, s := range states {
+		protocolCounts[s.Protocol] += s.Count
+	}
+	// 部分协议采集失败时监听端口不完整，不上报（nil），避免服务端把未采集到的期望端口视为停止监听
+	if err != nil {
+		listening = nil
+	} else if listening == nil {
+		listening = []ListeningPort{}
+	}
+	return func(m *SystemMetrics) {
+		m.ConnStates, m.ListeningPorts = states, listening
+		for protocol, count := range protocolCounts {
+			m.NetworkInfo[protocol+"_connections"] = count // 按IPv4/IPv6区分的连接数
+		}
+		m.NetworkInfo["tcp_connections"] = protocolCounts["tcp4"] + protocolCounts["tcp6"] // TCP连接数
+		m.NetworkInfo["udp_connections"] = protocolCounts["udp4"] + protocolCounts["udp6"] // UDP连接数
+	}, err
+}
+
+// collectLoad 采集负载平均值
+func collectLoad(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	loadInfo, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) {
+		m.LoadAverage["load1"] = loadInfo.Load1   // 1分钟负载
+		m.LoadAverage["load5"] = loadInfo.Load5   // 5分钟负载
+		m.LoadAverage["load15"] = loadInfo.Load15 // 15分钟负载
+	}, nil
+}
+
+// collectProcessCount 采集进程数
+func collectProcessCount(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	pids, err := process.PidsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	count := len(pids)
+	return func(m *SystemMetrics) { m.ProcessCount = count }, nil
+}
+
+// collectProcessMetrics 采集CPU和内存占用最高的进程
+func collectProcessMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	if cfg.TopProcesses <= 0 {
+		return nil, nil
+	}
+	processes, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	top, err := collectTopProcesses(ctx, processes, cfg.TopProcesses)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.TopProcesses = top }, nil
+}
+
+// collectSensorMetrics 采集温度和风扇传感器
+func collectSensorMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	sensors, err := collectSensors(ctx, cfg.SysfsRoot)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.Sensors = sensors }, nil
+}
+
+// collectCgroupMetrics 采集容器和systemd服务的资源占用
+func collectCgroupMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	cgroups, err := collectCgroups(ctx, cfg.CgroupRoot)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.Cgroups = cgroups }, nil
+}
+
+// collectSystemdMetrics 采集systemd单元状态
+func collectSystemdMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	if len(cfg.SystemdUnits) == 0 && !cfg.SystemdFailed {
+		return nil, nil
+	}
+	units, err := collectSystemdUnits(ctx, cfg.SystemdUnits, cfg.SystemdFailed)
+	if units == nil && err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) { m.SystemdUnits = units }, err
+}
+
+// collectHost 采集系统信息
+func collectHost(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	hostInfo, err := host.InfoWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(m *SystemMetrics) {
+		m.SystemInfo["hostname"] = hostInfo.Hostname            // 主机名
+		m.SystemInfo["os"] = hostInfo.OS                        // 操作系统
+		m.SystemInfo["platform"] = hostInfo.Platform            // 系统平台
+		m.SystemInfo["kernel_version"] = hostInfo.KernelVersion // 内核版本
+		m.UptimeSeconds = hostInfo.Uptime                       // 系统运行时间
+	}, nil
+}
+
+// collectTextfileMetrics 读取-textfile-dir目录下的.prom文件，未配置目录时不采集
+func collectTextfileMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	if cfg.TextfileDir == "" {
+		return nil, nil
+	}
+	metrics, err := collectTextfiles(cfg.TextfileDir)
+	for i := range metrics {
+		metrics[i].Source = "textfile"
+	}
+	return func(m *SystemMetrics) {
+		m.CustomMetrics = append(m.CustomMetrics, metrics...)
+	}, err
+}
+
+// collectStatsdMetrics 汇总StatsD监听在本采集周期内收到的数据，未配置监听地址时不采集
+func collectStatsdMetrics(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	statsdMutex.Lock()
+	s := statsd
+	statsdMutex.Unlock()
+	if s == nil {
+		// 只在本机输出时不监听端口
+		if cfg.StatsdAddr != "" && !localMode {
+			return nil, fmt.Errorf("StatsD未在%s上监听", cfg.StatsdAddr)
+		}
+		return nil, nil
+	}
+
+	metrics, invalid, dropped := s.flush(time.Now(), cfg.StatsdPercentiles)
+	for i := range metrics {
+		metrics[i].Source = "statsd"
+	}
+	var problems []string
+	if invalid > 0 {
+		problems = append(problems, fmt.Sprintf("%d行格式无效", invalid))
+	}
+	if dropped > 0 {
+		problems = append(problems, fmt.Sprintf("指标数量超过%d个，丢弃了%d个样本", maxStatsdMetrics, dropped))
+	}
+	var err error
+	if len(problems) > 0 {
+		err = fmt.Errorf("本周期%s", strings.Join(problems, "，"))
+	}
+	return func(m *SystemMetrics) {
+		m.CustomMetrics = append(m.CustomMetrics, metrics...)
+	}, err
+}
+
+// statsdServer StatsD UDP监听及当前采集周期内的聚合数据
+type statsdServer struct {
+	addr string
+	conn stdnet.PacketConn
+
+	mutex   sync.Mutex
+	metrics map[string]*statsdMetric // 键为类型、名称和排序后的标签
+	since   time.Time                // 当前采集周期的开始时间
+	invalid int                      // 当前采集周期内格式无效的行数
+	dropped int                      // 当前采集周期内因指标数量超过上限而丢弃的样本数
+}
+
+// statsdMetric 类型、名称和标签相同的StatsD样本在当前采集周期内的聚合值
+type statsdMetric struct {
+	name   string
+	kind   string // counter、gauge、timer或set
+	unit   string // 单位，ms类型的计时器为ms
+	labels map[string]string
+
+	count    float64             // 计数器按采样率换算后的累计值，或计时器按采样率换算后的样本数
+	value    float64             // 仪表盘的当前值
+	samples  []float64           // 计时器的样本，最多保留maxStatsdTimerSamples个
+	min, max float64             // 计时器所有样本的最小值和最大值
+	sum      float64             // 计时器所有样本的总和
+	seen     int                 // 计时器实际收到的样本数
+	members  map[string]struct{} // 集合中出现过的不同值
+	idle     int                 // 仪表盘连续没有更新的采集周期数
+}
+
+// 当前的StatsD监听，未启用或监听失败时为nil
+var statsd *statsdServer
+var statsdMutex = &sync.Mutex{}
+
+// updateStatsdListener 根据配置启动、重新启动或关闭StatsD监听，监听地址不变时保留当前采集周期内已经聚合的数据
+func updateStatsdListener() {
+	addr := config.StatsdAddr
+	if !collectorEnabled("statsd") {
+		addr = ""
+	}
+	statsdMutex.Lock()
+	defer statsdMutex.Unlock()
+	if statsd != nil && statsd.addr == addr {
+		return
+	}
+
+	if statsd != nil {
+		statsd.conn.Close()
+		log.Printf("StatsD监听已关闭: %s", statsd.addr)
+		statsd = nil
+	}
+	if addr == "" {
+		return
+	}
+	conn, err := stdnet.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("StatsD监听%s失败: %v", addr, err)
+		return
+	}
+	statsd = &statsdServer{addr: addr, conn: conn, metrics: make(map[string]*statsdMetric), since: time.Now()}
+	go statsd.serve()
+	log.Printf("StatsD监听: %s", conn.LocalAddr())
+}
+
+// serve 接收StatsD数据包直到监听关闭，一个数据包可以包含多行
+func (s *statsdServer) serve() {
+	buf := make([]byte, maxStatsdPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, stdnet.ErrClosed) {
+				log.Printf("接收StatsD数据出错，停止监听: %v", err)
+			}
+			return
+		}
+		s.mutex.Lock()
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if err := s.add(line); err != nil {
+				s.invalid++
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// add 解析一行StatsD数据并累加到当前采集周期，调用方持有s.mutex
+// 格式为name:value|type[|@sample_rate][|#tag1:value1,tag2]，type为c（计数器）、g（仪表盘）、ms、h或d（计时器）、s（集合）
+// 仪表盘的值以+或-开头时表示在当前值上增减；DogStatsD的事件、服务检查和其他扩展字段忽略
+func (s *statsdServer) add(line string) error {
+	if strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return nil
+	}
+	name, rest, ok := strings.Cut(line, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || len(name) > maxStatsdNameLength {
+		return fmt.Errorf("指标名称无效")
+	}
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("缺少类型")
+	}
+	value := strings.TrimSpace(fields[0])
+
+	var kind string
+	switch fields[1] {
+	case "c":
+		kind = "counter"
+	case "g":
+		kind = "gauge"
+	case "ms", "h", "d":
+		kind = "timer"
+	case "s":
+		kind = "set"
+	default:
+		return fmt.Errorf("不支持的类型: %s", fields[1])
+	}
+
+	rate := 1.0
+	var labels map[string]string
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("采样率无效: %s", field)
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			for _, tag := range strings.Split(field[1:], ",") {
+				key, v, _ := strings.Cut(tag, ":")
+				if key = strings.TrimSpace(key); key == "" {
+					continue
+				}
+				if labels == nil {
+					labels = make(map[string]string)
+				}
+				labels[key] = strings.TrimSpace(v)
+			}
+		}
+	}
+
+	var v float64
+	if kind != "set" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return fmt.Errorf("值无效: %s", value)
+		}
+		v = parsed
+	}
+
+	tags := make([]string, 0, len(labels))
+	for k, tagValue := range labels {
+		tags = append(tags, k+"="+tagValue)
+	}
+	sort.Strings(tags)
+	key := kind + "|" + name + "|" + strings.Join(tags, ",")
+	m, ok := s.metrics[key]
+	if !ok {
+		if len(s.metrics) >= maxStatsdMetrics {
+			s.dropped++
+			return nil
+		}
+		m = &statsdMetric{name: name, kind: kind, labels: labels}
+		if fields[1] == "ms" {
+			m.unit = "ms"
+		}
+		s.metrics[key] = m
+	}
+
+	switch kind {
+	case "counter":
+		m.count += v / rate
+	case "gauge":
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			m.value += v
+		} else {
+			m.value = v
+		}
+		m.idle = 0
+	case "timer":
+		if m.seen == 0 || v < m.min {
+			m.min = v
+		}
+		if m.seen == 0 || v > m.max {
+			m.max = v
+		}
+		m.count += 1 / rate
+		m.sum += v
+		m.seen++
+		if len(m.samples) < maxStatsdTimerSamples {
+			m.samples = append(m.samples, v)
+		}
+	case "set":
+		if m.members == nil {
+			m.members = make(map[string]struct{})
+		}
+		if len(m.members) < maxStatsdSetMembers {
+			m.members[value] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// flush 返回当前采集周期的聚合结果以及格式无效的行数和丢弃的样本数，然后开始新的周期
+// 计数器上报累计值name.count和每秒速率name.rate；计时器上报name.count、name.min、name.max、name.mean和各百分位数name.p<N>；
+// 集合上报不同值的数量name；仪表盘上报当前值name并保留到下一个周期，连续statsdGaugeExpiry个周期没有更新后删除
+func (s *statsdServer) flush(now time.Time, percentiles []float64) ([]CustomMetric, int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elapsed := now.Sub(s.since).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	keys := make([]string, 0, len(s.metrics))
+	for key := range s.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var metrics []CustomMetric
+	for _, key := range keys {
+		m := s.metrics[key]
+		add := func(suffix string, value float64, unit string) {
+			metrics = append(metrics, CustomMetric{Name: m.name + suffix, Labels: m.labels, Value: value, Unit: unit, Type: m.kind})
+		}
+		switch m.kind {
+		case "counter":
+			add(".count", m.count, "")
+			add(".rate", m.count/elapsed, "/s")
+		case "gauge":
+			if m.idle >= statsdGaugeExpiry {
+				break
+			}
+			add("", m.value, "")
+			m.idle++
+			continue
+		case "timer":
+			sort.Float64s(m.samples)
+			add(".count", m.count, "")
+			add(".min", m.min, m.unit)
+			add(".max", m.max, m.unit)
+			add(".mean", m.sum/float64(m.seen), m.unit)
+			for _, p := range percentiles {
+				i := int(math.Ceil(p/100*float64(len(m.samples)))) - 1
+				if i < 0 {
+					i = 0
+				}
+				name := ".p" + strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_")
+				add(name, m.samples[i], m.unit)
+			}
+		case "set":
+			add("", float64(len(m.members)), "")
+		}
+		delete(s.metrics, key)
+	}
+
+	invalid, dropped := s.invalid, s.dropped
+	s.since = now
+	s.invalid = 0
+	s.dropped = 0
+	return metrics, invalid, dropped
+}
+
+// execCollector 运行配置的外部程序，把标准输出解析为自定义指标
+type execCollector struct {
+	plugin ExecPlugin
+}
+
+// Name 返回采集项名称exec:<程序名称>
+func (c *execCollector) Name() string {
+	return "exec:" + c.plugin.Name
+}
+
+// Collect 运行外部程序，超时后终止进程；Nagios格式的程序退出码为0到3时都视为成功，退出码作为status指标上报
+func (c *execCollector) Collect(ctx context.Context, cfg Config) (func(*SystemMetrics), error) {
+	p := c.plugin
+	stdout := &limitedBuffer{limit: p.MaxOutput}
+	stderr := &limitedBuffer{limit: 4096}
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// 程序被终止后不再等待它启动的子进程关闭输出
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("执行超时，已终止")
+	}
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil && !(p.Format == "nagios" && exitCode >= 0 && exitCode <= 3) {
+		if message := strings.TrimSpace(stderr.buf.String()); message != "" {
+			return nil, fmt.Errorf("执行失败: %v: %s", err, strings.SplitN(message, "\n", 2)[0])
+		}
+		return nil, fmt.Errorf("执行失败: %v", err)
+	}
+	if stdout.truncated {
+		return nil, fmt.Errorf("标准输出超过%d字节", p.MaxOutput)
+	}
+
+	var metrics []CustomMetric
+	if p.Format == "nagios" {
+		metrics, err = parseNagiosOutput(stdout.buf.String())
+		metrics = append([]CustomMetric{{Name: "status", Value: float64(exitCode)}}, metrics...)
+	} else {
+		metrics, err = parseJSONOutput(stdout.buf.Bytes())
+	}
+	if len(metrics) > maxExecMetrics {
+		metrics = metrics[:maxExecMetrics]
+		if err == nil {
+			err = fmt.Errorf("指标数量超过%d个，多出的部分已丢弃", maxExecMetrics)
+		}
+	}
+	for i := range metrics {
+		metrics[i].Name = p.Name + "." + metrics[i].Name
+		metrics[i].Source = c.Name()
+		if len(p.Labels) > 0 {
+			labels := make(map[string]string, len(p.Labels)+len(metrics[i].Labels))
+			for k, v := range metrics[i].Labels {
+				labels[k] = v
+			}
+			for k, v := range p.Labels {
+				labels[k] = v
+			}
+			metrics[i].Labels = labels
+		}
+	}
+	return func(m *SystemMetrics) {
+		m.CustomMetrics = append(m.CustomMetrics, metrics...)
+	}, err
+}
+
+// parseJSONOutput 解析JSON格式的输出，可以是名称到数值的对象，也可以是包含name、value、labels和unit的对象数组
+func parseJSONOutput(output []byte) ([]CustomMetric, error) {
+	output = bytes.TrimSpace(output)
+	if len(output) > 0 && output[0] == '[' {
+		var items []struct {
+			Name   string            `json:"name"`
+			Value  *float64          `json:"value"`
+			Labels map[string]string `json:"labels"`
+			Unit   string            `json:"unit"`
+		}
+		if err := json.Unmarshal(output, &items); err != nil {
+			return nil, fmt.Errorf("解析JSON输出失败: %v", err)
+		}
+		metrics := make([]CustomMetric, 0, len(items))
+		for i, item := range items {
+			if item.Name == "" || item.Value == nil {
+				return metrics, fmt.Errorf("JSON输出中第%d个指标缺少name或value", i+1)
+			}
+			metrics = append(metrics, CustomMetric{Name: item.Name, Labels: item.Labels, Value: *item.Value, Unit: item.Unit})
+		}
+		return metrics, nil
+	}
+
+	var values map[string]float64
+	if err := json.Unmarshal(output, &values); err != nil {
+		return nil, fmt.Errorf("解析JSON输出失败: %v", err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]CustomMetric, 0, len(names))
+	for _, name := range names {
+		if name == "" {
+			return metrics, fmt.Errorf("JSON输出中的指标名称为空")
+		}
+		metrics = append(metrics, CustomMetric{Name: name, Value: values[name]})
+	}
+	return metrics, nil
+}
+
+// Nagios性能数据的取值：数值及可选的单位，如12.5ms、80%、1024B、35c
+var perfValuePattern = regexp.MustCompile(`^([-+]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)([A-Za-z%]*)$`)
+
+// parseNagiosOutput 解析Nagios插件输出中的性能数据
+// 性能数据位于第一行的“|”之后，以及后续第一个含“|”的行中“|”之后直到输出结束的部分
+func parseNagiosOutput(output string) ([]CustomMetric, error) {
+	lines := strings.Split(output, "\n")
+	var perfdata []string
+	if _, after, ok := strings.Cut(lines[0], "|"); ok {
+		perfdata = append(perfdata, after)
+	}
+	inPerfdata := false
+	for _, line := range lines[1:] {
+		if inPerfdata {
+			perfdata = append(perfdata, line)
+		} else if _, after, ok := strings.Cut(line, "|"); ok {
+			perfdata = append(perfdata, after)
+			inPerfdata = true
+		}
+	}
+	return parsePerfdata(strings.Join(perfdata, " "))
+}
+
+// parsePerfdata 解析空白分隔的'label'=value[UOM];[warn];[crit];[min];[max]列表，只保留数值和单位
+// 含空格的标签用单引号括起，标签中的单引号写作两个单引号；值为U（无法确定）的项忽略
+func parsePerfdata(data string) ([]CustomMetric, error) {
+	var metrics []CustomMetric
+	s := strings.TrimSpace(data)
+	for s != "" {
+		var label string
+		if s[0] == '\'' {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return metrics, fmt.Errorf("性能数据中的引号未闭合")
+			}
+			label = b.String()
+			s = s[i+1:]
+		} else {
+			i := strings.IndexAny(s, "= \t\r")
+			if i < 0 {
+				i = len(s)
+			}
+			label = s[:i]
+			s = s[i:]
+		}
+		if label == "" || !strings.HasPrefix(s, "=") {
+			return metrics, fmt.Errorf("性能数据格式无效，应为'label'=value[UOM];[warn];[crit];[min];[max]")
+		}
+		end := strings.IndexAny(s, " \t\r")
+		if end < 0 {
+			end = len(s)
+		}
+		value, _, _ := strings.Cut(s[1:end], ";")
+		s = strings.TrimSpace(s[end:])
+
+		if value == "U" {
+			continue
+		}
+		match := perfValuePattern.FindStringSubmatch(strings.Replace(value, ",", ".", 1))
+		if match == nil {
+			return metrics, fmt.Errorf("性能数据%s的值无效: %q", label, value)
+		}
+		v, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return metrics, fmt.Errorf("性能数据%s的值无效: %q", label, value)
+		}
+		metrics = append(metrics, CustomMetric{Name: label, Value: v, Unit: match[2]})
+	}
+	return metrics, nil
+}
+
+// collectTextfiles 读取目录下所有.prom文件中的样本，解析失败的文件跳过
+// 与node_exporter的textfile采集一致，另外上报成功读取的文件的修改时间node_textfile_mtime_seconds和是否有文件读取失败node_textfile_scrape_error
+func collectTextfiles(dir string) ([]CustomMetric, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取目录失败: %v", err)
+	}
+
+	var metrics, mtimes []CustomMetric
+	var errs []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".prom") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() > maxTextfileSize {
+			errs = append(errs, fmt.Sprintf("%s: 文件超过%d字节", entry.Name(), maxTextfileSize))
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", entry.Name(), err))
+			continue
+		}
+		samples, err := parsePrometheusText(string(data))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", entry.Name(), err))
+			continue
+		}
+		metrics = append(metrics, samples...)
+		mtimes = append(mtimes, CustomMetric{
+			Name:   "node_textfile_mtime_seconds",
+			Labels: map[string]string{"file": entry.Name()},
+			Value:  float64(info.ModTime().Unix()),
+			Type:   "gauge",
+			Help:   "Unixtime mtime of textfiles successfully read.",
+		})
+	}
+
+	// 超出上限时只丢弃文件中的样本，各文件的修改时间和node_textfile_scrape_error总是上报
+	if limit := maxTextfileMetrics - len(mtimes) - 1; len(metrics) > limit {
+		errs = append(errs, fmt.Sprintf("指标数量超过%d个，多出的部分已丢弃", maxTextfileMetrics))
+		if limit < 0 {
+			limit = 0
+		}
+		metrics = metrics[:limit]
+	}
+	metrics = append(metrics, mtimes...)
+	scrapeError := 0.0
+	if len(errs) > 0 {
+		scrapeError = 1
+	}
+	metrics = append(metrics, CustomMetric{
+		Name:  "node_textfile_scrape_error",
+		Value: scrapeError,
+		Type:  "gauge",
+		Help:  "1 if there was an error opening or reading a file, 0 otherwise",
+	})
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// Prometheus指标名称和标签名称
+var (
+	promMetricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	promLabelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+// parsePrometheusText 解析Prometheus文本格式，每个样本为一个自定义指标，类型和说明取自所属指标族的TYPE和HELP
+// 直方图和摘要的_bucket、_sum、_count样本归属于去掉后缀的指标族；样本中的时间戳、NaN和正负无穷的样本忽略
+func parsePrometheusText(data string) ([]CustomMetric, error) {
+	var metrics []CustomMetric
+	types := make(map[string]string)
+	helps := make(map[string]string)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			// 除“# HELP”和“# TYPE”以外的注释忽略
+			fields := strings.Fields(line)
+			if len(fields) < 3 || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+				continue
+			}
+			name := fields[2]
+			text := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			text = strings.TrimSpace(strings.TrimPrefix(text, fields[1]))
+			text = strings.TrimSpace(strings.TrimPrefix(text, name))
+			if fields[1] == "TYPE" {
+				switch text {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+					types[name] = text
+				default:
+					return nil, fmt.Errorf("第%d行: 不支持的指标类型: %s", i+1, text)
+				}
+			} else {
+				helps[name] = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(text)
+			}
+			continue
+		}
+
+		metric, err := parsePrometheusSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行: %v", i+1, err)
+		}
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	for i := range metrics {
+		family := metrics[i].Name
+		if _, ok := types[family]; !ok {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(family, suffix); base != family {
+					if t := types[base]; t == "histogram" || t == "summary" {
+						family = base
+					}
+				}
+			}
+		}
+		metrics[i].Type = types[family]
+		metrics[i].Help = helps[family]
+	}
+	return metrics, nil
+}
+
+// parsePrometheusSample 解析一行样本：name{label="value",...} value [timestamp]，值为空的标签视为不存在
+func parsePrometheusSample(line string) (CustomMetric, error) {
+	var metric CustomMetric
+	metric.Name = promMetricNamePattern.FindString(line)
+	if metric.Name == "" {
+		return metric, fmt.Errorf("指标名称无效")
+	}
+	s := strings.TrimLeft(line[len(metric.Name):], " \t")
+
+	if strings.HasPrefix(s, "{") {
+		s = s[1:]
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if strings.HasPrefix(s, "}") {
+				s = s[1:]
+				break
+			}
+			label := promLabelNamePattern.FindString(s)
+			if label == "" {
+				return metric, fmt.Errorf("%s的标签名称无效", metric.Name)
+			}
+			s = strings.TrimLeft(s[len(label):], " \t")
+			if !strings.HasPrefix(s, "=") {
+				return metric, fmt.Errorf("%s的标签%s缺少=", metric.Name, label)
+			}
+			s = strings.TrimLeft(s[1:], " \t")
+			if !strings.HasPrefix(s, `"`) {
+				return metric, fmt.Errorf("%s的标签%s的值缺少引号", metric.Name, label)
+			}
+
+			// 标签值中的反斜杠、双引号和换行分别转义为\\、\"和\n
+			var value strings.Builder
+			closed := false
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					if s[i] == 'n' {
+						value.WriteByte('\n')
+					} else {
+						value.WriteByte(s[i])
+					}
+					continue
+				}
+				value.WriteByte(s[i])
+			}
+			if !closed {
+				return metric, fmt.Errorf("%s的标签%s的值缺少结束引号", metric.Name, label)
+			}
+			s = strings.TrimLeft(s[i+1:], " \t")
+			if value.Len() > 0 {
+				if metric.Labels == nil {
+					metric.Labels = make(map[string]string)
+				}
+				metric.Labels[label] = value.String()
+			}
+			if strings.HasPrefix(s, ",") {
+				s = s[1:]
+			} else if !strings.HasPrefix(s, "}") {
+				return metric, fmt.Errorf("%s的标签之间缺少逗号", metric.Name)
+			}
+		}
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) < 1 || len(fields) > 2 {
+		return metric, fmt.Errorf("%s的样本格式无效，应为名称、可选的标签、值和可选的时间戳", metric.Name)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return metric, fmt.Errorf("%s的值无效: %q", metric.Name, fields[0])
+	}
+	metric.Value = value
+	return metric, nil
+}
+
+// collectCPUStats 根据cpu.Times计算汇总及每个核心在两次采集之间的各模式占比
+// 首次调用时只记录基准值，返回空结果
+func collectCPUStats() ([]CPUStat, error) {
+	var times []cpu.TimesStat
+	total, err := cpu.Times(false)
+	if err != nil {
+		return nil, fmt.Errorf("采集CPU时间出错: %v", err)
+	}
+	times = append(times, total...)
+	perCPU, err := cpu.Times(true)
+	if err != nil {
+		log.Printf("采集每核心CPU时间出错: %v", err)
+	} else {
+		times = append(times, perCPU...)
+	}
+
+	var stats []CPUStat
+	for _, t := range times {
+		last, ok := lastCPUTimes[t.CPU]
+		lastCPUTimes[t.CPU] = t
+		if !ok {
+			continue
+		}
+		if stat, ok := calculateCPUStat(last, t); ok {
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
+
+// calculateCPUStat 计算两次CPU时间采样之间各模式所占的百分比
+// 在Linux上guest时间已包含在user中，因此不重复计入总时间
+func calculateCPUStat(prev, cur cpu.TimesStat) (CPUStat, bool) {
+	prevTotal := prev.User + prev.System + prev.Idle + prev.Nice + prev.Iowait + prev.Irq + prev.Softirq + prev.Steal
+	curTotal := cur.User + cur.System + cur.Idle + cur.Nice + cur.Iowait + cur.Irq + cur.Softirq + cur.Steal
+	delta := curTotal - prevTotal
+	if delta <= 0 {
+		return CPUStat{}, false
+	}
+
+	percent := func(prevValue, curValue float64) float64 {
+		value := (curValue - prevValue) / delta * 100
+		if value < 0 {
+			return 0
+		}
+		return math.Min(value, 100)
+	}
+
+	stat := CPUStat{
+		CPU:     cur.CPU,
+		User:    percent(prev.User, cur.User),
+		System:  percent(prev.System, cur.System),
+		Nice:    percent(prev.Nice, cur.Nice),
+		Iowait:  percent(prev.Iowait, cur.Iowait),
+		Irq:     percent(prev.Irq, cur.Irq),
+		Softirq: percent(prev.Softirq, cur.Softirq),
+		Steal:   percent(prev.Steal, cur.Steal),
+		Guest:   percent(prev.Guest, cur.Guest),
+	}
+	stat.Usage = math.Max(0, 100-percent(prev.Idle, cur.Idle)-stat.Iowait)
+	return stat, true
+}
+
+// collectFilesystems 枚举所有挂载点，按配置的类型和路径过滤后采集空间和inode使用情况，超时后不再采集剩余的挂载点
+func collectFilesystems(ctx context.Context, cfg Config) ([]FilesystemInfo, error) {
+	partitions, err := disk.PartitionsWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("获取挂载点列表出错: %v", err)
+	}
+
+	var filesystems []FilesystemInfo
+	seen := make(map[string]bool)
+	for _, p := range partitions {
+		// 同一挂载点可能因重复挂载出现多次，只保留第一条
+		if seen[p.Mountpoint] || !shouldCollectFilesystem(cfg, p) {
+			continue
+		}
+		seen[p.Mountpoint] = true
+
+		usage, err := diskUsageWithTimeout(ctx, p.Mountpoint, fsUsageTimeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("获取挂载点 %s 使用情况出错: %v", p.Mountpoint, err)
+			continue
+		}
+		// 总大小为0的通常是伪文件系统
+		if usage.Total == 0 {
+			continue
+		}
+
+		filesystems = append(filesystems, FilesystemInfo{
+			Mountpoint:        p.Mountpoint,
+			Device:            p.Device,
+			Fstype:            p.Fstype,
+			Total:             usage.Total,
+			Used:              usage.Used,
+			Free:              usage.Free,
+			UsedPercent:       usage.UsedPercent,
+			InodesTotal:       usage.InodesTotal,
+			InodesUsed:        usage.InodesUsed,
+			InodesFree:        usage.InodesFree,
+			InodesUsedPercent: usage.InodesUsedPercent,
+		})
+	}
+	return filesystems, nil
+}
+
+// shouldCollectFilesystem 根据配置的文件系统类型和路径过滤规则判断是否采集该挂载点
+func shouldCollectFilesystem(cfg Config, p disk.PartitionStat) bool {
+	if len(cfg.FSIncludeTypes) > 0 && !containsString(cfg.FSIncludeTypes, p.Fstype) {
+		return false
+	}
+	if containsString(cfg.FSExcludeTypes, p.Fstype) {
+		return false
+	}
+	if len(cfg.FSIncludePaths) > 0 && !matchAnyPath(cfg.FSIncludePaths, p.Mountpoint) {
+		return false
+	}
+	if matchAnyPath(cfg.FSExcludePaths, p.Mountpoint) {
+		return false
+	}
+	return true
+}
+
+// matchAnyPath 判断路径是否匹配任一模式，模式既可以是通配符，也可以是目录（匹配该目录及其子目录）
+func matchAnyPath(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if path == pattern || strings.HasPrefix(path, strings.TrimSuffix(pattern, "/")+"/") {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// diskUsageWithTimeout 获取挂载点使用情况，超时或采集被取消则放弃，避免失联的网络文件系统阻塞整个采集周期
+func diskUsageWithTimeout(ctx context.Context, path string, timeout time.Duration) (*disk.UsageStat, error) {
+	type result struct {
+		usage *disk.UsageStat
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		usage, err := disk.Usage(path)
+		ch <- result{usage, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.usage, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("超时（%v）", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// collectDiskIO 根据disk.IOCounters计算各块设备在两次采集之间的吞吐量、IOPS、平均耗时和繁忙度
+// 首次调用时只记录基准值，返回空结果；采集被取消时不更新基准值
+func collectDiskIO(ctx context.Context, cfg Config) ([]DiskIOStat, error) {
+	counters, err := disk.IOCountersWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("采集块设备IO计数出错: %v", err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	now := time.Now()
+
+	prev := lastDiskIOCounters
+	elapsed := now.Sub(lastDiskIOTime).Seconds()
+	lastDiskIOCounters = counters
+	lastDiskIOTime = now
+	if prev == nil || elapsed <= 0 {
+		return nil, nil
+	}
+
+	var stats []DiskIOStat
+	for name, cur := range counters {
+		if matchAnyName(cfg.DiskIOExclude, name) {
+			continue
+		}
+		last, ok := prev[name]
+		// 新出现的设备或计数器被重置（如设备重新挂载）时跳过本次
+		if !ok || cur.ReadCount < last.ReadCount || cur.WriteCount < last.WriteCount ||
+			cur.ReadBytes < last.ReadBytes || cur.WriteBytes < last.WriteBytes ||
+			cur.ReadTime < last.ReadTime || cur.WriteTime < last.WriteTime || cur.IoTime < last.IoTime {
+			continue
+		}
+
+		reads := float64(cur.ReadCount - last.ReadCount)
+		writes := float64(cur.WriteCount - last.WriteCount)
+		readTime := float64(cur.ReadTime - last.ReadTime)
+		writeTime := float64(cur.WriteTime - last.WriteTime)
+
+		stat := DiskIOStat{
+			Device:           name,
+			ReadBytesPerSec:  float64(cur.ReadBytes-last.ReadBytes) / elapsed,
+			WriteBytesPerSec: float64(cur.WriteBytes-last.WriteBytes) / elapsed,
+			ReadIOPS:         reads / elapsed,
+			WriteIOPS:        writes / elapsed,
+			// io_time单位为毫秒
+			UtilPercent: math.Min(float64(cur.IoTime-last.IoTime)/(elapsed*1000)*100, 100),
+		}
+		if reads > 0 {
+			stat.ReadAwaitMs = readTime / reads
+		}
+		if writes > 0 {
+			stat.WriteAwaitMs = writeTime / writes
+		}
+		if reads+writes > 0 {
+			stat.AwaitMs = (readTime + writeTime) / (reads + writes)
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Device < stats[j].Device })
+	return stats, nil
+}
+
+// collectNetInterfaces 根据net.IOCounters计算各网卡在两次采集之间的流量速率、错误和丢包
+// 首次调用时只记录基准值，返回空结果；采集被取消时不更新基准值
+func collectNetInterfaces(ctx context.Context, cfg Config) ([]NetInterfaceStat, error) {
+	counters, err := net.IOCountersWithContext(ctx, true)
+	if err != nil {
+		return nil, fmt.Errorf("采集网卡计数出错: %v", err)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	now := time.Now()
+
+	current := make(map[string]net.IOCountersStat)
+	for _, c := range counters {
+		if len(cfg.NetInclude) > 0 && !matchAnyName(cfg.NetInclude, c.Name) {
+			continue
+		}
+		if matchAnyName(cfg.NetExclude, c.Name) {
+			continue
+		}
+		current[c.Name] = c
+	}
+
+	prev := lastNetIOCounters
+	elapsed := now.Sub(lastNetIOTime).Seconds()
+	lastNetIOCounters = current
+	lastNetIOTime = now
+	if prev == nil || elapsed <= 0 {
+		return nil, nil
+	}
+
+	// 32位内核的网卡计数器会回绕，64位内核上计数器变小只可能是被重置
+	counterDelta := counterDelta
+	if isKernel32Bit() {
+		counterDelta = counterDelta32
+	}
+	var stats []NetInterfaceStat
+	for name, cur := range current {
+		last, ok := prev[name]
+		if !ok {
+			continue
+		}
+
+		bytesSent, ok1 := counterDelta(last.BytesSent, cur.BytesSent)
+		bytesRecv, ok2 := counterDelta(last.BytesRecv, cur.BytesRecv)
+		packetsSent, ok3 := counterDelta(last.PacketsSent, cur.PacketsSent)
+		packetsRecv, ok4 := counterDelta(last.PacketsRecv, cur.PacketsRecv)
+		errIn, ok5 := counterDelta(last.Errin, cur.Errin)
+		errOut, ok6 := counterDelta(last.Errout, cur.Errout)
+		dropIn, ok7 := counterDelta(last.Dropin, cur.Dropin)
+		dropOut, ok8 := counterDelta(last.Dropout, cur.Dropout)
+		// 计数器被重置（网卡重建、驱动重载等）时跳过本次，下个周期以新值为基准
+		if !(ok1 && ok2 && ok3 && ok4 && ok5 && ok6 && ok7 && ok8) {
+			log.Printf("网卡 %s 计数器已重置，跳过本次速率计算", name)
+			continue
+		}
+
+		stats = append(stats, NetInterfaceStat{
+			Interface:         name,
+			BytesSent:         cur.BytesSent,
+			BytesRecv:         cur.BytesRecv,
+			BytesSentPerSec:   float64(bytesSent) / elapsed,
+			BytesRecvPerSec:   float64(bytesRecv) / elapsed,
+			PacketsSentPerSec: float64(packetsSent) / elapsed,
+			PacketsRecvPerSec: float64(packetsRecv) / elapsed,
+			ErrorsIn:          errIn,
+			ErrorsOut:         errOut,
+			DropsIn:           dropIn,
+			DropsOut:          dropOut,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Interface < stats[j].Interface })
+	return stats, nil
+}
+
+// collectConnections 按协议统计各状态的连接数，并整理正在监听的端口及所属进程
+// 某个协议采集失败时继续采集其他协议，返回已采集到的结果和失败的原因
+func collectConnections(ctx context.Context) ([]ConnStateCount, []ListeningPort, error) {
+	var states []ConnStateCount
+	var listening []ListeningPort
+	var errs []string
+	processNames := make(map[int32]string)
+	seen := make(map[string]bool)
+
+	for _, protocol := range []string{"tcp4", "tcp6", "udp4", "udp6"} {
+		conns, err := net.ConnectionsWithContext(ctx, protocol)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("采集%s连接出错: %v", protocol, err))
+			continue
+		}
+
+		counts := make(map[string]int)
+		for _, conn := range conns {
+			state := conn.Status
+			if state == "" {
+				state = "NONE"
+			}
+			counts[state]++
+
+			// TCP的LISTEN状态，以及未连接远端的UDP套接字视为监听端口
+			isListening := state == "LISTEN" ||
+				(strings.HasPrefix(protocol, "udp") && conn.Raddr.Port == 0 && conn.Laddr.Port != 0)
+			if !isListening {
+				continue
+			}
+			key := fmt.Sprintf("%s|%s|%d", protocol, conn.Laddr.IP, conn.Laddr.Port)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			listening = append(listening, ListeningPort{
+				Protocol: protocol,
+				Address:  conn.Laddr.IP,
+				Port:     conn.Laddr.Port,
+				PID:      conn.Pid,
+				Process:  lookupProcessName(conn.Pid, processNames),
+			})
+		}
+
+		for state, count := range counts {
+			states = append(states, ConnStateCount{Protocol: protocol, State: state, Count: count})
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Protocol != states[j].Protocol {
+			return states[i].Protocol < states[j].Protocol
+		}
+		return states[i].State < states[j].State
+	})
+	sort.Slice(listening, func(i, j int) bool {
+		if listening[i].Port != listening[j].Port {
+			return listening[i].Port < listening[j].Port
+		}
+		return listening[i].Protocol < listening[j].Protocol
+	})
+	if len(errs) > 0 {
+		return states, listening, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return states, listening, nil
+}
+
+// lookupProcessName 根据PID获取进程名称，结果缓存在cache中避免重复读取
+func lookupProcessName(pid int32, cache map[int32]string) string {
+	if pid <= 0 {
+		return ""
+	}
+	if name, ok := cache[pid]; ok {
+		return name
+	}
+	name := ""
+	if p, err := process.NewProcess(pid); err == nil {
+		name, _ = p.Name()
+	}
+	cache[pid] = name
+	return name
+}
+
+// collectMemoryStat 整理内存明细，并根据两次采集之间的换入换出增量计算交换速率
+// 首次调用时交换速率为0
+func collectMemoryStat(memInfo *mem.VirtualMemoryStat) *MemoryStat {
+	stat := &MemoryStat{
+		Total:     memInfo.Total,
+		Used:      memInfo.Used,
+		Available: memInfo.Available,
+		Cached:    memInfo.Cached,
+		Buffers:   memInfo.Buffers,
+		Dirty:     memInfo.Dirty,
+		Slab:      memInfo.Slab,
+	}
+
+	swap, err := mem.SwapMemory()
+	if err != nil {
+		log.Printf("采集交换分区信息出错: %v", err)
+		return stat
+	}
+	stat.SwapTotal = swap.Total
+	stat.SwapUsed = swap.Used
+
+	now := time.Now()
+	if !lastSwapTime.IsZero() {
+		elapsed := now.Sub(lastSwapTime).Seconds()
+		if elapsed > 0 {
+			if delta, ok := counterDelta(lastSwapIn, swap.Sin); ok {
+				stat.SwapInPerSec = float64(delta) / elapsed
+			}
+			if delta, ok := counterDelta(lastSwapOut, swap.Sout); ok {
+				stat.SwapOutPerSec = float64(delta) / elapsed
+			}
+		}
+	}
+	lastSwapIn, lastSwapOut, lastSwapTime = swap.Sin, swap.Sout, now
+	return stat
+}
+
+// collectPressure 读取/proc/pressure下cpu、memory、io的压力阻塞信息，内核不支持时返回空结果
+func collectPressure(ctx context.Context) ([]PressureStat, error) {
+	var stats []PressureStat
+	for _, resource := range []string{"cpu", "memory", "io"} {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(pressureDir, resource))
+		if err != nil {
+			continue // 内核未开启PSI
+		}
+		stats = append(stats, parsePressure(resource, string(data))...)
+	}
+	return stats, nil
+}
+
+// parsePressure 解析PSI文件内容，每行格式为：some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePressure(resource, content string) []PressureStat {
+	var stats []PressureStat
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		stat := PressureStat{Resource: resource, Kind: fields[0]}
+		for _, field := range fields[1:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			switch key {
+			case "avg10":
+				stat.Avg10, _ = strconv.ParseFloat(value, 64)
+			case "avg60":
+				stat.Avg60, _ = strconv.ParseFloat(value, 64)
+			case "avg300":
+				stat.Avg300, _ = strconv.ParseFloat(value, 64)
+			case "total":
+				stat.Total, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// collectSensors 读取sysfs下hwmon和thermal的温度、临界温度和风扇转速，采集被取消时返回ctx的错误
+func collectSensors(ctx context.Context, sysfsRoot string) ([]SensorStat, error) {
+	var sensors []SensorStat
+	seen := make(map[string]bool)
+	add := func(s SensorStat, device string) {
+		// 同名芯片（如多路CPU的coretemp）以设备目录名区分
+		if seen[s.Type+"|"+s.Sensor] {
+			s.Sensor = fmt.Sprintf("%s (%s)", s.Sensor, device)
+		}
+		seen[s.Type+"|"+s.Sensor] = true
+		sensors = append(sensors, s)
+	}
+
+	hwmonDir := filepath.Join(sysfsRoot, "class", "hwmon")
+	devices, _ := os.ReadDir(hwmonDir)
+	for _, device := range devices {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(hwmonDir, device.Name())
+		chip := readSysfsString(filepath.Join(dir, "name"))
+		if chip == "" {
+			chip = device.Name()
+		}
+		inputs, _ := filepath.Glob(filepath.Join(dir, "*_input"))
+		sort.Strings(inputs)
+		for _, input := range inputs {
+			prefix := strings.TrimSuffix(filepath.Base(input), "_input")
+			var sensorType string
+			var scale float64
+			switch {
+			case strings.HasPrefix(prefix, "temp"):
+				sensorType, scale = "temperature", 1000 // 毫摄氏度
+			case strings.HasPrefix(prefix, "fan"):
+				sensorType, scale = "fan", 1
+			default:
+				continue // 电压、功率等暂不采集
+			}
+			value, ok := readSysfsNumber(input)
+			if !ok {
+				continue
+			}
+			label := readSysfsString(filepath.Join(dir, prefix+"_label"))
+			if label == "" {
+				label = prefix
+			}
+			s := SensorStat{Sensor: chip + "/" + label, Type: sensorType, Value: value / scale}
+			if sensorType == "temperature" {
+				if crit, ok := readSysfsNumber(filepath.Join(dir, prefix+"_crit")); ok {
+					s.Critical = crit / scale
+				}
+			}
+			add(s, device.Name())
+		}
+	}
+
+	thermalDir := filepath.Join(sysfsRoot, "class", "thermal")
+	zones, _ := filepath.Glob(filepath.Join(thermalDir, "thermal_zone*"))
+	sort.Strings(zones)
+	for _, zone := range zones {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		temp, ok := readSysfsNumber(filepath.Join(zone, "temp"))
+		if !ok {
+			continue
+		}
+		zoneType := readSysfsString(filepath.Join(zone, "type"))
+		if zoneType == "" {
+			zoneType = filepath.Base(zone)
+		}
+		s := SensorStat{Sensor: "thermal/" + zoneType, Type: "temperature", Value: temp / 1000}
+		tripTypes, _ := filepath.Glob(filepath.Join(zone, "trip_point_*_type"))
+		for _, tripType := range tripTypes {
+			if readSysfsString(tripType) != "critical" {
+				continue
+			}
+			if crit, ok := readSysfsNumber(strings.TrimSuffix(tripType, "_type") + "_temp"); ok {
+				s.Critical = crit / 1000
+			}
+			break
+		}
+		add(s, filepath.Base(zone))
+	}
+
+	return sensors, nil
+}
+
+// collectCgroups 遍历cgroup v2层级，采集容器、systemd服务和顶层slice的CPU、内存、OOM和IO
+// 根目录不是cgroup v2时返回空结果；CPU和IO速率在首次调用时为0；采集被取消时返回ctx的错误，不更新基准值
+func collectCgroups(ctx context.Context, root string) ([]CgroupStat, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, nil // 未挂载cgroup v2
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(lastCgroupTime).Seconds()
+	currentCPU := make(map[string]uint64)
+	currentIO := make(map[string][2]uint64)
+	var stats []CgroupStat
+
+	walkErr := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil || !d.IsDir() || path == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		name := d.Name()
+
+		stat := CgroupStat{Path: rel}
+		descend := true
+		if m := containerScopePattern.FindStringSubmatch(name); m != nil {
+			stat.Kind, stat.ContainerID, descend = "container", m[2], false
+		} else if filepath.Base(filepath.Dir(path)) == "docker" && len(name) == 64 {
+			// cgroupfs驱动下的Docker容器：/docker/<id>
+			stat.Kind, stat.ContainerID, descend = "container", name, false
+		} else if strings.HasSuffix(name, ".service") {
+			stat.Kind, stat.Name, descend = "service", name, false
+		} else if strings.HasSuffix(name, ".slice") && !strings.Contains(rel, string(filepath.Separator)) {
+			stat.Kind, stat.Name = "slice", name
+		} else {
+			return nil
+		}
+		if stat.Kind == "container" {
+			stat.Name = lookupContainerName(stat.ContainerID)
+		}
+
+		readCgroupStat(path, &stat)
+		if usage, ok := readCgroupKeyed(filepath.Join(path, "cpu.stat"))["usage_usec"]; ok {
+			currentCPU[rel] = usage
+			if prev, ok := lastCgroupCPU[rel]; ok && elapsed > 0 {
+				if delta, ok := counterDelta(prev, usage); ok {
+					stat.CPUPercent = math.Round(float64(delta)/1e6/elapsed*10000) / 100
+				}
+			}
+		}
+		currentIO[rel] = [2]uint64{stat.IOReadBytes, stat.IOWriteBytes}
+		if prev, ok := lastCgroupIO[rel]; ok && elapsed > 0 {
+			if delta, ok := counterDelta(prev[0], stat.IOReadBytes); ok {
+				stat.IOReadBytesPerSec = float64(delta) / elapsed
+			}
+			if delta, ok := counterDelta(prev[1], stat.IOWriteBytes); ok {
+				stat.IOWriteBytesPerSec = float64(delta) / elapsed
+			}
+		}
+
+		stats = append(stats, stat)
+		if !descend {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	lastCgroupCPU = currentCPU
+	lastCgroupIO = currentIO
+	lastCgroupTime = now
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Path < stats[j].Path })
+	return stats, nil
+}
+
+// readCgroupStat 读取cgroup的内存占用、内存上限、OOM次数和IO累计字节数
+func readCgroupStat(path string, stat *CgroupStat) {
+	if value, ok := readSysfsNumber(filepath.Join(path, "memory.current")); ok {
+		stat.MemoryCurrent = uint64(value)
+	}
+	// memory.max为"max"时表示不限制
+	if value, ok := readSysfsNumber(filepath.Join(path, "memory.max")); ok {
+		stat.MemoryMax = uint64(value)
+	}
+	stat.OOMKills = readCgroupKeyed(filepath.Join(path, "memory.events"))["oom_kill"]
+
+	// io.stat每行一个设备：8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0
+	data, err := os.ReadFile(filepath.Join(path, "io.stat"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		for _, field := range strings.Fields(line) {
+			key, value, found := strings.Cut(field, "=")
+			if !found {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "rbytes":
+				stat.IOReadBytes += n
+			case "wbytes":
+				stat.IOWriteBytes += n
+			}
+		}
+	}
+}
+
+// readCgroupKeyed 读取"键 值"格式的cgroup文件，如cpu.stat、memory.events
+func readCgroupKeyed(path string) map[string]uint64 {
+	result := make(map[string]uint64)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return result
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			result[fields[0]] = value
+		}
+	}
+	return result
+}
+
+// lookupContainerName 从Docker的容器配置中读取容器名称，无法读取时返回12位短ID
+func lookupContainerName(id string) string {
+	data, err := os.ReadFile(filepath.Join(dockerContainersDir, id, "config.v2.json"))
+	if err == nil {
+		var cfg struct {
+			Name string `json:"Name"`
+		}
+		if json.Unmarshal(data, &cfg) == nil && cfg.Name != "" {
+			return strings.TrimPrefix(cfg.Name, "/")
+		}
+	}
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// collectSystemdUnits 通过systemctl获取关注的单元以及所有failed单元的状态
+// 系统未使用systemd或获取单元状态失败时返回空结果；只有获取failed单元失败时仍返回关注的单元
+func collectSystemdUnits(ctx context.Context, watched []string, includeFailed bool) ([]UnitStat, error) {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return nil, nil // 与sd_booted相同的判断方式，系统不是由systemd启动
+	}
+
+	// 获取failed单元失败时仍上报关注的单元，错误与结果一起返回
+	units := append([]string{}, watched...)
+	var failedErr error
+	if includeFailed {
+		output, err := runSystemctl(ctx, "list-units", "--state=failed", "--plain", "--no-legend", "--full")
+		if err != nil {
+			failedErr = fmt.Errorf("获取failed单元出错: %v", err)
+		}
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && !containsString(units, fields[0]) {
+				units = append(units, fields[0])
+			}
+		}
+	}
+	if len(units) == 0 {
+		return nil, failedErr
+	}
+
+	args := []string{"show", "--property=Id,LoadState,ActiveState,SubState,NRestarts,StateChangeTimestampMonotonic", "--"}
+	output, err := runSystemctl(ctx, append(args, units...)...)
+	if err != nil {
+		return nil, fmt.Errorf("获取systemd单元状态出错: %v", err)
+	}
+
+	// 单调时间为开机以来的微秒数，加上开机时间换算为时间戳
+	bootTime, _ := host.BootTime()
+
+	// systemctl show按参数顺序输出，每个单元的属性之间以空行分隔
+	var stats []UnitStat
+	for i, block := range strings.Split(strings.TrimSpace(output), "\n\n") {
+		if i >= len(units) {
+			break
+		}
+		stat := UnitStat{Unit: units[i], Watched: containsString(watched, units[i])}
+		for _, line := range strings.Split(block, "\n") {
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				continue
+			}
+			switch key {
+			case "LoadState":
+				stat.LoadState = value
+			case "ActiveState":
+				stat.ActiveState = value
+			case "SubState":
+				stat.SubState = value
+			case "NRestarts":
+				stat.Restarts, _ = strconv.Atoi(value)
+			case "StateChangeTimestampMonotonic":
+				if usec, err := strconv.ParseInt(value, 10, 64); err == nil && usec > 0 && bootTime > 0 {
+					stat.StateChangedAt = int64(bootTime) + usec/1000000
+				}
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, failedErr
+}
+
+// runSystemctl 执行systemctl命令并返回标准输出
+func runSystemctl(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, systemctlTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "systemctl", args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// readSysfsString 读取sysfs属性文件并去除首尾空白，读取失败时返回空字符串
+func readSysfsString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysfsNumber 读取sysfs中的整数属性
+func readSysfsNumber(path string) (float64, bool) {
+	value, err := strconv.ParseInt(readSysfsString(path), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return float64(value), true
+}
+
+// collectTopProcesses 选出CPU占用和内存占用各前n的进程并补充详细信息
+// CPU占用根据两次采集之间的CPU时间增量计算，首次调用时所有进程的CPU占用为0
+// ctx超时时返回错误，不更新CPU时间的基准
+func collectTopProcesses(ctx context.Context, processes []*process.Process, n int) ([]ProcessInfo, error) {
+	type candidate struct {
+		proc *process.Process
+		cpu  float64
+		rss  uint64
+	}
+
+	lastProcMutex.Lock()
+	now := time.Now()
+	elapsed := now.Sub(lastProcTime).Seconds()
+	current := make(map[int32]float64, len(processes))
+	candidates := make([]candidate, 0, len(processes))
+	for _, p := range processes {
+		if ctx.Err() != nil {
+			lastProcMutex.Unlock()
+			return nil, ctx.Err()
+		}
+		times, err := p.TimesWithContext(ctx)
+		if err != nil {
+			continue // 进程已退出或无权限
+		}
+		total := times.User + times.System
+		current[p.Pid] = total
+
+		c := candidate{proc: p}
+		if lastProcCPUTimes != nil && elapsed > 0 {
+			// 上次不存在或CPU时间变小（PID被复用）的进程是在本周期内启动的，全部CPU时间都属于本周期
+			delta := total
+			if prev, ok := lastProcCPUTimes[p.Pid]; ok && total >= prev {
+				delta = total - prev
+			}
+			c.cpu = math.Min(delta/elapsed*100, float64(runtime.NumCPU())*100)
+		}
+		if memInfo, err := p.MemoryInfoWithContext(ctx); err == nil {
+			c.rss = memInfo.RSS
+		}
+		candidates = append(candidates, c)
+	}
+	lastProcCPUTimes = current
+	lastProcTime = now
+	lastProcMutex.Unlock()
+
+	selected := make(map[int32]*ProcessInfo)
+	var order []*process.Process
+	pick := func(c candidate) *ProcessInfo {
+		if info, ok := selected[c.proc.Pid]; ok {
+			return info
+		}
+		info := &ProcessInfo{
+			PID:        c.proc.Pid,
+			CPUPercent: math.Round(c.cpu*100) / 100,
+			RSS:        c.rss,
+			NumFDs:     -1,
+		}
+		selected[c.proc.Pid] = info
+		order = append(order, c.proc)
+		return info
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].cpu > candidates[j].cpu })
+	for i := 0; i < n && i < len(candidates); i++ {
+		pick(candidates[i]).TopCPU = true
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].rss > candidates[j].rss })
+	for i := 0; i < n && i < len(candidates); i++ {
+		pick(candidates[i]).TopMemory = true
+	}
+
+	// 只为入选的进程读取名称、命令行、用户、文件描述符和IO等开销较大的信息
+	result := make([]ProcessInfo, 0, len(order))
+	for _, p := range order {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		info := selected[p.Pid]
+		info.Name, _ = p.NameWithContext(ctx)
+		if cmdline, err := p.CmdlineWithContext(ctx); err == nil {
+			if len(cmdline) > maxCmdlineLength {
+				cmdline = strings.ToValidUTF8(cmdline[:maxCmdlineLength], "")
+			}
+			info.Cmdline = cmdline
+		}
+		info.Username, _ = p.UsernameWithContext(ctx)
+		if fds, err := p.NumFDsWithContext(ctx); err == nil {
+			info.NumFDs = fds
+		}
+		if ioStat, err := p.IOCountersWithContext(ctx); err == nil {
+			info.ReadBytes = ioStat.ReadBytes
+			info.WriteBytes = ioStat.WriteBytes
+		}
+		result = append(result, *info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CPUPercent != result[j].CPUPercent {
+			return result[i].CPUPercent > result[j].CPUPercent
+		}
+		return result[i].RSS > result[j].RSS
+	})
+	return result, nil
+}
+
+// counterDelta 计算单调递增计数器两次采样的差值，当前值变小视为计数器被重置（重启、网卡重建等），返回false
+func counterDelta(prev, cur uint64) (uint64, bool) {
+	if cur >= prev {
+		return cur - prev, true
+	}
+	return 0, false
+}
+
+// counterDelta32 计算已知为32位的计数器两次采样的差值
+// 上次的值处于32位的高位区间时，当前值变小视为回绕；否则与counterDelta一样视为被重置
+func counterDelta32(prev, cur uint64) (uint64, bool) {
+	if cur < prev && prev <= math.MaxUint32 && prev > math.MaxUint32/2 {
+		return cur + (math.MaxUint32 - prev) + 1, true
+	}
+	return counterDelta(prev, cur)
+}
+
+// 内核是否为32位，为true时/proc/net/dev中的网卡计数器为32位
+var (
+	kernel32BitOnce sync.Once
+	kernel32Bit     bool
+)
+
+// isKernel32Bit 根据uname返回的机器类型判断内核是否为32位，无法判断时视为64位
+func isKernel32Bit() bool {
+	kernel32BitOnce.Do(func() {
+		arch, err := host.KernelArch()
 		if err != nil {
-			return "", err
+			return
 		}
-		return string(data), nil
-	}
+		switch {
+		case arch == "i386" || arch == "i486" || arch == "i586" || arch == "i686":
+			kernel32Bit = true
+		case strings.HasPrefix(arch, "armv") && !strings.Contains(arch, "64"):
+			kernel32Bit = true
+		case arch == "mips" || arch == "ppc" || arch == "s390":
+			kernel32Bit = true
+		}
+	})
+	return kernel32Bit
+}
 
-	// 生成新的UUID
-	newID := uuid.New().String()
-	
-	// 写入文件
-	err = os.WriteFile(idFilePath, []byte(newID), 0644)
-	if err != nil {
-		return "", err
+// matchAnyName 判断名称是否匹配任一通配符模式
+func matchAnyName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
 	}
-	
-	return newID, nil
+	return false
 }
 
-// collectMetrics 采集系统性能指标
-func collectMetrics() (SystemMetrics, error) {
-	// 初始化指标结构体
-	metrics := SystemMetrics{
-		AgentID:     config.AgentID,
-		Timestamp:   time.Now().Unix(),
-		MemoryInfo:  make(map[string]interface{}),
-		DiskInfo:    make(map[string]interface{}),
-		NetworkInfo: make(map[string]interface{}),
-		LoadAverage: make(map[string]interface{}),
-		SystemInfo:  make(map[string]interface{}),
+// splitList 将逗号分隔的字符串拆分为去除空白的列表
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
+}
 
-	// 采集CPU使用率
-	cpuPercent, err := cpu.Percent(time.Second, false)
-	if err == nil && len(cpuPercent) > 0 {
-		metrics.CPUUsage = cpuPercent[0]
+// containsString 判断列表中是否包含指定字符串
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
+	return false
+}
 
-	// 采集内存信息
-	memInfo, err := mem.VirtualMemory()
-	if err == nil {
-		metrics.MemoryInfo["total"] = memInfo.Total      // 总内存
-		metrics.MemoryInfo["used"] = memInfo.Used        // 已用内存
-		metrics.MemoryInfo["percent"] = memInfo.UsedPercent // 内存使用率
+// deriveEnvelopeKey 使用HKDF-SHA256从共享密钥派生AES-256密钥和用于标识密钥的ID
+func deriveEnvelopeKey(secret string) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), []byte("linux-monitor"), []byte("envelope key v2")), key); err != nil {
+		return nil, nil, err
+	}
+	keyID := make([]byte, envelopeKeyIDSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), []byte("linux-monitor"), []byte("envelope key id v2")), keyID); err != nil {
+		return nil, nil, err
 	}
+	return key, keyID, nil
+}
 
-	// 采集磁盘信息
-	diskInfo, err := disk.Usage("/")
-	if err == nil {
-		metrics.DiskInfo["total"] = diskInfo.Total       // 总磁盘空间
-		metrics.DiskInfo["used"] = diskInfo.Used         // 已用空间
-		metrics.DiskInfo["percent"] = diskInfo.UsedPercent // 磁盘使用率
+// newEnvelopeAEAD 从密钥派生AES-256-GCM加解密器和密钥ID
+func newEnvelopeAEAD(secret string) (cipher.AEAD, []byte, error) {
+	key, keyID, err := deriveEnvelopeKey(secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("派生密钥失败: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建加密器失败: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建GCM失败: %v", err)
 	}
+	return aead, keyID, nil
+}
 
-	// 采集网络信息
-	netIO, err := net.IOCounters(false)
-	if err == nil && len(netIO) > 0 {
-		metrics.NetworkInfo["bytes_sent"] = netIO[0].BytesSent // 发送字节数
-		metrics.NetworkInfo["bytes_recv"] = netIO[0].BytesRecv // 接收字节数
+// sealEnvelope 使用AES-256-GCM加密数据并封装为带版本和密钥ID的信封
+func sealEnvelope(data []byte, secret string) ([]byte, error) {
+	aead, keyID, err := newEnvelopeAEAD(secret)
+	if err != nil {
+		return nil, err
 	}
 
-	// 采集TCP/UDP连接数
-	tcpConns, _ := net.Connections("tcp")
-	udpConns, _ := net.Connections("udp")
-	metrics.NetworkInfo["tcp_connections"] = len(tcpConns) // TCP连接数
-	metrics.NetworkInfo["udp_connections"] = len(udpConns) // UDP连接数
+	header := make([]byte, 0, len(envelopeMagic)+1+envelopeKeyIDSize+aead.NonceSize())
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion)
+	header = append(header, keyID...)
 
-	// 采集负载平均值
-	loadInfo, err := load.Avg()
-	if err == nil {
-		metrics.LoadAverage["load1"] = loadInfo.Load1   // 1分钟负载
-		metrics.LoadAverage["load5"] = loadInfo.Load5   // 5分钟负载
-		metrics.LoadAverage["load15"] = loadInfo.Load15 // 15分钟负载
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("生成nonce失败: %v", err)
 	}
 
-	// 采集进程数
-	processes, _ := process.Processes()
-	metrics.ProcessCount = len(processes)
+	envelope := append(header, nonce...)
+	return aead.Seal(envelope, nonce, data, header), nil
+}
 
-	// 采集系统信息
-	hostInfo, err := host.Info()
-	if err == nil {
-		metrics.SystemInfo["hostname"] = hostInfo.Hostname       // 主机名
-		metrics.SystemInfo["os"] = hostInfo.OS                   // 操作系统
-		metrics.SystemInfo["platform"] = hostInfo.Platform       // 系统平台
-		metrics.SystemInfo["kernel_version"] = hostInfo.KernelVersion // 内核版本
-		metrics.UptimeSeconds = hostInfo.Uptime                  // 系统运行时间
+// openEnvelope 校验并解密服务端下发的信封
+func openEnvelope(data []byte, secret string) ([]byte, error) {
+	aead, keyID, err := newEnvelopeAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(envelopeMagic) + 1 + envelopeKeyIDSize
+	if len(data) < headerSize+aead.NonceSize()+aead.Overhead() || !bytes.HasPrefix(data, envelopeMagic) {
+		return nil, fmt.Errorf("无效的信封")
+	}
+	if data[len(envelopeMagic)] != envelopeVersion {
+		return nil, fmt.Errorf("不支持的信封版本: %d", data[len(envelopeMagic)])
+	}
+	if !bytes.Equal(data[len(envelopeMagic)+1:headerSize], keyID) {
+		return nil, fmt.Errorf("密钥ID不匹配: %x", data[len(envelopeMagic)+1:headerSize])
 	}
 
-	return metrics, nil
+	header := data[:headerSize]
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], header)
 }
 
 // encrypt 使用AES加密数据
@@ -275,64 +4428,268 @@ func min(a, b int) int {
 	return b
 }
 
-// sendMetrics sends the collected metrics to the server
-func sendMetrics(metrics SystemMetrics) error {
+// sendBatch 为样本分配序列号后发送：failover模式下发送到当前可用的服务器，fanout模式下同时发送到所有服务器
+// 返回主服务器（failover模式下为当前可用的服务器）按顺序已送达的样本数，出错时batch[sent:]由调用方暂存；
+// fanout模式下其他服务器未送达的样本暂存到各自的目录，该服务器恢复后只补发给它
+func sendBatch(batch []SystemMetrics) (int, error) {
+	assignSequence(batch)
+	sent, err := sendPrimary(batch)
+	if config.ServerMode == "fanout" {
+		for _, link := range links[1:] {
+			n, err := link.send(batch)
+			if err != nil {
+				log.Printf("发送指标到%s出错: %v", link.url, err)
+				for _, m := range batch[n:] {
+					if err := spoolMetrics(link.spoolDir, m); err != nil {
+						log.Printf("暂存%s的指标出错: %v", link.url, err)
+					}
+				}
+				continue
+			}
+			replaySpool(link.spoolDir, link.send)
+		}
+	}
+	return sent, err
+}
+
+// sendPrimary 发送已分配序列号的样本，fanout模式下发送到主服务器，failover模式下发送到当前可用的服务器
+func sendPrimary(batch []SystemMetrics) (int, error) {
+	if config.ServerMode == "fanout" {
+		return links[0].send(batch)
+	}
+	return sendFailover(batch)
+}
+
+// assignSequence 为样本分配新的序列号并记录发送时间，补发的样本也按发送顺序编号
+func assignSequence(batch []SystemMetrics) {
+	sentAt := time.Now().UnixMilli()
+	for i := range batch {
+		batch[i].Sequence = nextSequence()
+		batch[i].SentAt = sentAt
+	}
+}
+
+// sendFailover 优先发送到当前使用的服务器，失败时按优先级依次尝试其他服务器，
+// 使用备用服务器期间每隔切回间隔尝试一次优先级更高的服务器；已送达的样本不会再发送到其他服务器，
+// 处于重试间隔内的服务器直接跳过，不会在每个周期都等待握手超时
+func sendFailover(batch []SystemMetrics) (int, error) {
+	if activeLink > 0 && time.Since(lastFailback) >= config.FailbackInterval {
+		lastFailback = time.Now()
+		for i := 0; i < activeLink; i++ {
+			if links[i].connect() != nil {
+				switchLink(i)
+				break
+			}
+		}
+	}
+
+	sent, err := links[activeLink].send(batch)
+	if err == nil {
+		return sent, nil
+	}
+	for i, link := range links {
+		if i == activeLink {
+			continue
+		}
+		n, linkErr := link.send(batch[sent:])
+		sent += n
+		if linkErr == nil {
+			log.Printf("服务器%s不可用: %v", links[activeLink].url, err)
+			switchLink(i)
+			return sent, nil
+		}
+	}
+	return sent, err
+}
+
+// switchLink 切换当前使用的服务器并断开原来的连接，避免原服务器继续下发配置和命令
+func switchLink(i int) {
+	previous := links[activeLink]
+	activeLink = i
+	lastFailback = time.Now()
+	previous.reset()
+	if i == 0 {
+		log.Printf("已切回主服务器: %s", links[i].url)
+	} else {
+		log.Printf("切换到备用服务器: %s", links[i].url)
+	}
+}
+
+// initServerLinks 按配置的服务器列表重新建立连接并读取代理在各服务器上的专属密钥，原有的连接全部断开
+func initServerLinks() {
+	for _, link := range links {
+		link.reset()
+	}
+	links = make([]*serverLink, len(config.ServerURLs))
+	for i, serverURL := range config.ServerURLs {
+		link := &serverLink{url: serverURL, control: config.ServerMode != "fanout" || i == 0, spoolDir: config.SpoolDir}
+		if len(config.EnrollTokens) == 1 {
+			link.enrollToken = config.EnrollTokens[0]
+		} else if len(config.EnrollTokens) > 1 {
+			link.enrollToken = config.EnrollTokens[i]
+		}
+		// fanout模式下每个服务器单独暂存和补发，主服务器沿用暂存目录本身
+		if config.ServerMode == "fanout" && i > 0 && config.SpoolDir != "" {
+			link.spoolDir = filepath.Join(config.SpoolDir, "server-"+serverKey(serverURL))
+		}
+		link.loadSecret(i == 0)
+		links[i] = link
+	}
+	activeLink = 0
+}
+
+// send 在一帧中发送多个样本，服务端不支持批量时逐个发送，返回按顺序已送达的样本数
+func (l *serverLink) send(batch []SystemMetrics) (int, error) {
+	// Use a persistent WebSocket connection
+	conn := l.connect()
+	if conn == nil {
+		return 0, fmt.Errorf("could not get WebSocket connection")
+	}
+
+	// 服务端不支持批量上报时逐个发送，中途失败时前面的样本已经送达
+	if len(batch) > 1 && !l.batchSupported {
+		for i, metrics := range batch {
+			if _, err := l.send([]SystemMetrics{metrics}); err != nil {
+				return i, err
+			}
+		}
+		return len(batch), nil
+	}
+
 	// Convert metrics to JSON
-	data, err := json.Marshal(metrics)
+	var data []byte
+	var err error
+	if len(batch) == 1 {
+		data, err = json.Marshal(batch[0])
+	} else {
+		data, err = json.Marshal(MetricsBatch{AgentID: config.AgentID, Batch: batch})
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %v", err)
+		return 0, fmt.Errorf("failed to marshal metrics: %v", err)
 	}
 
-	// Encrypt data
-	encryptedData, err := encrypt(data, config.EncryptionKey)
+	// Compress data with the negotiated algorithm
+	compressedData, err := compressPayload(data, l.compression)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt metrics: %v", err)
+		return 0, fmt.Errorf("failed to compress metrics: %v", err)
 	}
 
-	// Use a persistent WebSocket connection
-	static_conn := getWebSocketConnection()
-	if static_conn == nil {
-		return fmt.Errorf("could not get WebSocket connection")
+	// Encrypt data
+	// 已在该服务器上注册时忽略-legacy-encryption
+	var encryptedData []byte
+	if config.LegacyEncryption && !l.enrolled() {
+		encryptedData, err = encrypt(compressedData, config.EncryptionKey)
+	} else {
+		encryptedData, err = sealEnvelope(compressedData, l.encryptionKey())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt metrics: %v", err)
 	}
 
 	// Send data
-	err = static_conn.WriteMessage(websocket.BinaryMessage, encryptedData)
+	l.writeMutex.Lock()
+	err = conn.WriteMessage(websocket.BinaryMessage, encryptedData)
+	l.writeMutex.Unlock()
 	if err != nil {
 		// Connection might be broken, reset it
-		resetWebSocketConnection()
-		return fmt.Errorf("failed to send metrics: %v", err)
+		l.reset()
+		return 0, fmt.Errorf("failed to send metrics: %v", err)
 	}
 
-	return nil
+	return len(batch), nil
 }
 
-// getWebSocketConnection returns an existing connection or creates a new one
-func getWebSocketConnection() *websocket.Conn {
-	wsConnectionMutex.Lock()
-	defer wsConnectionMutex.Unlock()
-	
+// compressPayload 使用指定算法压缩数据，算法为空时原样返回
+func compressPayload(data []byte, algorithm string) ([]byte, error) {
+	switch algorithm {
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		if zstdEncoder == nil {
+			return nil, fmt.Errorf("zstd encoder not initialized")
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+// connect returns an existing connection or creates a new one
+// 只在主循环中调用，注册和握手期间不持有l.mutex，避免发送命令结果和读取消息的协程等待
+func (l *serverLink) connect() *websocket.Conn {
+	l.mutex.Lock()
+	existing := l.conn
+	l.mutex.Unlock()
+
 	// If we already have a connection, check if it's still valid
-	if wsConnection != nil {
+	if existing != nil {
 		// Send a ping to check connection
-		err := wsConnection.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(2*time.Second))
+		err := existing.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(2*time.Second))
 		if err == nil {
-			return wsConnection
+			return existing
 		}
 		// Connection is broken, close it
-		wsConnection.Close()
-		wsConnection = nil
-		log.Println("WebSocket connection lost, reconnecting...")
+		l.mutex.Lock()
+		if l.conn == existing {
+			l.conn = nil
+		}
+		l.mutex.Unlock()
+		existing.Close()
+		log.Printf("WebSocket connection to %s lost, reconnecting...", l.url)
 	}
-	
+
+	// 上次连接或注册失败后在重试间隔内不再尝试，避免每次发送都等待握手超时
+	if time.Now().Before(l.retryAt) {
+		return nil
+	}
+
+	// 提供了注册令牌但尚未在该服务器上注册时先注册，注册成功前不使用共享密钥连接
+	if l.enrollToken != "" && !l.enrolled() {
+		if _, err := l.enroll(); err != nil {
+			l.backoff()
+			log.Printf("向%s注册失败，%v后重试: %v", l.url, l.retryDelay, err)
+			return nil
+		}
+	}
+
 	// Create a new connection
 	dialer := websocket.DefaultDialer
 	dialer.HandshakeTimeout = 10 * time.Second
-	conn, _, err := dialer.Dial(config.ServerURL, nil)
+	dialer.TLSClientConfig = tlsConfig
+	requestHeader := http.Header{}
+	if config.Compression != "none" {
+		requestHeader.Set(compressionHeader, config.Compression)
+	}
+	conn, resp, err := dialer.Dial(l.url, requestHeader)
 	if err != nil {
-		log.Printf("Failed to connect to server: %v", err)
+		l.backoff()
+		log.Printf("Failed to connect to server %s, retrying in %v: %v", l.url, l.retryDelay, err)
 		return nil
 	}
-	
+	l.retryDelay = 0
+
+	// 只使用服务端确认的压缩算法和特性，兼容旧版本服务端
+	l.compression = ""
+	if config.Compression != "none" {
+		if resp.Header.Get(compressionHeader) == config.Compression {
+			l.compression = config.Compression
+		} else {
+			log.Printf("服务端%s不支持%s压缩，发送未压缩的数据", l.url, config.Compression)
+		}
+	}
+	l.batchSupported = containsString(splitList(resp.Header.Get(featuresHeader)), "batch")
+	if config.BatchSize > 1 && !l.batchSupported {
+		log.Printf("服务端%s不支持批量上报，样本将逐个发送", l.url)
+	}
+
 	// Setup ping handler to keep connection alive
 	conn.SetPingHandler(func(data string) error {
 		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(5*time.Second))
@@ -341,19 +4698,512 @@ func getWebSocketConnection() *websocket.Conn {
 		}
 		return nil
 	})
-	
-	wsConnection = conn
-	log.Println("Connected to server via WebSocket")
-	return wsConnection
+
+	l.mutex.Lock()
+	l.conn = conn
+	l.mutex.Unlock()
+	log.Printf("Connected to server %s via WebSocket", l.url)
+
+	// 读取服务端下发的消息，同时使Ping处理函数生效并及时发现断开的连接
+	go readServerMessages(l, conn)
+
+	return conn
 }
 
-// resetWebSocketConnection closes and resets the WebSocket connection
-func resetWebSocketConnection() {
-	wsConnectionMutex.Lock()
-	defer wsConnectionMutex.Unlock()
-	
-	if wsConnection != nil {
-		wsConnection.Close()
-		wsConnection = nil
+// backoff 连接或注册失败后推迟下一次尝试，重试间隔从linkRetryDelay开始每次翻倍，最长为切回间隔
+func (l *serverLink) backoff() {
+	l.retryDelay *= 2
+	if l.retryDelay < linkRetryDelay {
+		l.retryDelay = linkRetryDelay
+	}
+	if l.retryDelay > config.FailbackInterval {
+		l.retryDelay = config.FailbackInterval
+	}
+	l.retryAt = time.Now().Add(l.retryDelay)
+}
+
+// readServerMessages 读取并处理服务端下发的消息，连接断开时退出
+func readServerMessages(l *serverLink, conn *websocket.Conn) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			l.mutex.Lock()
+			if l.conn == conn {
+				log.Printf("WebSocket connection to %s closed: %v", l.url, err)
+				l.conn.Close()
+				l.conn = nil
+			}
+			l.mutex.Unlock()
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		plaintext, err := openEnvelope(data, l.encryptionKey())
+		if err != nil {
+			log.Printf("无法解密服务端消息: %v", err)
+			continue
+		}
+		var message ServerMessage
+		if err := json.Unmarshal(plaintext, &message); err != nil {
+			log.Printf("解析服务端消息失败: %v", err)
+			continue
+		}
+
+		// fanout模式下其他服务器不能下发配置，以免与主服务器冲突；每个服务器轮换的是代理在该服务器上的专属密钥
+		if !l.control && message.Type == "config" {
+			log.Printf("忽略服务器%s下发的%s消息，只接受主服务器的", l.url, message.Type)
+			continue
+		}
+
+		switch message.Type {
+		case "rotate_secret":
+			if message.Secret == "" {
+				continue
+			}
+			if err := l.saveSecret(message.Secret); err != nil {
+				log.Printf("保存%s轮换后的专属密钥失败: %v", l.url, err)
+				continue
+			}
+			log.Printf("%s上的专属密钥已轮换", l.url)
+		case "command":
+			queueCommand(serverCommand{ServerMessage: message, link: l})
+		case "config":
+			// 只保留最新的一份配置，尚未应用的旧配置直接丢弃
+			select {
+			case <-remoteConfigs:
+			default:
+			}
+			select {
+			case remoteConfigs <- message:
+			default:
+			}
+		default:
+			log.Printf("忽略未知的服务端消息类型: %s", message.Type)
+		}
+	}
+}
+
+// queueCommand 把命令交给主循环执行，队列已满时直接返回繁忙
+// 在读取服务端消息的协程中调用
+func queueCommand(command serverCommand) {
+	select {
+	case commands <- command:
+	default:
+		go finishCommand(newCommandResult(command), time.Now(), nil, fmt.Errorf("代理繁忙，请稍后重试"))
+	}
+}
+
+// newCommandResult 创建与命令对应的结果，可能在读取服务端消息的协程中调用，与applyConfig使用同一把锁读取配置
+func newCommandResult(message serverCommand) CommandResult {
+	agentSecretMutex.Lock()
+	agentID := config.AgentID
+	agentSecretMutex.Unlock()
+	return CommandResult{Type: "command_result", AgentID: agentID, ID: message.ID, Command: message.Command, link: message.link}
+}
+
+// commandTimeout 返回命令的执行时间上限，未指定时使用默认值，最长不超过maxCommandTimeout
+func commandTimeout(timeoutMs int64) time.Duration {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		return defaultCommandTimeout
+	}
+	if timeout > maxCommandTimeout {
+		return maxCommandTimeout
+	}
+	return timeout
+}
+
+// handleCommand 执行服务端触发的诊断命令并返回结果，除collect_now外的命令都在单独的协程中运行，不阻塞采集
+func handleCommand(message serverCommand) {
+	start := time.Now()
+	result := newCommandResult(message)
+	if config.CommandsDisabled {
+		finishCommand(result, start, nil, fmt.Errorf("代理已禁用远程命令"))
+		return
+	}
+	log.Printf("执行服务端触发的诊断命令: %s %v", message.Command, message.Args)
+
+	switch message.Command {
+	case "collect_now":
+		// 提前开始下一次正常的采集，样本与等待中的批量一起按顺序上报，速率基准也按正常周期推进，
+		// 采集完成后把本次的数据作为结果返回
+		collectNowCommands = append(collectNowCommands, pendingCommand{message: message, start: start})
+	case "top_processes":
+		limit := config.TopProcesses
+		if limit <= 0 {
+			limit = 10
+		}
+		if value := message.Args["limit"]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				finishCommand(result, start, nil, fmt.Errorf("无效的进程数量: %s", value))
+				return
+			}
+			limit = n
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(message.TimeoutMs))
+			defer cancel()
+			processes, err := process.ProcessesWithContext(ctx)
+			if err != nil {
+				finishCommand(result, start, nil, err)
+				return
+			}
+			top, err := collectTopProcesses(ctx, processes, limit)
+			if err != nil {
+				finishCommand(result, start, nil, err)
+				return
+			}
+			if message.Args["sort"] == "memory" {
+				sort.Slice(top, func(i, j int) bool { return top[i].RSS > top[j].RSS })
+			} else {
+				sort.Slice(top, func(i, j int) bool { return top[i].CPUPercent > top[j].CPUPercent })
+			}
+			// 采集结果是CPU和内存各前N的并集，按排序方式只保留前N个
+			if len(top) > limit {
+				top = top[:limit]
+			}
+			finishCommand(result, start, top, nil)
+		}()
+	case "listening_ports":
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(message.TimeoutMs))
+			defer cancel()
+			// 出错时仍返回已采集到的端口，状态为error
+			_, ports, err := collectConnections(ctx)
+			var data interface{}
+			if ports != nil {
+				data = ports
+			}
+			finishCommand(result, start, data, err)
+		}()
+	case "run_script":
+		dir := config.ScriptDir
+		go func() {
+			output, err := runScript(dir, message.Args["name"], commandTimeout(message.TimeoutMs))
+			var data interface{}
+			if output != nil {
+				data = output
+			}
+			finishCommand(result, start, data, err)
+		}()
+	default:
+		finishCommand(result, start, nil, fmt.Errorf("不支持的命令: %s", message.Command))
+	}
+}
+
+// runScript 运行脚本目录中指定名称的脚本，不传递任何参数，标准输出和标准错误合并后最多保留maxScriptOutput字节
+func runScript(dir, name string, timeout time.Duration) (map[string]interface{}, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("代理未配置脚本目录")
+	}
+	if !scriptNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("无效的脚本名称: %q", name)
+	}
+	path := filepath.Join(dir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("脚本不存在: %s", name)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return nil, fmt.Errorf("脚本不可执行: %s", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output := &limitedBuffer{limit: maxScriptOutput}
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = dir
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// 脚本被终止后不再等待它启动的子进程关闭输出
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+
+	data := map[string]interface{}{
+		"name":      name,
+		"exit_code": -1,
+		"output":    output.buf.String(),
+		"truncated": output.truncated,
+	}
+	if cmd.ProcessState != nil {
+		data["exit_code"] = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return data, fmt.Errorf("脚本执行超时（%v）", timeout)
+	}
+	if err != nil {
+		return data, fmt.Errorf("脚本执行失败: %v", err)
+	}
+	return data, nil
+}
+
+// limitedBuffer 只保留前limit字节的输出，超出部分丢弃并标记为已截断
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); remaining < len(p) {
+		b.truncated = true
+		if remaining > 0 {
+			b.buf.Write(p[:remaining])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// finishCommand 记录耗时和执行状态后把结果发送给服务端
+func finishCommand(result CommandResult, start time.Time, data interface{}, err error) {
+	result.DurationMs = time.Since(start).Milliseconds()
+	result.Status = "ok"
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+		log.Printf("诊断命令%s执行失败: %v", result.Command, err)
+	}
+	if data != nil {
+		result.Result = data
+	}
+	sendCommandResult(result)
+}
+
+// sendCommandResult 把诊断命令的结果发送给服务端，连接已断开时丢弃结果，服务端按超时处理
+func sendCommandResult(result CommandResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("序列化命令结果失败: %v", err)
+		return
+	}
+	l := result.link
+	envelope, err := sealEnvelope(data, l.encryptionKey())
+	if err != nil {
+		log.Printf("加密命令结果失败: %v", err)
+		return
+	}
+
+	l.mutex.Lock()
+	conn := l.conn
+	l.mutex.Unlock()
+	if conn == nil {
+		log.Printf("连接已断开，丢弃命令%s的结果", result.ID)
+		return
+	}
+	l.writeMutex.Lock()
+	err = conn.WriteMessage(websocket.BinaryMessage, envelope)
+	l.writeMutex.Unlock()
+	if err != nil {
+		log.Printf("发送命令结果失败: %v", err)
+	}
+}
+
+// reset closes and resets the WebSocket connection
+func (l *serverLink) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+// spoolMetrics 将发送失败的指标写入暂存目录，每个样本一个文件，文件名按时间排序
+func spoolMetrics(dir string, metrics SystemMetrics) error {
+	if config.SpoolMaxSize <= 0 || dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	state := loadSpool(dir)
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	// 先写临时文件再重命名，避免进程中断时留下不完整的文件
+	created := time.Now().UnixNano()
+	name := filepath.Join(dir, fmt.Sprintf("%020d.json", created))
+	tmp := name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if config.SpoolFsync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	state.files = append(state.files, spoolFile{name: filepath.Base(name), created: created, size: int64(len(data))})
+	state.size += int64(len(data))
+	pruneSpool(dir, state)
+	return nil
+}
+
+// spoolFile 暂存目录中的一个文件
+type spoolFile struct {
+	name    string
+	created int64 // 写入时间（纳秒），取自文件名
+	size    int64
+}
+
+// spoolState 暂存目录中的文件清单和总大小，首次使用时读取一次目录，之后随写入、补发和丢弃更新，写入时不再遍历目录
+type spoolState struct {
+	files []spoolFile // 按写入顺序排列
+	size  int64
+}
+
+// 各暂存目录的状态，只在主循环中读写
+var spools = make(map[string]*spoolState)
+
+// loadSpool 返回暂存目录的状态，首次调用时读取目录中已有的文件，包括上次运行时留下的
+func loadSpool(dir string) *spoolState {
+	if state, ok := spools[dir]; ok {
+		return state
+	}
+	state := &spoolState{}
+	for _, entry := range listSpool(dir) {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		created, _ := strconv.ParseInt(strings.TrimSuffix(entry.Name(), ".json"), 10, 64)
+		state.files = append(state.files, spoolFile{name: entry.Name(), created: created, size: info.Size()})
+		state.size += info.Size()
+	}
+	spools[dir] = state
+	return state
+}
+
+// forget 从清单中去掉已删除的文件
+func (s *spoolState) forget(removed map[string]bool) {
+	kept := s.files[:0]
+	for _, file := range s.files {
+		if removed[file.name] {
+			s.size -= file.size
+			continue
+		}
+		kept = append(kept, file)
+	}
+	s.files = kept
+}
+
+// listSpool 按写入顺序列出暂存目录中的文件，不含其他服务器的子目录
+func listSpool(dir string) []os.DirEntry {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	files := entries[:0]
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, entry)
+		}
+	}
+	// os.ReadDir已按文件名排序，文件名为定长的纳秒时间戳
+	return files
+}
+
+// pruneSpool 删除超过保留时间的暂存文件，目录的总容量超出上限时从最旧的开始删除
+// 只检查清单中最旧的文件，未超出限制时不访问磁盘
+func pruneSpool(dir string, state *spoolState) {
+	cutoff := time.Now().Add(-config.SpoolMaxAge).UnixNano()
+	dropped := 0
+	for len(state.files) > 0 && (state.files[0].created < cutoff || state.size > config.SpoolMaxSize) {
+		file := state.files[0]
+		if err := os.Remove(filepath.Join(dir, file.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("删除暂存文件 %s 失败: %v", file.name, err)
+			break
+		}
+		state.files = state.files[1:]
+		state.size -= file.size
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("暂存数据超出容量或保留时间，已丢弃最旧的 %d 条", dropped)
+	}
+}
+
+// replaySpool 按写入顺序用send补发暂存目录中的指标，补发成功后删除对应文件，遇到发送失败时停止
+func replaySpool(dir string, send func([]SystemMetrics) (int, error)) {
+	if config.SpoolMaxSize <= 0 || dir == "" {
+		return
 	}
-} 
\ No newline at end of file
+
+	state := loadSpool(dir)
+	if len(state.files) == 0 {
+		return
+	}
+	files := state.files
+	if len(files) > spoolReplayBatch {
+		files = files[:spoolReplayBatch]
+	}
+
+	removed := make(map[string]bool)
+	remove := func(name string) {
+		if err := os.Remove(filepath.Join(dir, name)); err == nil || os.IsNotExist(err) {
+			removed[name] = true
+		}
+	}
+	defer state.forget(removed)
+
+	sent := 0
+	var batch []SystemMetrics
+	var paths []string
+	for i, file := range files {
+		path := filepath.Join(dir, file.name)
+		if data, err := os.ReadFile(path); err == nil {
+			var metrics SystemMetrics
+			if err := json.Unmarshal(data, &metrics); err != nil {
+				log.Printf("暂存文件 %s 已损坏，丢弃: %v", file.name, err)
+				remove(file.name)
+			} else {
+				metrics.Backfill = true
+				batch = append(batch, metrics)
+				paths = append(paths, file.name)
+			}
+		} else if os.IsNotExist(err) {
+			removed[file.name] = true
+		}
+
+		// 按批量大小分帧补发
+		if len(batch) == 0 || (len(batch) < config.BatchSize && i < len(files)-1) {
+			continue
+		}
+		assignSequence(batch)
+		n, err := send(batch)
+		for _, p := range paths[:n] {
+			remove(p)
+		}
+		sent += n
+		if err != nil {
+			log.Printf("补发暂存指标出错，稍后重试: %v", err)
+			break
+		}
+		batch, paths = nil, nil
+	}
+	log.Printf("已补发 %d 条暂存指标，剩余 %d 条", sent, len(state.files)-len(removed))
+}
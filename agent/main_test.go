@@ -0,0 +1,743 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeFiles 在root下按相对路径创建文件，用于模拟sysfs、cgroup等目录
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur uint64
+		delta     uint64
+		ok        bool
+	}{
+		{"递增", 100, 150, 50, true},
+		{"不变", 100, 100, 0, true},
+		{"重置", 1000, 10, 0, false},
+		{"高位区间后重置", math.MaxUint32 - 100, 10, 0, false},
+		{"超过32位后重置", math.MaxUint32 + 100, 10, 0, false},
+	}
+	for _, tt := range tests {
+		delta, ok := counterDelta(tt.prev, tt.cur)
+		if delta != tt.delta || ok != tt.ok {
+			t.Errorf("%s: counterDelta(%d, %d) = %d, %v，期望 %d, %v", tt.name, tt.prev, tt.cur, delta, ok, tt.delta, tt.ok)
+		}
+	}
+}
+
+func TestCounterDelta32(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur uint64
+		delta     uint64
+		ok        bool
+	}{
+		{"递增", 100, 150, 50, true},
+		{"回绕", math.MaxUint32 - 9, 10, 20, true},
+		{"低位区间变小视为重置", 1000, 10, 0, false},
+		{"超过32位后变小视为重置", math.MaxUint32 + 100, 10, 0, false},
+	}
+	for _, tt := range tests {
+		delta, ok := counterDelta32(tt.prev, tt.cur)
+		if delta != tt.delta || ok != tt.ok {
+			t.Errorf("%s: counterDelta32(%d, %d) = %d, %v，期望 %d, %v", tt.name, tt.prev, tt.cur, delta, ok, tt.delta, tt.ok)
+		}
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []PressureStat
+	}{
+		{
+			name: "some和full",
+			content: "some avg10=1.50 avg60=0.75 avg300=0.10 total=123456\n" +
+				"full avg10=0.00 avg60=0.00 avg300=0.00 total=42\n",
+			want: []PressureStat{
+				{Resource: "memory", Kind: "some", Avg10: 1.5, Avg60: 0.75, Avg300: 0.1, Total: 123456},
+				{Resource: "memory", Kind: "full", Total: 42},
+			},
+		},
+		{
+			name:    "忽略未知字段和格式错误的字段",
+			content: "some avg10=2.00 unknown=1 broken total=7",
+			want:    []PressureStat{{Resource: "memory", Kind: "some", Avg10: 2, Total: 7}},
+		},
+		{
+			name:    "空内容",
+			content: "\n",
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		got := parsePressure("memory", tt.content)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parsePressure() = %+v，期望 %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectSensors(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"class/hwmon/hwmon0/name":                       "coretemp\n",
+		"class/hwmon/hwmon0/temp1_input":                "45000\n",
+		"class/hwmon/hwmon0/temp1_label":                "Package id 0\n",
+		"class/hwmon/hwmon0/temp1_crit":                 "100000\n",
+		"class/hwmon/hwmon0/in0_input":                  "1200\n",
+		"class/hwmon/hwmon1/name":                       "coretemp\n",
+		"class/hwmon/hwmon1/temp1_input":                "47500\n",
+		"class/hwmon/hwmon1/temp1_label":                "Package id 0\n",
+		"class/hwmon/hwmon2/fan1_input":                 "1500\n",
+		"class/hwmon/hwmon2/temp2_input":                "invalid\n",
+		"class/thermal/thermal_zone0/type":              "x86_pkg_temp\n",
+		"class/thermal/thermal_zone0/temp":              "50000\n",
+		"class/thermal/thermal_zone0/trip_point_0_type": "passive\n",
+		"class/thermal/thermal_zone0/trip_point_0_temp": "90000\n",
+		"class/thermal/thermal_zone0/trip_point_1_type": "critical\n",
+		"class/thermal/thermal_zone0/trip_point_1_temp": "105000\n",
+	})
+
+	want := []SensorStat{
+		{Sensor: "coretemp/Package id 0", Type: "temperature", Value: 45, Critical: 100},
+		{Sensor: "coretemp/Package id 0 (hwmon1)", Type: "temperature", Value: 47.5},
+		{Sensor: "hwmon2/fan1", Type: "fan", Value: 1500},
+		{Sensor: "thermal/x86_pkg_temp", Type: "temperature", Value: 50, Critical: 105},
+	}
+	ctx := context.Background()
+	if got, err := collectSensors(ctx, root); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("collectSensors() = %+v, %v，期望 %+v", got, err, want)
+	}
+	if got, err := collectSensors(ctx, filepath.Join(root, "missing")); err != nil || got != nil {
+		t.Errorf("sysfs不存在时collectSensors() = %+v, %v，期望nil", got, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if got, err := collectSensors(canceled, root); err != context.Canceled || got != nil {
+		t.Errorf("采集被取消时collectSensors() = %+v, %v，期望nil和context.Canceled", got, err)
+	}
+}
+
+func TestCollectCgroups(t *testing.T) {
+	root := t.TempDir()
+	containerID := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	writeFiles(t, root, map[string]string{
+		"cgroup.controllers":                                           "cpu io memory\n",
+		"system.slice/memory.current":                                  "4096\n",
+		"system.slice/nginx.service/memory.current":                    "1048576\n",
+		"system.slice/nginx.service/memory.max":                        "max\n",
+		"system.slice/nginx.service/memory.events":                     "low 0\nhigh 0\nmax 2\noom 1\noom_kill 1\n",
+		"system.slice/nginx.service/cpu.stat":                          "usage_usec 1000000\nuser_usec 600000\n",
+		"system.slice/nginx.service/io.stat":                           "8:0 rbytes=100 wbytes=200 rios=1 wios=2\n8:16 rbytes=1 wbytes=2\n",
+		"system.slice/nginx.service/child/memory.current":              "1\n",
+		"system.slice/docker-" + containerID + ".scope/memory.current": "2048\n",
+		"system.slice/docker-" + containerID + ".scope/memory.max":     "8192\n",
+		"user.slice/user-1000.slice/memory.current":                    "1\n",
+		"init.scope/memory.current":                                    "1\n",
+	})
+
+	lastCgroupCPU, lastCgroupIO, lastCgroupTime = nil, nil, time.Time{}
+	want := []CgroupStat{
+		{Name: "system.slice", Kind: "slice", Path: "system.slice", MemoryCurrent: 4096},
+		{Name: containerID[:12], Kind: "container", Path: "system.slice/docker-" + containerID + ".scope", ContainerID: containerID, MemoryCurrent: 2048, MemoryMax: 8192},
+		{Name: "nginx.service", Kind: "service", Path: "system.slice/nginx.service", MemoryCurrent: 1048576, OOMKills: 1, IOReadBytes: 101, IOWriteBytes: 202},
+		{Name: "user.slice", Kind: "slice", Path: "user.slice"},
+	}
+	ctx := context.Background()
+	if got, err := collectCgroups(ctx, root); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("collectCgroups() = %+v, %v，期望 %+v", got, err, want)
+	}
+
+	// 采集被取消时不更新基准值
+	baseline := lastCgroupTime
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if got, err := collectCgroups(canceled, root); err != context.Canceled || got != nil {
+		t.Errorf("采集被取消时collectCgroups() = %+v, %v，期望nil和context.Canceled", got, err)
+	}
+	if !lastCgroupTime.Equal(baseline) {
+		t.Errorf("采集被取消后基准时间变为%v，期望保持%v", lastCgroupTime, baseline)
+	}
+
+	// 第二次采集根据两次之间的CPU时间计算占用，1秒CPU时间分摊到约10秒约为10%
+	lastCgroupTime = lastCgroupTime.Add(-10 * time.Second)
+	writeFiles(t, root, map[string]string{"system.slice/nginx.service/cpu.stat": "usage_usec 2000000\n"})
+	stats, err := collectCgroups(ctx, root)
+	if err != nil {
+		t.Fatalf("collectCgroups()出错: %v", err)
+	}
+	for _, stat := range stats {
+		if stat.Name == "nginx.service" && math.Abs(stat.CPUPercent-10) > 0.1 {
+			t.Errorf("nginx.service的CPU占用 = %v，期望约10", stat.CPUPercent)
+		}
+	}
+	if got, err := collectCgroups(ctx, filepath.Join(root, "system.slice")); err != nil || got != nil {
+		t.Errorf("不是cgroup v2根目录时collectCgroups() = %+v, %v，期望nil", got, err)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"env=prod", map[string]string{"env": "prod"}, false},
+		{" env = prod , group=web ,", map[string]string{"env": "prod", "group": "web"}, false},
+		{"role=", map[string]string{"role": ""}, false},
+		{"a=b=c", map[string]string{"a": "b=c"}, false},
+		{"env", nil, true},
+		{"=prod", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLabels(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLabels(%q) error = %v，期望出错: %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLabels(%q) = %v，期望 %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseCollectorDurations(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"connections=1m", map[string]time.Duration{"connections": time.Minute}, false},
+		{" connections = 1m , processes=30s ,", map[string]time.Duration{"connections": time.Minute, "processes": 30 * time.Second}, false},
+		{"processes=10s,processes=20s", map[string]time.Duration{"processes": 20 * time.Second}, false},
+		{"cpu=500ms", map[string]time.Duration{"cpu": 500 * time.Millisecond}, false},
+		{"connections", nil, true},
+		{"=1m", nil, true},
+		{"unknown=1m", nil, true},
+		{"connections=1", nil, true},
+		{"connections=0s", nil, true},
+		{"connections=-1m", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCollectorDurations(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCollectorDurations(%q) 错误 = %v，期望出错 %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCollectorDurations(%q) = %v，期望 %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+// sameMetrics 比较自定义指标列表，nil与空列表视为相同
+func sameMetrics(got, want []CustomMetric) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func TestParsePerfdata(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []CustomMetric
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"time=0.5s;1;2;0;10 size=1024B;;;0", []CustomMetric{{Name: "time", Value: 0.5, Unit: "s"}, {Name: "size", Value: 1024, Unit: "B"}}, false},
+		{"'disk usage'=80%;90;95", []CustomMetric{{Name: "disk usage", Value: 80, Unit: "%"}}, false},
+		{"'it''s'=1", []CustomMetric{{Name: "it's", Value: 1}}, false},
+		{"load1=0,75", []CustomMetric{{Name: "load1", Value: 0.75}}, false},
+		{"a=U b=2", []CustomMetric{{Name: "b", Value: 2}}, false},
+		{" temp=35c \t x=-1e3 y=.5 z=+2ms ", []CustomMetric{{Name: "temp", Value: 35, Unit: "c"}, {Name: "x", Value: -1000}, {Name: "y", Value: 0.5}, {Name: "z", Value: 2, Unit: "ms"}}, false},
+		{"'open=1", nil, true},
+		{"a=1 novalue", []CustomMetric{{Name: "a", Value: 1}}, true},
+		{"a=abc", nil, true},
+		{"a=1.2.3", nil, true},
+		{"=1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePerfdata(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePerfdata(%q) 错误 = %v，期望出错 %v", tt.input, err, tt.wantErr)
+		}
+		if !sameMetrics(got, tt.want) {
+			t.Errorf("parsePerfdata(%q) = %+v，期望 %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseNagiosOutput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []CustomMetric
+		wantErr bool
+	}{
+		{"OK - all good", nil, false},
+		{"OK - all good\n", nil, false},
+		{"OK - 3 users | users=3;5;10;0", []CustomMetric{{Name: "users", Value: 3}}, false},
+		{
+			"DISK OK | /=50%\nfirst long line\nsecond long line | /home=20%\n/var=30%\n",
+			[]CustomMetric{{Name: "/", Value: 50, Unit: "%"}, {Name: "/home", Value: 20, Unit: "%"}, {Name: "/var", Value: 30, Unit: "%"}},
+			false,
+		},
+		{"WARNING\nlong text | rta=1.5ms pl=0%", []CustomMetric{{Name: "rta", Value: 1.5, Unit: "ms"}, {Name: "pl", Value: 0, Unit: "%"}}, false},
+		{"CRITICAL | broken", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNagiosOutput(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNagiosOutput(%q) 错误 = %v，期望出错 %v", tt.input, err, tt.wantErr)
+		}
+		if !sameMetrics(got, tt.want) {
+			t.Errorf("parseNagiosOutput(%q) = %+v，期望 %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseJSONOutput(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []CustomMetric
+		wantErr bool
+	}{
+		{`{"b": 2, "a": 1.5}`, []CustomMetric{{Name: "a", Value: 1.5}, {Name: "b", Value: 2}}, false},
+		{"  {\"a\": 1}\n", []CustomMetric{{Name: "a", Value: 1}}, false},
+		{`{}`, nil, false},
+		{`[]`, nil, false},
+		{
+			`[{"name": "queue", "value": 3, "labels": {"queue": "mail"}, "unit": "ms"}, {"name": "zero", "value": 0}]`,
+			[]CustomMetric{{Name: "queue", Labels: map[string]string{"queue": "mail"}, Value: 3, Unit: "ms"}, {Name: "zero", Value: 0}},
+			false,
+		},
+		{`[{"name": "a", "value": 1}, {"value": 2}]`, []CustomMetric{{Name: "a", Value: 1}}, true},
+		{`[{"name": "a"}]`, nil, true},
+		{`{"": 1}`, nil, true},
+		{`{"a": "x"}`, nil, true},
+		{`not json`, nil, true},
+		{``, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONOutput([]byte(tt.input))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseJSONOutput(%q) 错误 = %v，期望出错 %v", tt.input, err, tt.wantErr)
+		}
+		if !sameMetrics(got, tt.want) {
+			t.Errorf("parseJSONOutput(%q) = %+v，期望 %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrometheusSample(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    CustomMetric
+		wantErr bool
+	}{
+		{"up 1", CustomMetric{Name: "up", Value: 1}, false},
+		{"http_requests_total{method=\"post\",code=\"200\"} 1027 1395066363000", CustomMetric{Name: "http_requests_total", Labels: map[string]string{"method": "post", "code": "200"}, Value: 1027}, false},
+		{"node:load_ratio { cpu = \"0\" , } \t 0.5", CustomMetric{Name: "node:load_ratio", Labels: map[string]string{"cpu": "0"}, Value: 0.5}, false},
+		{`msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9`, CustomMetric{Name: "msdos_file_access_time_seconds", Labels: map[string]string{"path": `C:\DIR\FILE.TXT`, "error": "Cannot find file:\n\"FILE.TXT\""}, Value: 1.458255915e9}, false},
+		{`empty{a="",b="x"} 2`, CustomMetric{Name: "empty", Labels: map[string]string{"b": "x"}, Value: 2}, false},
+		{"nothing{} -3", CustomMetric{Name: "nothing", Value: -3}, false},
+		{"rate +Inf", CustomMetric{Name: "rate", Value: math.Inf(1)}, false},
+		{"rate -Inf", CustomMetric{Name: "rate", Value: math.Inf(-1)}, false},
+		{"1abc 1", CustomMetric{}, true},
+		{"up", CustomMetric{}, true},
+		{"up 1 2 3", CustomMetric{}, true},
+		{"up abc", CustomMetric{}, true},
+		{`up{1a="x"} 1`, CustomMetric{}, true},
+		{`up{a "x"} 1`, CustomMetric{}, true},
+		{`up{a=x} 1`, CustomMetric{}, true},
+		{`up{a="x} 1`, CustomMetric{}, true},
+		{`up{a="x" b="y"} 1`, CustomMetric{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrometheusSample(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePrometheusSample(%q) 错误 = %v，期望出错 %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePrometheusSample(%q) = %+v，期望 %+v", tt.line, got, tt.want)
+		}
+	}
+
+	got, err := parsePrometheusSample("missing NaN")
+	if err != nil || !math.IsNaN(got.Value) {
+		t.Errorf("parsePrometheusSample(\"missing NaN\") = %+v, %v，期望NaN", got, err)
+	}
+}
+
+func TestParsePrometheusText(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []CustomMetric
+		wantErr bool
+	}{
+		{"空内容", "\n  \n# 普通注释\n", nil, false},
+		{
+			"类型和说明",
+			"# HELP jobs_done Jobs done.\\nSecond line \\\\ end\n# TYPE jobs_done counter\njobs_done{queue=\"a\"} 3\njobs_done{queue=\"b\"} 4\nuntyped_metric 1\n",
+			[]CustomMetric{
+				{Name: "jobs_done", Labels: map[string]string{"queue": "a"}, Value: 3, Type: "counter", Help: "Jobs done.\nSecond line \\ end"},
+				{Name: "jobs_done", Labels: map[string]string{"queue": "b"}, Value: 4, Type: "counter", Help: "Jobs done.\nSecond line \\ end"},
+				{Name: "untyped_metric", Value: 1},
+			},
+			false,
+		},
+		{
+			"直方图后缀",
+			"# TYPE latency histogram\n# HELP latency Request latency.\nlatency_bucket{le=\"0.1\"} 2\nlatency_bucket{le=\"+Inf\"} 5\nlatency_sum 1.5\nlatency_count 5\n# TYPE size_count gauge\nsize_count 7\n# TYPE size summary\nsize_sum 9\n",
+			[]CustomMetric{
+				{Name: "latency_bucket", Labels: map[string]string{"le": "0.1"}, Value: 2, Type: "histogram", Help: "Request latency."},
+				{Name: "latency_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 5, Type: "histogram", Help: "Request latency."},
+				{Name: "latency_sum", Value: 1.5, Type: "histogram", Help: "Request latency."},
+				{Name: "latency_count", Value: 5, Type: "histogram", Help: "Request latency."},
+				{Name: "size_count", Value: 7, Type: "gauge"},
+				{Name: "size_sum", Value: 9, Type: "summary"},
+			},
+			false,
+		},
+		{
+			"忽略NaN、无穷和时间戳",
+			"a NaN\nb +Inf\nc -Inf 1620000000000\nd 2 1620000000000\n",
+			[]CustomMetric{{Name: "d", Value: 2}},
+			false,
+		},
+		{"不支持的类型", "# TYPE a enum\na 1\n", nil, true},
+		{"格式错误", "a 1\nb\n", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrometheusText(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parsePrometheusText() 错误 = %v，期望出错 %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !sameMetrics(got, tt.want) {
+			t.Errorf("%s: parsePrometheusText() = %+v，期望 %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectTextfilesLimit(t *testing.T) {
+	dir := t.TempDir()
+	var b strings.Builder
+	for i := 0; i < maxTextfileMetrics+10; i++ {
+		fmt.Fprintf(&b, "sample{i=\"%d\"} %d\n", i, i)
+	}
+	writeFiles(t, dir, map[string]string{"a.prom": b.String(), "b.prom": "other 1\n"})
+
+	metrics, err := collectTextfiles(dir)
+	if err == nil {
+		t.Error("指标数量超过上限时collectTextfiles()应返回错误")
+	}
+	if len(metrics) != maxTextfileMetrics {
+		t.Fatalf("collectTextfiles()返回%d个指标，期望%d个", len(metrics), maxTextfileMetrics)
+	}
+	last := metrics[len(metrics)-1]
+	if last.Name != "node_textfile_scrape_error" || last.Value != 1 {
+		t.Errorf("最后一个指标为%+v，期望值为1的node_textfile_scrape_error", last)
+	}
+	mtimes := 0
+	for _, m := range metrics {
+		if m.Name == "node_textfile_mtime_seconds" {
+			mtimes++
+		}
+	}
+	if mtimes != 2 {
+		t.Errorf("node_textfile_mtime_seconds有%d个，期望2个", mtimes)
+	}
+}
+
+// newTestStatsd 创建不监听端口的StatsD聚合器，周期从start开始
+func newTestStatsd(start time.Time) *statsdServer {
+	return &statsdServer{metrics: make(map[string]*statsdMetric), since: start}
+}
+
+func TestStatsdAdd(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{"hits:1|c", false},
+		{"hits:1|c|@0.1|#env:prod", false},
+		{"latency:12.5|ms", false},
+		{"latency:3|h|#a", false},
+		{"users:alice|s", false},
+		{"temp:-2|g", false},
+		{"_e{5,4}:title|text", false},
+		{"_sc|db|0", false},
+		{"bad", true},
+		{":1|c", true},
+		{"hits:1", true},
+		{"hits:1|q", true},
+		{"hits:abc|c", true},
+		{"hits:NaN|g", true},
+		{"hits:Inf|ms", true},
+		{"hits:1|c|@0", true},
+		{"hits:1|c|@1.5", true},
+		{"hits:1|c|@x", true},
+	}
+	for _, tt := range tests {
+		s := newTestStatsd(time.Now())
+		if err := s.add(tt.line); (err != nil) != tt.wantErr {
+			t.Errorf("add(%q) 错误 = %v，期望出错 %v", tt.line, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStatsdFlush(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newTestStatsd(start)
+	for _, line := range []string{
+		"hits:2|c|@0.5",
+		"hits:1|c",
+		"req:1|c|#env:prod,host:a",
+		"req:2|c|#host:a,env:prod",
+		"temp:10|g",
+		"temp:+5|g",
+		"temp:-3|g",
+		"delta:-4|g",
+		"users:a|s",
+		"users:b|s",
+		"users:a|s",
+		"_e{5,4}:title|text",
+	} {
+		if err := s.add(line); err != nil {
+			t.Fatalf("add(%q)出错: %v", line, err)
+		}
+	}
+	for i := 10; i >= 1; i-- {
+		s.add(fmt.Sprintf("lat:%d|ms|@0.5", i))
+	}
+	metrics, invalid, dropped := s.flush(start.Add(10*time.Second), []float64{50, 90, 99.9})
+	counter, gauge, timer, set := "counter", "gauge", "timer", "set"
+	labels := map[string]string{"env": "prod", "host": "a"}
+	want := []CustomMetric{
+		{Name: "hits.count", Value: 5, Type: counter},
+		{Name: "hits.rate", Value: 0.5, Unit: "/s", Type: counter},
+		{Name: "req.count", Labels: labels, Value: 3, Type: counter},
+		{Name: "req.rate", Labels: labels, Value: 0.3, Unit: "/s", Type: counter},
+		{Name: "delta", Value: -4, Type: gauge},
+		{Name: "temp", Value: 12, Type: gauge},
+		{Name: "users", Value: 2, Type: set},
+		{Name: "lat.count", Value: 20, Type: timer},
+		{Name: "lat.min", Value: 1, Unit: "ms", Type: timer},
+		{Name: "lat.max", Value: 10, Unit: "ms", Type: timer},
+		{Name: "lat.mean", Value: 5.5, Unit: "ms", Type: timer},
+		{Name: "lat.p50", Value: 5, Unit: "ms", Type: timer},
+		{Name: "lat.p90", Value: 9, Unit: "ms", Type: timer},
+		{Name: "lat.p99_9", Value: 10, Unit: "ms", Type: timer},
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("flush() =\n%+v\n期望\n%+v", metrics, want)
+	}
+	if invalid != 0 || dropped != 0 {
+		t.Errorf("flush() invalid = %d, dropped = %d，期望都为0", invalid, dropped)
+	}
+
+	// 计数器、计时器和集合在上报后清空，仪表盘继续上报原值，直到连续statsdGaugeExpiry个周期没有更新
+	next := start.Add(20 * time.Second)
+	s.add("temp:+1|g")
+	for i := 0; i < statsdGaugeExpiry; i++ {
+		metrics, _, _ = s.flush(next, nil)
+		wantGauges := []CustomMetric{{Name: "delta", Value: -4, Type: gauge}, {Name: "temp", Value: 13, Type: gauge}}
+		if i == statsdGaugeExpiry-1 {
+			wantGauges = wantGauges[1:]
+		}
+		if !reflect.DeepEqual(metrics, wantGauges) {
+			t.Errorf("第%d个空闲周期flush() = %+v，期望 %+v", i+1, metrics, wantGauges)
+		}
+	}
+	if _, ok := s.metrics["gauge|delta|"]; ok {
+		t.Error("长期没有更新的仪表盘应被删除")
+	}
+}
+
+func TestStatsdLimit(t *testing.T) {
+	s := newTestStatsd(time.Now())
+	for i := 0; i < maxStatsdMetrics; i++ {
+		s.add(fmt.Sprintf("g%d:1|g", i))
+	}
+	s.add("extra:1|c")
+	if _, _, dropped := s.flush(time.Now(), nil); dropped != 1 {
+		t.Fatalf("超过上限时dropped = %d，期望1", dropped)
+	}
+
+	// 仪表盘过期后释放名额
+	for i := 0; i < statsdGaugeExpiry; i++ {
+		s.flush(time.Now(), nil)
+	}
+	s.add("extra:1|c")
+	metrics, _, dropped := s.flush(time.Now(), nil)
+	if dropped != 0 || len(metrics) != 2 || metrics[0].Name != "extra.count" {
+		t.Errorf("仪表盘过期后flush() = %+v, dropped = %d，期望只有extra的计数", metrics, dropped)
+	}
+}
+
+// TestQueueCommandBusy 命令队列已满时在读取消息的协程中直接返回繁忙，与主循环替换配置并发时不能有数据竞争，需要用-race运行
+func TestQueueCommandBusy(t *testing.T) {
+	saved := config
+	defer func() {
+		agentSecretMutex.Lock()
+		config = saved
+		agentSecretMutex.Unlock()
+	}()
+	// 填满队列，之后的命令都走繁忙的分支
+	for len(commands) < cap(commands) {
+		commands <- serverCommand{}
+	}
+	defer func() {
+		for len(commands) > 0 {
+			<-commands
+		}
+	}()
+
+	link := &serverLink{url: "ws://127.0.0.1:0/ws"}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			queueCommand(serverCommand{ServerMessage: ServerMessage{Type: "command", ID: fmt.Sprint(i), Command: "top_processes"}, link: link})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		newConfig := saved
+		newConfig.AgentID = fmt.Sprintf("agent-%d", i)
+		agentSecretMutex.Lock()
+		config = newConfig
+		agentSecretMutex.Unlock()
+	}
+	wg.Wait()
+
+	if len(commands) != cap(commands) {
+		t.Errorf("期望队列保持已满，实际 %d/%d", len(commands), cap(commands))
+	}
+}
+
+// TestConnectWithoutLock 握手期间不持有连接锁，发送命令结果和读取消息的协程不会被阻塞
+func TestConnectWithoutLock(t *testing.T) {
+	// 接受TCP连接但不响应握手
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	link := &serverLink{url: "ws://" + listener.Addr().String() + "/ws"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		link.connect()
+	}()
+
+	var serverConn net.Conn
+	select {
+	case serverConn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("期望代理发起连接")
+	}
+	if !link.mutex.TryLock() {
+		t.Error("期望握手期间连接锁可用")
+	} else {
+		link.mutex.Unlock()
+	}
+
+	serverConn.Close()
+	<-done
+	if link.conn != nil {
+		t.Error("期望握手失败后没有连接")
+	}
+	if link.retryAt.IsZero() {
+		t.Error("期望握手失败后推迟重试")
+	}
+}
+
+// TestSpool 暂存目录的清单随写入、丢弃和补发更新，与磁盘上的文件保持一致
+func TestSpool(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	dir := t.TempDir()
+	config.SpoolMaxAge = time.Hour
+	config.BatchSize = 2
+
+	// 上次运行留下的文件在首次使用时读入清单，超过保留时间的先被丢弃
+	expired := fmt.Sprintf("%020d.json", time.Now().Add(-2*time.Hour).UnixNano())
+	writeFiles(t, dir, map[string]string{expired: `{"agent_id":"old"}`})
+
+	data, _ := json.Marshal(SystemMetrics{AgentID: "agent"})
+	config.SpoolMaxSize = int64(len(data)) * 3
+	for i := 0; i < 5; i++ {
+		if err := spoolMetrics(dir, SystemMetrics{AgentID: "agent"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := spools[dir]
+	if len(state.files) != 3 || state.size != config.SpoolMaxSize {
+		t.Errorf("期望保留最新的3个文件共 %d 字节，实际 %d 个共 %d 字节", config.SpoolMaxSize, len(state.files), state.size)
+	}
+	if files := listSpool(dir); len(files) != len(state.files) {
+		t.Errorf("期望目录中有 %d 个文件，实际 %d", len(state.files), len(files))
+	}
+
+	// 第二帧发送失败时只删除已送达的文件
+	calls := 0
+	replaySpool(dir, func(batch []SystemMetrics) (int, error) {
+		calls++
+		if calls > 1 {
+			return 0, fmt.Errorf("连接已断开")
+		}
+		return len(batch), nil
+	})
+	if len(state.files) != 1 || state.size != int64(len(data)) {
+		t.Errorf("期望剩余1个文件，实际 %d 个共 %d 字节", len(state.files), state.size)
+	}
+	if files := listSpool(dir); len(files) != 1 || files[0].Name() != state.files[0].name {
+		t.Errorf("期望目录中只剩 %s，实际 %v", state.files[0].name, files)
+	}
+
+	replaySpool(dir, func(batch []SystemMetrics) (int, error) { return len(batch), nil })
+	if len(state.files) != 0 || state.size != 0 || len(listSpool(dir)) != 0 {
+		t.Errorf("期望补发后暂存目录为空，实际清单 %d 个、%d 字节，目录 %d 个", len(state.files), state.size, len(listSpool(dir)))
+	}
+}
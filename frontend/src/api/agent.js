@@ -9,6 +9,14 @@
  * - 获取代理列表
  * - 获取单个代理详情
  * - 获取代理的监控指标数据
+ * - 获取代理各挂载点的文件系统数据
+ * - 获取代理各网卡的流量速率
+ * - 获取代理的压力阻塞信息
+ * - 获取代理的温度和风扇传感器读数
+ * - 获取代理的容器和服务资源占用
+ * - 获取代理的systemd服务状态
+ * - 获取代理的监听端口
+ * - 获取代理的进程快照
  * - 更新和删除代理
  */
 
@@ -172,6 +180,146 @@ export default {
     }
   },
   
+  // 获取代理各挂载点的文件系统数据
+  async getAgentFilesystems(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/metrics/filesystems`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid filesystem metrics data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch filesystem metrics for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理各网卡的流量速率
+  async getAgentNetworkInterfaces(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/metrics/network`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid network metrics data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch network metrics for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的压力阻塞信息
+  async getAgentPressure(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/metrics/pressure`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid pressure metrics data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch pressure metrics for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的温度和风扇传感器读数
+  async getAgentSensors(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/metrics/sensors`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid sensor metrics data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch sensor metrics for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的自定义指标历史
+  async getAgentCustomMetrics(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/metrics/custom`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid custom metrics data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch custom metrics for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的自定义指标曲线及其最新取值
+  async getAgentCustomSeries(id) {
+    try {
+      const response = await api.get(`/agents/${id}/custom-metrics`)
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid custom series data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch custom series for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的容器和服务资源占用
+  async getAgentContainers(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/containers`, { params })
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid container data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch containers for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的systemd服务状态
+  async getAgentServices(id) {
+    try {
+      const response = await api.get(`/agents/${id}/services`)
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid services data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch services for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理的监听端口
+  async getAgentListeningPorts(id) {
+    try {
+      const response = await api.get(`/agents/${id}/listening-ports`)
+      if (!Array.isArray(response.data)) {
+        throw new Error('Invalid listening ports data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch listening ports for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
+  // 获取代理某一时刻的进程快照
+  async getAgentProcesses(id, params) {
+    try {
+      const response = await api.get(`/agents/${id}/processes`, { params })
+      if (!response.data || !Array.isArray(response.data.processes)) {
+        throw new Error('Invalid process snapshot data format')
+      }
+      return response.data
+    } catch (error) {
+      console.error(`Failed to fetch processes for agent ${id}:`, error)
+      throw error
+    }
+  },
+  
   // 更新代理信息
   async updateAgent(id, data) {
     try {
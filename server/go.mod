@@ -1,12 +1,13 @@
 module github.com/user/linux-monitor/server
 
-go 1.20
+go 1.23.0
 
 require (
 	github.com/gin-gonic/gin v1.9.0
 	github.com/golang-jwt/jwt/v4 v4.5.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.16.7
 	github.com/mattn/go-sqlite3 v1.14.16
 	golang.org/x/crypto v0.17.0
 )
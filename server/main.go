@@ -17,19 +17,36 @@ linux-monitor 服务端
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"net/url"
 
@@ -37,8 +54,10 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/hkdf"
 )
 
 // Config 配置结构体，用于保存服务端配置
@@ -48,12 +67,146 @@ type Config struct {
 	EncryptionKey string `json:"encryption_key"` // AES加密密钥
 	APIKey        string `json:"api_key"`        // API认证密钥
 	JWTSecret     string `json:"jwt_secret"`     // JWT密钥
+
+	EncryptionKeys       []string `json:"encryption_keys,omitempty"`       // 密钥轮换期间额外接受的加密密钥
+	RequireAuthenticated bool     `json:"require_authenticated,omitempty"` // 拒绝明文和旧版AES-CFB格式的数据，只接受认证加密信封
+
+	ClockSkewThresholdSeconds int `json:"clock_skew_threshold_seconds,omitempty"` // 代理时钟偏移告警阈值（秒），为0时使用默认值
+
+	RequireEnrollment bool `json:"require_enrollment,omitempty"` // 只接受使用专属密钥的代理，拒绝使用共享密钥的数据
+
+	TLSCert           string `json:"tls_cert,omitempty"`            // TLS证书文件，设置后以HTTPS/WSS提供服务
+	TLSKey            string `json:"tls_key,omitempty"`             // TLS私钥文件
+	TLSSelfSigned     bool   `json:"tls_self_signed,omitempty"`     // 证书文件不存在或已过期时自动生成自签名证书
+	TLSClientCA       string `json:"tls_client_ca,omitempty"`       // 校验代理客户端证书的CA证书文件
+	RequireClientCert bool   `json:"require_client_cert,omitempty"` // 代理连接必须提供由tls_client_ca签发的客户端证书
+
+	ProcessRetentionHours int `json:"process_retention_hours,omitempty"` // 进程快照保留时长（小时），为0时使用默认值
+}
+
+// 进程快照默认保留时长（小时）
+const defaultProcessRetentionHours = 48
+
+// 每次上报最多存储的自定义指标数量，以及指标名称的最大长度
+const (
+	maxCustomMetrics    = 2000
+	maxCustomMetricName = 200
+)
+
+// 代理时钟偏移默认告警阈值（秒）
+const defaultClockSkewThresholdSeconds = 30
+
+// 信封nonce的记录时长（秒），窗口期内重复出现的信封视为重放
+const nonceWindowSeconds = 300
+
+// 自动生成的自签名证书有效期
+const selfSignedCertValidity = 5 * 365 * 24 * time.Hour
+
+// 注册令牌默认有效期（小时）
+const defaultEnrollmentTokenTTLHours = 24
+
+// 代理通过该标签声明所属分组，分组的期望配置对组内所有代理生效
+const configGroupLabel = "group"
+
+// 允许服务端下发的配置项，连接、密钥、TLS和标签等设置只能在代理本机修改
+var remoteConfigKeys = []string{"interval", "collectors", "spool", "batch"}
+
+// 允许在代理上执行的诊断命令及各命令接受的参数
+var diagnosticCommands = map[string][]string{
+	"collect_now":     nil,
+	"top_processes":   {"limit", "sort"},
+	"listening_ports": nil,
+	"run_script":      {"name"},
+}
+
+// 诊断命令的默认和最长等待时间，代理返回结果的传输时间另计
+const (
+	defaultCommandTimeout  = 30 * time.Second
+	maxCommandTimeout      = 5 * time.Minute
+	commandResultGrace     = 5 * time.Second
+	maxCommandTopProcesses = 100
+)
+
+// 脚本名称只能包含字母、数字、点、下划线和连字符，与代理的校验规则一致
+var scriptNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// 代理返回的命令结果以该前缀开头，据此与指标数据区分
+var commandResultPrefix = []byte(`{"type":"command_result"`)
+
+// 代理上报数据的大小限制
+const (
+	maxAgentMessageSize = 8 * 1024 * 1024  // 单个WebSocket帧的最大字节数
+	maxDecompressedSize = 64 * 1024 * 1024 // 解压后的最大字节数
+)
+
+// 认证加密信封格式：魔数(2) | 版本(1) | 密钥ID(8) | nonce(12) | 密文和GCM认证标签
+// 魔数、版本和密钥ID作为附加认证数据参与校验
+const (
+	envelopeVersion   = 2
+	envelopeKeyIDSize = 8
+)
+
+var envelopeMagic = []byte("LM")
+
+// envelopeKey 信封密钥及其所属代理
+type envelopeKey struct {
+	id       []byte      // 密钥ID
+	aead     cipher.AEAD // AES-256-GCM加解密器
+	agentID  string      // 代理专属密钥所属的代理，共享密钥为空
+	previous bool        // 是否为轮换前的旧密钥
+}
+
+// 按密钥ID索引的信封密钥，启动时由配置的共享密钥和数据库中的代理专属密钥派生
+var (
+	envelopeKeysMutex sync.RWMutex
+	envelopeKeys      = make(map[string]envelopeKey)
+	agentCredentials  = make(map[string]bool) // 已登记专属密钥（含已吊销）的代理，不再接受共享密钥
+	pendingRotations  = make(map[string]bool) // 已轮换密钥但代理尚未开始使用新密钥
+)
+
+// 防重放状态：每个代理已接受的最大序列号和近期出现过的信封nonce
+var (
+	replayMutex    sync.Mutex
+	agentSequences = make(map[string]uint64) // 键为代理ID
+	seenNonces     = make(map[string]int64)  // 键为nonce，值为首次出现的时间
+	lastNoncePrune int64
+)
+
+// 代理连接映射表的锁，管理接口下发配置时与WebSocket处理协程并发访问
+var clientsMutex sync.RWMutex
+
+// pendingCommand 已发送给代理、正在等待结果的诊断命令
+type pendingCommand struct {
+	agentID string
+	client  *agentConnection   // 只接受发出命令的连接返回的结果
+	result  chan CommandResult // 容量为1，结果到达时不阻塞读取循环
 }
 
+// 等待结果的诊断命令，键为命令ID
+var (
+	commandsMutex   sync.Mutex
+	pendingCommands = make(map[string]*pendingCommand)
+)
+
+// 与代理握手时使用的HTTP头
+const (
+	compressionHeader = "X-Monitor-Compression" // 代理请求的压缩算法列表，服务端在响应中返回选定的算法
+	featuresHeader    = "X-Monitor-Features"    // 服务端支持的上报特性，逗号分隔
+)
+
+// 压缩数据的头部魔数
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
 // SystemMetrics 系统指标结构体，用于存储从客户端代理接收的监控数据
 type SystemMetrics struct {
 	AgentID        string                 `json:"agent_id"`        // 代理ID
 	Timestamp      int64                  `json:"timestamp"`       // 时间戳
+	Backfill       bool                   `json:"backfill"`        // 是否为代理断线期间暂存后补发的数据
+	Sequence       uint64                 `json:"seq"`             // 代理发送时分配的单调递增序列号，旧版代理为0
+	SentAt         int64                  `json:"sent_at"`         // 代理发送时的时间（毫秒）
 	CPUUsage       float64                `json:"cpu_usage"`       // CPU使用率
 	MemoryInfo     map[string]interface{} `json:"memory_info"`     // 内存信息
 	DiskInfo       map[string]interface{} `json:"disk_info"`       // 磁盘信息
@@ -62,6 +215,248 @@ type SystemMetrics struct {
 	ProcessCount   int                    `json:"process_count"`   // 进程数量
 	SystemInfo     map[string]interface{} `json:"system_info"`     // 系统信息
 	UptimeSeconds  uint64                 `json:"uptime_seconds"`  // 系统运行时间(秒)
+	CPUStats       []CPUStat              `json:"cpu_stats"`       // 汇总及每个核心的CPU模式占比
+	Filesystems    []FilesystemInfo       `json:"filesystems"`     // 各挂载点的空间和inode使用情况
+	DiskIO         []DiskIOStat           `json:"disk_io"`         // 各块设备的IO速率
+	NetInterfaces  []NetInterfaceStat     `json:"net_interfaces"`  // 各网卡的流量速率、错误和丢包
+	ConnStates     []ConnStateCount       `json:"conn_states"`     // 按协议和状态统计的连接数
+	ListeningPorts []ListeningPort        `json:"listening_ports"` // 正在监听的端口及所属进程，为null表示本次没有采集
+	TopProcesses   []ProcessInfo          `json:"top_processes"`   // CPU和内存占用最高的进程
+	Memory         *MemoryStat            `json:"memory"`          // 内存和交换分区明细
+	Pressure       []PressureStat         `json:"pressure"`        // CPU、内存和IO的压力阻塞信息
+	Sensors        []SensorStat           `json:"sensors"`         // 温度和风扇传感器读数
+	Cgroups        []CgroupStat           `json:"cgroups"`         // 各容器、systemd服务和slice的资源占用
+	SystemdUnits   []UnitStat             `json:"systemd_units"`   // 关注的及处于failed状态的systemd单元
+
+	Labels        map[string]string `json:"labels,omitempty"`         // 代理配置的标签
+	ConfigVersion string            `json:"config_version,omitempty"` // 代理已应用的服务端下发配置版本
+	ConfigError   string            `json:"config_error,omitempty"`   // 代理拒绝服务端下发配置的原因
+
+	Collectors []CollectorStat `json:"collectors,omitempty"` // 代理各采集项最近一次采集的耗时和错误
+
+	CustomMetrics []CustomMetric `json:"custom_metrics,omitempty"` // 外部程序等来源的自定义指标
+}
+
+// CustomMetric 代理上报的单个自定义指标，名称和标签相同的数据属于同一条曲线
+type CustomMetric struct {
+	Name   string            `json:"name"`             // 指标名称
+	Labels map[string]string `json:"labels,omitempty"` // 标签
+	Value  float64           `json:"value"`            // 数值
+	Unit   string            `json:"unit,omitempty"`   // 单位
+	Type   string            `json:"type,omitempty"`   // 指标类型，如counter、gauge
+	Help   string            `json:"help,omitempty"`   // 指标说明
+	Source string            `json:"source,omitempty"` // 来源，如textfile、statsd、exec:<程序名称>，旧版本代理上报时为空
+}
+
+// customMetricID 按来源和名称区分的自定义指标，不同来源的同名指标分别保存类型和说明
+type customMetricID struct {
+	Source string
+	Name   string
+}
+
+// CollectorStat 代理单个采集项最近一次采集的耗时和错误
+type CollectorStat struct {
+	Name       string  `json:"name"`            // 采集项名称
+	DurationMs float64 `json:"duration_ms"`     // 耗时（毫秒）
+	LastRun    int64   `json:"last_run"`        // 最近一次开始采集的时间戳
+	Error      string  `json:"error,omitempty"` // 采集失败或超时的原因
+}
+
+// UnitStat 单个systemd单元的状态
+type UnitStat struct {
+	Unit           string `json:"unit"`             // 单元名称
+	LoadState      string `json:"load_state"`       // 加载状态
+	ActiveState    string `json:"active_state"`     // 活动状态
+	SubState       string `json:"sub_state"`        // 子状态
+	Restarts       int64  `json:"restarts"`         // 自动重启次数
+	StateChangedAt int64  `json:"state_changed_at"` // 最近一次状态变化的时间戳
+	Watched        bool   `json:"watched"`          // 是否为代理配置中关注的单元
+}
+
+// CgroupStat 单个cgroup（容器、systemd服务或顶层slice）的资源占用
+type CgroupStat struct {
+	Name               string  `json:"name"`                   // 容器名称或systemd单元名称
+	Kind               string  `json:"kind"`                   // 类型：container、service、slice
+	Path               string  `json:"path"`                   // 相对cgroup根目录的路径
+	ContainerID        string  `json:"container_id"`           // 容器ID，非容器为空
+	CPUPercent         float64 `json:"cpu_percent"`            // CPU占用，以单核为100%
+	MemoryCurrent      int64   `json:"memory_current"`         // 当前内存占用（字节）
+	MemoryMax          int64   `json:"memory_max"`             // 内存上限（字节），0表示不限制
+	OOMKills           int64   `json:"oom_kills"`              // 累计OOM kill次数
+	IOReadBytes        int64   `json:"io_read_bytes"`          // 累计读取字节数
+	IOWriteBytes       int64   `json:"io_write_bytes"`         // 累计写入字节数
+	IOReadBytesPerSec  float64 `json:"io_read_bytes_per_sec"`  // 每秒读取字节数
+	IOWriteBytesPerSec float64 `json:"io_write_bytes_per_sec"` // 每秒写入字节数
+}
+
+// SensorStat 单个硬件传感器的读数
+type SensorStat struct {
+	Sensor   string  `json:"sensor"`   // 传感器标识
+	Type     string  `json:"type"`     // 传感器类型：temperature或fan
+	Value    float64 `json:"value"`    // 读数，温度单位为摄氏度，风扇单位为RPM
+	Critical float64 `json:"critical"` // 临界温度（摄氏度），未知时为0
+}
+
+// MemoryStat 内存和交换分区明细，容量单位为字节
+type MemoryStat struct {
+	Total         int64   `json:"total"`            // 总内存
+	Used          int64   `json:"used"`             // 已用内存
+	Available     int64   `json:"available"`        // 可用内存（含可回收的缓存）
+	Cached        int64   `json:"cached"`           // 页缓存
+	Buffers       int64   `json:"buffers"`          // 块设备缓冲区
+	Dirty         int64   `json:"dirty"`            // 等待写回磁盘的脏页
+	Slab          int64   `json:"slab"`             // 内核slab
+	SwapTotal     int64   `json:"swap_total"`       // 交换分区总量
+	SwapUsed      int64   `json:"swap_used"`        // 已用交换分区
+	SwapInPerSec  float64 `json:"swap_in_per_sec"`  // 每秒换入字节数
+	SwapOutPerSec float64 `json:"swap_out_per_sec"` // 每秒换出字节数
+}
+
+// PressureStat 单个资源的压力阻塞信息（PSI）
+type PressureStat struct {
+	Resource string  `json:"resource"` // 资源：cpu、memory、io
+	Kind     string  `json:"kind"`     // some或full
+	Avg10    float64 `json:"avg10"`    // 10秒平均值（百分比）
+	Avg60    float64 `json:"avg60"`    // 60秒平均值（百分比）
+	Avg300   float64 `json:"avg300"`   // 300秒平均值（百分比）
+	Total    int64   `json:"total"`    // 累计阻塞时间（微秒）
+}
+
+// ProcessInfo 单个进程的资源占用
+type ProcessInfo struct {
+	PID        int64   `json:"pid"`         // 进程PID
+	Name       string  `json:"name"`        // 进程名称
+	Cmdline    string  `json:"cmdline"`     // 命令行
+	Username   string  `json:"username"`    // 运行用户
+	CPUPercent float64 `json:"cpu_percent"` // CPU占用，以单核为100%
+	RSS        int64   `json:"rss"`         // 常驻内存（字节）
+	NumFDs     int64   `json:"num_fds"`     // 打开的文件描述符数，无权限时为-1
+	ReadBytes  int64   `json:"read_bytes"`  // 累计读取字节数
+	WriteBytes int64   `json:"write_bytes"` // 累计写入字节数
+	TopCPU     bool    `json:"top_cpu"`     // 是否属于CPU占用前N
+	TopMemory  bool    `json:"top_memory"`  // 是否属于内存占用前N
+}
+
+// ServerMessage 服务端通过WebSocket下发给代理的消息，使用代理当前的密钥封装为信封
+type ServerMessage struct {
+	Type    string          `json:"type"`              // 消息类型，rotate_secret表示下发新的专属密钥，config表示下发期望配置，command表示诊断命令
+	Secret  string          `json:"secret,omitempty"`  // 新的专属密钥
+	Config  json.RawMessage `json:"config,omitempty"`  // 期望配置，格式与代理配置文件相同
+	Version string          `json:"version,omitempty"` // 期望配置的版本，为空表示清除服务端下发的配置
+
+	ID        string            `json:"id,omitempty"`         // 命令ID，代理在结果中原样返回
+	Command   string            `json:"command,omitempty"`    // 诊断命令名称
+	Args      map[string]string `json:"args,omitempty"`       // 命令参数
+	TimeoutMs int64             `json:"timeout_ms,omitempty"` // 服务端等待结果的时间（毫秒）
+}
+
+// CommandResult 代理返回的诊断命令结果
+type CommandResult struct {
+	Type       string          `json:"type"`             // 固定为command_result
+	AgentID    string          `json:"agent_id"`         // 代理ID
+	ID         string          `json:"id"`               // 命令ID
+	Command    string          `json:"command"`          // 命令名称
+	Status     string          `json:"status"`           // ok或error
+	Error      string          `json:"error,omitempty"`  // 失败原因
+	Result     json.RawMessage `json:"result,omitempty"` // 命令的输出
+	DurationMs int64           `json:"duration_ms"`      // 代理执行命令的耗时（毫秒）
+}
+
+// EnrollmentToken 注册令牌，令牌本身只在创建时返回一次，数据库中只保存其哈希
+type EnrollmentToken struct {
+	ID          string `json:"id"`          // 令牌ID
+	Description string `json:"description"` // 描述
+	MaxUses     int    `json:"max_uses"`    // 最多可使用次数，0表示不限制
+	Uses        int    `json:"uses"`        // 已使用次数
+	CreatedAt   int64  `json:"created_at"`  // 创建时间
+	ExpiresAt   int64  `json:"expires_at"`  // 过期时间
+	Revoked     bool   `json:"revoked"`     // 是否已吊销
+}
+
+// MetricsBatch 代理批量上报的指标信封，一帧中包含按采集顺序排列的多个样本
+type MetricsBatch struct {
+	AgentID string          `json:"agent_id"` // 代理ID
+	Batch   []SystemMetrics `json:"batch"`    // 指标样本
+}
+
+// CPUStat 单个CPU核心（或汇总）的各模式时间占比，单位为百分比
+type CPUStat struct {
+	CPU     string  `json:"cpu"`     // CPU标识，cpu-total表示所有核心汇总
+	Usage   float64 `json:"usage"`   // 总使用率
+	User    float64 `json:"user"`    // 用户态
+	System  float64 `json:"system"`  // 内核态
+	Nice    float64 `json:"nice"`    // 低优先级用户态
+	Iowait  float64 `json:"iowait"`  // 等待IO
+	Irq     float64 `json:"irq"`     // 硬中断
+	Softirq float64 `json:"softirq"` // 软中断
+	Steal   float64 `json:"steal"`   // 被宿主机抢占
+	Guest   float64 `json:"guest"`   // 运行虚拟机
+}
+
+// FilesystemInfo 单个挂载点的空间和inode使用情况
+type FilesystemInfo struct {
+	Mountpoint        string  `json:"mountpoint"`          // 挂载点
+	Device            string  `json:"device"`              // 设备
+	Fstype            string  `json:"fstype"`              // 文件系统类型
+	Total             int64   `json:"total"`               // 总空间
+	Used              int64   `json:"used"`                // 已用空间
+	Free              int64   `json:"free"`                // 可用空间
+	UsedPercent       float64 `json:"used_percent"`        // 空间使用率
+	InodesTotal       int64   `json:"inodes_total"`        // inode总数
+	InodesUsed        int64   `json:"inodes_used"`         // 已用inode
+	InodesFree        int64   `json:"inodes_free"`         // 可用inode
+	InodesUsedPercent float64 `json:"inodes_used_percent"` // inode使用率
+}
+
+// DiskIOStat 单个块设备的IO速率
+type DiskIOStat struct {
+	Device           string  `json:"device"`              // 设备名
+	ReadBytesPerSec  float64 `json:"read_bytes_per_sec"`  // 每秒读取字节数
+	WriteBytesPerSec float64 `json:"write_bytes_per_sec"` // 每秒写入字节数
+	ReadIOPS         float64 `json:"read_iops"`           // 每秒读次数
+	WriteIOPS        float64 `json:"write_iops"`          // 每秒写次数
+	ReadAwaitMs      float64 `json:"read_await_ms"`       // 读请求平均耗时（毫秒）
+	WriteAwaitMs     float64 `json:"write_await_ms"`      // 写请求平均耗时（毫秒）
+	AwaitMs          float64 `json:"await_ms"`            // 所有请求平均耗时（毫秒）
+	UtilPercent      float64 `json:"util_percent"`        // 设备繁忙时间占比
+}
+
+// NetInterfaceStat 单个网卡的流量速率、错误和丢包
+type NetInterfaceStat struct {
+	Interface         string  `json:"interface"`            // 网卡名称
+	BytesSent         int64   `json:"bytes_sent"`           // 累计发送字节数
+	BytesRecv         int64   `json:"bytes_recv"`           // 累计接收字节数
+	BytesSentPerSec   float64 `json:"bytes_sent_per_sec"`   // 每秒发送字节数
+	BytesRecvPerSec   float64 `json:"bytes_recv_per_sec"`   // 每秒接收字节数
+	PacketsSentPerSec float64 `json:"packets_sent_per_sec"` // 每秒发送包数
+	PacketsRecvPerSec float64 `json:"packets_recv_per_sec"` // 每秒接收包数
+	ErrorsIn          int64   `json:"errors_in"`            // 本周期接收错误数
+	ErrorsOut         int64   `json:"errors_out"`           // 本周期发送错误数
+	DropsIn           int64   `json:"drops_in"`             // 本周期接收丢包数
+	DropsOut          int64   `json:"drops_out"`            // 本周期发送丢包数
+}
+
+// ConnStateCount 某一协议某一状态下的连接数
+type ConnStateCount struct {
+	Protocol string `json:"protocol"` // 协议：tcp4、tcp6、udp4、udp6
+	State    string `json:"state"`    // 连接状态，如ESTABLISHED、TIME_WAIT；UDP为NONE
+	Count    int64  `json:"count"`    // 连接数
+}
+
+// ListeningPort 正在监听的端口
+type ListeningPort struct {
+	Protocol string `json:"protocol"` // 协议：tcp4、tcp6、udp4、udp6
+	Address  string `json:"address"`  // 监听地址
+	Port     int64  `json:"port"`     // 监听端口
+	PID      int64  `json:"pid"`      // 所属进程PID
+	Process  string `json:"process"`  // 所属进程名称
+}
+
+// ExpectedPort 期望代理保持监听的端口，停止监听时触发告警
+type ExpectedPort struct {
+	Protocol    string `json:"protocol"`    // 协议：tcp、udp匹配IPv4和IPv6，也可指定tcp4、tcp6等
+	Port        int64  `json:"port"`        // 端口
+	Description string `json:"description"` // 说明，如服务名称
 }
 
 // Agent 代理信息结构体，用于存储代理服务器的基本信息
@@ -75,6 +470,34 @@ type Agent struct {
 	IPAddress string    `json:"ip_address"` // IP地址
 	CreatedAt time.Time `json:"created_at"` // 创建时间
 	UpdatedAt time.Time `json:"updated_at"` // 更新时间
+
+	ClockOffsetMs int64 `json:"clock_offset_ms"` // 代理时钟相对服务端的偏移（毫秒），正数表示代理时钟偏快
+	ClockSkewed   bool  `json:"clock_skewed"`    // 时钟偏移是否超过告警阈值
+
+	ClientCertFingerprint string `json:"client_cert_fingerprint,omitempty"` // 最近一次连接使用的客户端证书SHA-256指纹
+	ClientCertExpiresAt   int64  `json:"client_cert_expires_at,omitempty"`  // 客户端证书过期时间
+
+	Labels map[string]string `json:"labels,omitempty"` // 代理配置的标签
+
+	Group                string `json:"group,omitempty"`                  // 代理所属分组，取自group标签
+	DesiredConfigVersion string `json:"desired_config_version,omitempty"` // 服务端期望的配置版本，为空表示没有下发配置
+	AppliedConfigVersion string `json:"applied_config_version,omitempty"` // 代理已应用的配置版本
+	ConfigInSync         bool   `json:"config_in_sync"`                   // 代理是否已应用期望的配置
+	ConfigError          string `json:"config_error,omitempty"`           // 代理拒绝下发配置的原因
+	ConfigAppliedAt      int64  `json:"config_applied_at,omitempty"`      // 代理应用当前配置版本的时间
+
+	Collectors []CollectorStat `json:"collectors,omitempty"` // 最近一次上报中各采集项的耗时和错误，只在代理详情中返回
+}
+
+// agentConnection 代理的WebSocket连接，读取循环和管理接口都可能向代理下发消息，写入时需要加锁
+type agentConnection struct {
+	conn *websocket.Conn
+
+	mutex         sync.Mutex
+	key           envelopeKey // 代理最近一次上报使用的信封密钥，下发消息时使用同一密钥
+	appliedConfig string      // 代理最近一次上报的已应用配置版本
+	pushedConfig  string      // 本次连接中最近一次下发的配置版本
+	configPushed  bool        // 本次连接中是否下发过配置
 }
 
 // User 用户信息结构体，用于存储用户认证和权限信息
@@ -89,7 +512,7 @@ type User struct {
 var (
 	config   Config                        // 全局配置对象
 	db       *sql.DB                       // 数据库连接
-	clients  = make(map[string]*websocket.Conn) // WebSocket客户端连接映射表，键为代理ID
+	clients  = make(map[string]*agentConnection) // WebSocket客户端连接映射表，键为代理ID
 	upgrader = websocket.Upgrader{        // WebSocket升级器
 		CheckOrigin: func(r *http.Request) bool {
 			return true // 允许任何来源的连接请求
@@ -99,6 +522,13 @@ var (
 	offlineAlerted = make(map[string]bool) // 离线告警缓存
 	highLoadStart = make(map[string]int64) // 高负载起始时间缓存
 	highLoadAlerted = make(map[string]bool) // 高负载告警缓存
+	portDownAlerted = make(map[string]bool) // 期望端口停止监听告警缓存，键为agentID/协议/端口
+	unitFailedAlerted = make(map[string]bool) // systemd单元failed告警缓存，键为agentID/单元名称
+	clockSkewAlerted = make(map[string]bool) // 时钟偏移告警缓存
+	// 按代理存储的明细指标表，删除代理和清理过期数据时一并处理
+	agentSeriesTables = []string{"cpu_metrics", "filesystem_metrics", "diskio_metrics", "netif_metrics", "conn_metrics", "process_snapshots", "memory_metrics", "pressure_metrics", "sensor_metrics", "cgroup_metrics", "custom_metrics"}
+	// 按代理存储的状态表（不按时间清理），删除代理时一并处理
+	agentStateTables = []string{"listening_ports", "expected_ports", "systemd_units", "agent_credentials", "agent_configs", "custom_metric_meta"}
 )
 
 // Claims JWT令牌的声明结构体
@@ -125,6 +555,13 @@ func main() {
 	dbPath := flag.String("db", "", "SQLite数据库路径（覆盖配置文件）")
 	encryptionKey := flag.String("key", "", "AES加密密钥（覆盖配置文件）")
 	apiKey := flag.String("apikey", "", "API认证密钥（覆盖配置文件）")
+	requireAuth := flag.Bool("require-auth", false, "只接受认证加密信封，拒绝明文和旧版AES-CFB格式的数据（覆盖配置文件）")
+	requireEnrollment := flag.Bool("require-enrollment", false, "只接受使用专属密钥的代理，拒绝使用共享密钥的数据（覆盖配置文件）")
+	tlsCert := flag.String("tls-cert", "", "TLS证书文件（覆盖配置文件）")
+	tlsKey := flag.String("tls-key", "", "TLS私钥文件（覆盖配置文件）")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "证书文件不存在时自动生成自签名证书（覆盖配置文件）")
+	tlsClientCA := flag.String("tls-client-ca", "", "校验代理客户端证书的CA证书文件（覆盖配置文件）")
+	requireClientCert := flag.Bool("require-client-cert", false, "代理连接必须提供有效的客户端证书（覆盖配置文件）")
 	flag.Parse()
 
 	// 加载配置文件
@@ -147,6 +584,32 @@ func main() {
 	if *apiKey != "" {
 		config.APIKey = *apiKey
 	}
+	if *requireAuth {
+		config.RequireAuthenticated = true
+	}
+	if *requireEnrollment {
+		config.RequireEnrollment = true
+	}
+	if *tlsCert != "" {
+		config.TLSCert = *tlsCert
+	}
+	if *tlsKey != "" {
+		config.TLSKey = *tlsKey
+	}
+	if *tlsSelfSigned {
+		config.TLSSelfSigned = true
+	}
+	if *tlsClientCA != "" {
+		config.TLSClientCA = *tlsClientCA
+	}
+	if *requireClientCert {
+		config.RequireClientCert = true
+	}
+
+	// 派生认证加密信封使用的密钥
+	if err := initEnvelopeKeys(); err != nil {
+		log.Fatalf("初始化加密密钥失败：%v", err)
+	}
 
 	// 初始化数据库
 	err = initDB()
@@ -155,6 +618,11 @@ func main() {
 	}
 	defer db.Close()
 
+	// 加载代理专属密钥
+	if err := loadAgentCredentials(); err != nil {
+		log.Fatalf("加载代理专属密钥失败：%v", err)
+	}
+
 	// 启动时自动生成hostname.json（如不存在）
 	hostnameFile := "hostname.json"
 	if _, err := os.Stat(hostnameFile); os.IsNotExist(err) {
@@ -181,6 +649,24 @@ func main() {
 		publicApi.GET("/agents", getAgents)               // 获取所有代理列表
 		publicApi.GET("/agents/:id", getAgentByID)        // 获取指定代理详情
 		publicApi.GET("/agents/:id/metrics", getAgentMetrics) // 获取指定代理的监控指标
+		publicApi.GET("/agents/:id/metrics/cpu", getAgentCPUMetrics) // 获取指定代理的CPU模式占比
+		publicApi.GET("/agents/:id/metrics/filesystems", getAgentFilesystemMetrics) // 获取指定代理各挂载点的文件系统使用情况
+		publicApi.GET("/agents/:id/metrics/diskio", getAgentDiskIOMetrics) // 获取指定代理各块设备的IO速率
+		publicApi.GET("/agents/:id/metrics/network", getAgentNetworkMetrics) // 获取指定代理各网卡的流量速率
+		publicApi.GET("/agents/:id/metrics/connections", getAgentConnectionMetrics) // 获取指定代理各协议的连接状态统计
+		publicApi.GET("/agents/:id/metrics/memory", getAgentMemoryMetrics) // 获取指定代理的内存和交换分区明细
+		publicApi.GET("/agents/:id/metrics/pressure", getAgentPressureMetrics) // 获取指定代理的压力阻塞信息
+		publicApi.GET("/agents/:id/metrics/sensors", getAgentSensorMetrics) // 获取指定代理的温度和风扇传感器读数
+		publicApi.GET("/agents/:id/metrics/cgroups", getAgentCgroupMetrics) // 获取指定代理各容器和服务的资源占用历史
+		publicApi.GET("/agents/:id/metrics/custom", getAgentCustomMetrics) // 获取指定代理的自定义指标历史
+		publicApi.GET("/agents/:id/containers", getAgentContainers) // 获取指定代理的容器及其最新资源占用
+		publicApi.GET("/agents/:id/custom-metrics", getAgentCustomSeries) // 获取指定代理的自定义指标曲线及其最新取值
+		publicApi.GET("/agents/:id/listening-ports", getAgentListeningPorts) // 获取指定代理的监听端口清单
+		publicApi.GET("/agents/:id/expected-ports", getAgentExpectedPorts) // 获取指定代理的期望监听端口
+		publicApi.GET("/agents/:id/services", getAgentServices) // 获取指定代理的systemd单元状态
+		publicApi.GET("/agents/:id/config", getAgentConfig) // 获取指定代理的期望配置和应用状态
+		publicApi.GET("/agent-groups", getGroupConfigs) // 获取设置了期望配置的代理分组
+		publicApi.GET("/agent-groups/:name/config", getGroupConfig) // 获取指定分组的期望配置和组内代理的应用状态
 	}
 
 	// 受保护的API路由（写操作）
@@ -189,6 +675,11 @@ func main() {
 	{
 		protectedApi.PUT("/agents/:id", updateAgent)      // 更新代理信息
 		protectedApi.DELETE("/agents/:id", deleteAgent)   // 删除代理
+		protectedApi.PUT("/agents/:id/expected-ports", setAgentExpectedPorts) // 设置指定代理的期望监听端口
+		protectedApi.PUT("/agents/:id/config", setAgentConfig) // 设置指定代理的期望配置
+		protectedApi.DELETE("/agents/:id/config", deleteAgentConfig) // 删除指定代理的期望配置
+		protectedApi.PUT("/agent-groups/:name/config", setGroupConfig) // 设置指定分组的期望配置
+		protectedApi.DELETE("/agent-groups/:name/config", deleteGroupConfig) // 删除指定分组的期望配置
 	}
 
 	// 安全API路由（JWT或ApiKey）
@@ -197,6 +688,7 @@ func main() {
 	{
 		secureApi.GET("/users/me", getCurrentUser)        // 获取当前用户信息
 		secureApi.PUT("/users/password", updatePassword)  // 更新密码
+		secureApi.GET("/agents/:id/processes", getAgentProcesses) // 获取指定代理某一时刻的进程快照，包含命令行和用户，需要认证
 	}
 
 	// 管理员路由
@@ -206,8 +698,24 @@ func main() {
 		adminApi.GET("/users", getUsers)                  // 获取所有用户列表
 		adminApi.POST("/users", createUser)               // 创建新用户
 		adminApi.DELETE("/users/:username", deleteUser)   // 删除用户
+
+		// 代理注册令牌和专属密钥管理
+		adminApi.GET("/enrollment-tokens", getEnrollmentTokens)               // 获取注册令牌列表
+		adminApi.POST("/enrollment-tokens", createEnrollmentToken)            // 创建注册令牌
+		adminApi.DELETE("/enrollment-tokens/:id", revokeEnrollmentToken)      // 吊销注册令牌
+		adminApi.GET("/agents/:id/credential", getAgentCredential)            // 获取代理专属密钥状态
+		adminApi.POST("/agents/:id/credential/rotate", rotateAgentCredential) // 轮换代理专属密钥
+		adminApi.DELETE("/agents/:id/credential", revokeAgentCredential)      // 吊销代理专属密钥
+
+		// 代理诊断命令及审计日志
+		adminApi.POST("/agents/:id/commands", runAgentCommand) // 在代理上执行诊断命令并等待结果
+		adminApi.GET("/commands", getCommandAudit)             // 获取诊断命令审计日志
+		adminApi.GET("/commands/:id", getCommandAuditEntry)    // 获取单条诊断命令记录及结果
 	}
 
+	// 代理使用注册令牌换取专属密钥
+	r.POST("/api/enroll", enrollAgent)
+
 	// 新增webhook API路由
 	r.GET("/api/webhook", getWebhook) // 获取webhook配置
 	r.PUT("/api/webhook", adminMiddleware(), setWebhook) // 设置webhook配置
@@ -249,12 +757,161 @@ func main() {
 	// 启动自动告警任务
 	go alertTask()
 
-	// 启动HTTP服务器
+	// 启动HTTP服务器，配置了证书时使用HTTPS
 	addr := fmt.Sprintf(":%d", config.Port)
+	tlsConfig, err := setupTLS()
+	if err != nil {
+		log.Fatalf("初始化TLS失败：%v", err)
+	}
+	if tlsConfig != nil {
+		server := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+		log.Printf("服务器启动（TLS），端口：%d", config.Port)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Printf("服务器启动，端口：%d", config.Port)
 	log.Fatal(r.Run(addr))
 }
 
+// setupTLS 根据配置加载或生成证书，未启用TLS时返回nil
+func setupTLS() (*tls.Config, error) {
+	if config.TLSCert == "" && config.TLSKey == "" && !config.TLSSelfSigned {
+		if config.RequireClientCert || config.TLSClientCA != "" {
+			return nil, fmt.Errorf("客户端证书认证需要先启用TLS")
+		}
+		return nil, nil
+	}
+
+	// 自签名证书默认保存在数据库文件所在目录
+	if config.TLSCert == "" {
+		config.TLSCert = filepath.Join(filepath.Dir(config.DBPath), "tls-cert.pem")
+	}
+	if config.TLSKey == "" {
+		config.TLSKey = filepath.Join(filepath.Dir(config.DBPath), "tls-key.pem")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if config.TLSSelfSigned && (err != nil || time.Now().After(cert.Leaf.NotAfter)) {
+		log.Printf("生成自签名证书：%s", config.TLSCert)
+		if err := generateSelfSignedCert(config.TLSCert, config.TLSKey); err != nil {
+			return nil, fmt.Errorf("生成自签名证书失败: %v", err)
+		}
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("加载证书失败: %v", err)
+	}
+	// 代理可以用这个指纹固定服务端证书
+	log.Printf("TLS certificate %s, expires %s, SPKI SHA-256: %s",
+		cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.Format("2006-01-02"), spkiFingerprint(cert.Leaf))
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// 浏览器访问前端时不会提供客户端证书，因此只在证书存在时校验，是否必须由WebSocket处理函数决定
+	if config.TLSClientCA != "" {
+		caPEM, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端CA证书失败: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("客户端CA证书文件中没有有效的证书: %s", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if config.RequireClientCert {
+		return nil, fmt.Errorf("require_client_cert需要同时配置tls_client_ca")
+	}
+	return tlsConfig, nil
+}
+
+// generateSelfSignedCert 生成ECDSA P-256自签名证书，包含本机主机名、回环地址和网卡地址
+func generateSelfSignedCert(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"linux-monitor"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// spkiFingerprint 计算证书公钥的SHA-256指纹，证书续期但密钥不变时指纹保持不变
+func spkiFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// certFingerprint 计算整个证书的SHA-256指纹
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// clientCertificate 返回连接中已通过CA校验的客户端证书，没有时返回nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateAgentID 从客户端证书得到代理ID：优先使用agent:<ID>形式的URI SAN，否则使用证书的Common Name
+func certificateAgentID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "agent" && uri.Opaque != "" {
+			return uri.Opaque
+		}
+	}
+	return cert.Subject.CommonName
+}
+
 // Initialize the SQLite database
 func initDB() error {
 	// Ensure the database directory exists
@@ -380,87 +1037,466 @@ func initDB() error {
 		);
 
 		CREATE INDEX IF NOT EXISTS idx_metrics_agent_timestamp ON metrics(agent_id, timestamp);
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create tables: %v", err)
-	}
 
-	// Check and update agents table structure if necessary
-	log.Println("检查agents表结构...")
-	columns, err = getTableColumns("agents")
-	if err != nil {
-		return fmt.Errorf("failed to check agents table columns: %v", err)
-	}
+		CREATE TABLE IF NOT EXISTS cpu_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			cpu TEXT NOT NULL,
+			usage REAL,
+			user REAL,
+			system REAL,
+			nice REAL,
+			iowait REAL,
+			irq REAL,
+			softirq REAL,
+			steal REAL,
+			guest REAL
+		);
 
-	// 检查是否存在created_at和updated_at列
-	hasCreatedAt := false
-	hasUpdatedAt := false
-	for _, column := range columns {
-		if column == "created_at" {
-			hasCreatedAt = true
-		}
-		if column == "updated_at" {
-			hasUpdatedAt = true
-		}
-	}
+		CREATE INDEX IF NOT EXISTS idx_cpu_metrics_agent_timestamp ON cpu_metrics(agent_id, timestamp);
 
-	// 添加缺少的列
-	if !hasCreatedAt {
-		_, err = db.Exec("ALTER TABLE agents ADD COLUMN created_at INTEGER DEFAULT 0")
-		if err != nil {
-			log.Printf("Warning: Could not add created_at column: %v", err)
-		} else {
-			log.Println("已添加 created_at 列到 agents 表")
-		}
-	}
+		CREATE TABLE IF NOT EXISTS filesystem_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			mountpoint TEXT NOT NULL,
+			device TEXT,
+			fstype TEXT,
+			total INTEGER,
+			used INTEGER,
+			free INTEGER,
+			used_percent REAL,
+			inodes_total INTEGER,
+			inodes_used INTEGER,
+			inodes_free INTEGER,
+			inodes_used_percent REAL
+		);
 
-	if !hasUpdatedAt {
-		_, err = db.Exec("ALTER TABLE agents ADD COLUMN updated_at INTEGER DEFAULT 0")
-		if err != nil {
-			log.Printf("Warning: Could not add updated_at column: %v", err)
-		} else {
-			log.Println("已添加 updated_at 列到 agents 表")
-		}
-	}
+		CREATE INDEX IF NOT EXISTS idx_filesystem_metrics_agent_timestamp ON filesystem_metrics(agent_id, timestamp);
 
-	// 更新创建时间为0的记录
-	_, err = db.Exec("UPDATE agents SET created_at = ? WHERE created_at IS NULL OR created_at = 0", time.Now().Unix())
-	if err != nil {
-		log.Printf("Warning: Could not update agents created_at: %v", err)
-	}
+		CREATE TABLE IF NOT EXISTS diskio_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			device TEXT NOT NULL,
+			read_bytes_per_sec REAL,
+			write_bytes_per_sec REAL,
+			read_iops REAL,
+			write_iops REAL,
+			read_await_ms REAL,
+			write_await_ms REAL,
+			await_ms REAL,
+			util_percent REAL
+		);
 
-	// Create default admin user if no users exist
-	var count int
-	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
-	if err != nil {
-		return fmt.Errorf("failed to check users: %v", err)
-	}
+		CREATE INDEX IF NOT EXISTS idx_diskio_metrics_agent_timestamp ON diskio_metrics(agent_id, timestamp);
 
-	if count == 0 {
-		// 生成密码哈希
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-		if err != nil {
-			return fmt.Errorf("无法为默认管理员用户生成密码哈希：%v", err)
-		}
-		
-		// Create default admin user with hashed password
-		_, err = db.Exec(
-			"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
-			"admin", string(hashedPassword), "admin", time.Now().Unix(),
-		)
-		if err != nil {
-			return fmt.Errorf("failed to create default admin user: %v", err)
-		}
-		log.Println("创建默认管理员用户（用户名：admin，密码：admin）")
-	}
+		CREATE TABLE IF NOT EXISTS netif_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			interface TEXT NOT NULL,
+			bytes_sent INTEGER,
+			bytes_recv INTEGER,
+			bytes_sent_per_sec REAL,
+			bytes_recv_per_sec REAL,
+			packets_sent_per_sec REAL,
+			packets_recv_per_sec REAL,
+			errors_in INTEGER,
+			errors_out INTEGER,
+			drops_in INTEGER,
+			drops_out INTEGER
+		);
 
-	// Create a background task to clean up old data
-	go cleanupTask()
+		CREATE INDEX IF NOT EXISTS idx_netif_metrics_agent_timestamp ON netif_metrics(agent_id, timestamp);
 
-	return nil
-}
+		CREATE TABLE IF NOT EXISTS conn_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			protocol TEXT NOT NULL,
+			state TEXT NOT NULL,
+			count INTEGER
+		);
 
-// 获取表的列名
+		CREATE INDEX IF NOT EXISTS idx_conn_metrics_agent_timestamp ON conn_metrics(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS process_snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			pid INTEGER NOT NULL,
+			name TEXT,
+			cmdline TEXT,
+			username TEXT,
+			cpu_percent REAL,
+			rss INTEGER,
+			num_fds INTEGER,
+			read_bytes INTEGER,
+			write_bytes INTEGER,
+			top_cpu INTEGER,
+			top_memory INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_process_snapshots_agent_timestamp ON process_snapshots(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS memory_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			total INTEGER,
+			used INTEGER,
+			available INTEGER,
+			cached INTEGER,
+			buffers INTEGER,
+			dirty INTEGER,
+			slab INTEGER,
+			swap_total INTEGER,
+			swap_used INTEGER,
+			swap_in_per_sec REAL,
+			swap_out_per_sec REAL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_memory_metrics_agent_timestamp ON memory_metrics(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS pressure_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			resource TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			avg10 REAL,
+			avg60 REAL,
+			avg300 REAL,
+			total INTEGER
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_pressure_metrics_agent_timestamp ON pressure_metrics(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS sensor_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			sensor TEXT NOT NULL,
+			type TEXT NOT NULL,
+			value REAL,
+			critical REAL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_sensor_metrics_agent_timestamp ON sensor_metrics(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS cgroup_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			path TEXT NOT NULL,
+			container_id TEXT,
+			cpu_percent REAL,
+			memory_current INTEGER,
+			memory_max INTEGER,
+			oom_kills INTEGER,
+			io_read_bytes INTEGER,
+			io_write_bytes INTEGER,
+			io_read_bytes_per_sec REAL,
+			io_write_bytes_per_sec REAL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_cgroup_metrics_agent_timestamp ON cgroup_metrics(agent_id, timestamp);
+
+		CREATE TABLE IF NOT EXISTS custom_metrics (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			labels TEXT NOT NULL,
+			value REAL,
+			unit TEXT,
+			source TEXT NOT NULL DEFAULT ''
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_custom_metrics_agent_timestamp ON custom_metrics(agent_id, timestamp);
+		CREATE INDEX IF NOT EXISTS idx_custom_metrics_agent_name ON custom_metrics(agent_id, name, timestamp);
+
+		CREATE TABLE IF NOT EXISTS custom_metric_meta (
+			agent_id TEXT NOT NULL,
+			source TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			type TEXT,
+			help TEXT,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (agent_id, source, name)
+		);
+
+		CREATE TABLE IF NOT EXISTS listening_ports (
+			agent_id TEXT NOT NULL,
+			protocol TEXT NOT NULL,
+			address TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			pid INTEGER,
+			process TEXT,
+			first_seen INTEGER NOT NULL,
+			last_seen INTEGER NOT NULL,
+			PRIMARY KEY (agent_id, protocol, address, port)
+		);
+
+		CREATE TABLE IF NOT EXISTS systemd_units (
+			agent_id TEXT NOT NULL,
+			unit TEXT NOT NULL,
+			load_state TEXT,
+			active_state TEXT,
+			sub_state TEXT,
+			restarts INTEGER,
+			state_changed_at INTEGER,
+			watched INTEGER,
+			last_seen INTEGER NOT NULL,
+			PRIMARY KEY (agent_id, unit)
+		);
+
+		CREATE TABLE IF NOT EXISTS expected_ports (
+			agent_id TEXT NOT NULL,
+			protocol TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			description TEXT,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (agent_id, protocol, port)
+		);
+
+		CREATE TABLE IF NOT EXISTS enrollment_tokens (
+			id TEXT PRIMARY KEY,
+			token_hash TEXT NOT NULL UNIQUE,
+			description TEXT,
+			max_uses INTEGER NOT NULL DEFAULT 1,
+			uses INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0
+		);
+
+		CREATE TABLE IF NOT EXISTS agent_credentials (
+			agent_id TEXT PRIMARY KEY,
+			secret TEXT,
+			previous_secret TEXT,
+			token_id TEXT,
+			enrolled_at INTEGER NOT NULL,
+			rotated_at INTEGER,
+			revoked_at INTEGER
+		);
+
+		CREATE TABLE IF NOT EXISTS agent_configs (
+			agent_id TEXT PRIMARY KEY,
+			config TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS group_configs (
+			group_name TEXT PRIMARY KEY,
+			config TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS command_audit (
+			id TEXT PRIMARY KEY,
+			agent_id TEXT NOT NULL,
+			command TEXT NOT NULL,
+			args TEXT,
+			requested_by TEXT,
+			requested_from TEXT,
+			requested_at INTEGER NOT NULL,
+			finished_at INTEGER,
+			status TEXT NOT NULL,
+			error TEXT,
+			duration_ms INTEGER,
+			result TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_command_audit_agent_requested ON command_audit(agent_id, requested_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %v", err)
+	}
+
+	// Check and update agents table structure if necessary
+	log.Println("检查agents表结构...")
+	columns, err = getTableColumns("agents")
+	if err != nil {
+		return fmt.Errorf("failed to check agents table columns: %v", err)
+	}
+
+	// 检查是否存在created_at和updated_at列
+	hasCreatedAt := false
+	hasUpdatedAt := false
+	for _, column := range columns {
+		if column == "created_at" {
+			hasCreatedAt = true
+		}
+		if column == "updated_at" {
+			hasUpdatedAt = true
+		}
+	}
+
+	// 添加缺少的列
+	if !hasCreatedAt {
+		_, err = db.Exec("ALTER TABLE agents ADD COLUMN created_at INTEGER DEFAULT 0")
+		if err != nil {
+			log.Printf("Warning: Could not add created_at column: %v", err)
+		} else {
+			log.Println("已添加 created_at 列到 agents 表")
+		}
+	}
+
+	if !hasUpdatedAt {
+		_, err = db.Exec("ALTER TABLE agents ADD COLUMN updated_at INTEGER DEFAULT 0")
+		if err != nil {
+			log.Printf("Warning: Could not add updated_at column: %v", err)
+		} else {
+			log.Println("已添加 updated_at 列到 agents 表")
+		}
+	}
+
+	// 添加防重放和时钟偏移相关的列
+	for _, column := range []string{"last_seq", "clock_offset_ms", "clock_offset_at"} {
+		exists := false
+		for _, c := range columns {
+			if c == column {
+				exists = true
+			}
+		}
+		if exists {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE agents ADD COLUMN " + column + " INTEGER DEFAULT 0")
+		if err != nil {
+			log.Printf("Warning: Could not add %s column: %v", column, err)
+		} else {
+			log.Printf("已添加 %s 列到 agents 表", column)
+		}
+	}
+
+	// 添加客户端证书、标签、配置同步、采集项状态和监听端口上报时间相关的列
+	for _, column := range []string{"cert_fingerprint TEXT", "cert_expires_at INTEGER", "labels TEXT", "config_version TEXT", "config_error TEXT", "config_applied_at INTEGER", "collector_status TEXT", "ports_reported_at INTEGER", "systemd_reported_at INTEGER"} {
+		name := strings.Fields(column)[0]
+		exists := false
+		for _, c := range columns {
+			if c == name {
+				exists = true
+			}
+		}
+		if exists {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE agents ADD COLUMN " + column)
+		if err != nil {
+			log.Printf("Warning: Could not add %s column: %v", name, err)
+		} else {
+			log.Printf("已添加 %s 列到 agents 表", name)
+		}
+	}
+
+	// 自定义指标增加来源，类型和说明按来源和名称保存，避免不同来源的同名指标相互覆盖
+	if err := migrateCustomMetricSource(); err != nil {
+		return fmt.Errorf("failed to migrate custom metric tables: %v", err)
+	}
+
+	// 更新创建时间为0的记录
+	_, err = db.Exec("UPDATE agents SET created_at = ? WHERE created_at IS NULL OR created_at = 0", time.Now().Unix())
+	if err != nil {
+		log.Printf("Warning: Could not update agents created_at: %v", err)
+	}
+
+	// Create default admin user if no users exist
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check users: %v", err)
+	}
+
+	if count == 0 {
+		// 生成密码哈希
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("无法为默认管理员用户生成密码哈希：%v", err)
+		}
+		
+		// Create default admin user with hashed password
+		_, err = db.Exec(
+			"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
+			"admin", string(hashedPassword), "admin", time.Now().Unix(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create default admin user: %v", err)
+		}
+		log.Println("创建默认管理员用户（用户名：admin，密码：admin）")
+	}
+
+	// Create a background task to clean up old data
+	go cleanupTask()
+
+	return nil
+}
+
+// migrateCustomMetricSource 为旧版本创建的custom_metrics表添加source列，并重建custom_metric_meta表使主键包含来源
+// 原有的类型和说明保留在来源为空的记录中，对应旧版本代理上报的指标
+func migrateCustomMetricSource() error {
+	columns, err := getTableColumns("custom_metrics")
+	if err != nil {
+		return err
+	}
+	hasSource := false
+	for _, column := range columns {
+		if column == "source" {
+			hasSource = true
+		}
+	}
+	if !hasSource {
+		if _, err := db.Exec("ALTER TABLE custom_metrics ADD COLUMN source TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		log.Println("已添加 source 列到 custom_metrics 表")
+	}
+
+	columns, err = getTableColumns("custom_metric_meta")
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if column == "source" {
+			return nil
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		`CREATE TABLE custom_metric_meta_temp (
+			agent_id TEXT NOT NULL,
+			source TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			type TEXT,
+			help TEXT,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (agent_id, source, name)
+		)`,
+		`INSERT INTO custom_metric_meta_temp (agent_id, source, name, type, help, updated_at)
+			SELECT agent_id, '', name, type, help, updated_at FROM custom_metric_meta`,
+		`DROP TABLE custom_metric_meta`,
+		`ALTER TABLE custom_metric_meta_temp RENAME TO custom_metric_meta`,
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Println("已重建 custom_metric_meta 表，类型和说明按来源和名称保存")
+	return nil
+}
+
+// 获取表的列名
 func getTableColumns(tableName string) ([]string, error) {
 	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", tableName))
 	if err != nil {
@@ -494,6 +1530,22 @@ func cleanupTask() {
 		if err != nil {
 			log.Printf("Error cleaning up old metrics: %v", err)
 		}
+		for _, table := range agentSeriesTables {
+			_, err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE timestamp < ?", table), time.Now().Unix()-7*24*60*60)
+			if err != nil {
+				log.Printf("Error cleaning up old %s: %v", table, err)
+			}
+		}
+
+		// Process snapshots are large, keep them for a shorter configurable period
+		retentionHours := config.ProcessRetentionHours
+		if retentionHours <= 0 {
+			retentionHours = defaultProcessRetentionHours
+		}
+		_, err = db.Exec("DELETE FROM process_snapshots WHERE timestamp < ?", time.Now().Unix()-int64(retentionHours)*60*60)
+		if err != nil {
+			log.Printf("Error cleaning up old process snapshots: %v", err)
+		}
 
 		// Just remove old metrics, don't change agent status
 		// Agents will be considered offline if last_seen is older than 30 seconds
@@ -503,73 +1555,418 @@ func cleanupTask() {
 	}
 }
 
-// decrypt decrypts data using AES
-func decrypt(data []byte, key string) ([]byte, error) {
-	if len(data) < aes.BlockSize {
-		return nil, fmt.Errorf("ciphertext too short: received only %d bytes, need at least %d bytes", len(data), aes.BlockSize)
+// deriveEnvelopeKey 使用HKDF-SHA256从共享密钥派生AES-256密钥和用于标识密钥的ID
+func deriveEnvelopeKey(secret string) ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), []byte("linux-monitor"), []byte("envelope key v2")), key); err != nil {
+		return nil, nil, err
 	}
-
-	// 打印解密信息
-	log.Printf("Trying to decrypt message of length: %d bytes", len(data))
-	
-	// Convert key to 32 bytes for AES-256
-	keyBytes := []byte(key)
-	if len(keyBytes) > 32 {
-		keyBytes = keyBytes[:32]
-	} else if len(keyBytes) < 32 {
-		// Pad key if too short
-		newKey := make([]byte, 32)
-		copy(newKey, keyBytes)
-		keyBytes = newKey
+	keyID := make([]byte, envelopeKeyIDSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), []byte("linux-monitor"), []byte("envelope key id v2")), keyID); err != nil {
+		return nil, nil, err
 	}
-	
-	log.Printf("Using encryption key (first 6 chars): %s...", key[:min(6, len(key))])
+	return key, keyID, nil
+}
 
-	block, err := aes.NewCipher(keyBytes)
+// newEnvelopeKey 从密钥派生信封加解密器
+func newEnvelopeKey(secret string) (envelopeKey, error) {
+	key, keyID, err := deriveEnvelopeKey(secret)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %v", err)
+		return envelopeKey{}, err
 	}
-
-	// Get IV from first block
-	iv := data[:aes.BlockSize]
-	ciphertext := data[aes.BlockSize:]
-
-	// Decrypt
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
-	
-	// Log the first few bytes of decrypted data
-	if len(ciphertext) > 20 {
-		log.Printf("Decrypted data starts with: %s", string(ciphertext[:20]))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return envelopeKey{}, err
 	}
-
-	return ciphertext, nil
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return envelopeKey{}, err
+	}
+	return envelopeKey{id: keyID, aead: aead}, nil
 }
 
-// min returns the smaller of a or b
-func min(a, b int) int {
-	if a < b {
-		return a
+// initEnvelopeKeys 为当前共享密钥和轮换期间保留的共享密钥创建解密器
+func initEnvelopeKeys() error {
+	secrets := append([]string{config.EncryptionKey}, config.EncryptionKeys...)
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		key, err := newEnvelopeKey(secret)
+		if err != nil {
+			return err
+		}
+		envelopeKeys[string(key.id)] = key
+		log.Printf("Loaded encryption key with ID %x", key.id)
 	}
-	return b
+	return nil
 }
 
-// handleWebSocket handles WebSocket connections from agents
-func handleWebSocket(c *gin.Context) {
-	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+// loadAgentCredentials 从数据库加载所有代理的专属密钥
+func loadAgentCredentials() error {
+	rows, err := db.Query("SELECT agent_id, COALESCE(secret, ''), COALESCE(previous_secret, ''), COALESCE(revoked_at, 0) FROM agent_credentials")
 	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
-		return
+		return err
 	}
-	defer conn.Close()
-	
-	// 增加缓冲区大小
-	conn.SetReadLimit(65536)
-	
-	// Set initial values
-	var agentID string
-	remoteAddr := c.Request.RemoteAddr
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var agentID, secret, previous string
+		var revokedAt int64
+		if err := rows.Scan(&agentID, &secret, &previous, &revokedAt); err != nil {
+			return err
+		}
+		if err := registerAgentCredential(agentID, secret, previous, revokedAt > 0); err != nil {
+			return err
+		}
+		count++
+	}
+	log.Printf("Loaded credentials for %d agents", count)
+	return rows.Err()
+}
+
+// registerAgentCredential 用数据库中的最新状态替换代理在内存中的专属密钥
+func registerAgentCredential(agentID, secret, previous string, revoked bool) error {
+	var keys []envelopeKey
+	if !revoked {
+		for _, s := range []string{secret, previous} {
+			if s == "" {
+				continue
+			}
+			key, err := newEnvelopeKey(s)
+			if err != nil {
+				return err
+			}
+			key.agentID = agentID
+			key.previous = s == previous
+			keys = append(keys, key)
+		}
+	}
+
+	envelopeKeysMutex.Lock()
+	defer envelopeKeysMutex.Unlock()
+	for id, key := range envelopeKeys {
+		if key.agentID == agentID {
+			delete(envelopeKeys, id)
+		}
+	}
+	for _, key := range keys {
+		envelopeKeys[string(key.id)] = key
+	}
+	agentCredentials[agentID] = true
+	pendingRotations[agentID] = !revoked && previous != ""
+	return nil
+}
+
+// forgetAgentCredential 删除代理在内存中的专属密钥，删除代理时使用
+func forgetAgentCredential(agentID string) {
+	envelopeKeysMutex.Lock()
+	defer envelopeKeysMutex.Unlock()
+	for id, key := range envelopeKeys {
+		if key.agentID == agentID {
+			delete(envelopeKeys, id)
+		}
+	}
+	delete(agentCredentials, agentID)
+	delete(pendingRotations, agentID)
+}
+
+// checkAgentCredential 校验帧中样本的代理身份：专属密钥只能用于其所属代理，已登记专属密钥的代理不再接受共享密钥
+func checkAgentCredential(samples []SystemMetrics, key envelopeKey) error {
+	envelopeKeysMutex.RLock()
+	defer envelopeKeysMutex.RUnlock()
+	for _, metrics := range samples {
+		if key.agentID != "" {
+			if metrics.AgentID != key.agentID {
+				return fmt.Errorf("key of agent %s used for agent %s", key.agentID, metrics.AgentID)
+			}
+			continue
+		}
+		if agentCredentials[metrics.AgentID] {
+			return fmt.Errorf("agent %s is enrolled, shared key not accepted", metrics.AgentID)
+		}
+		if config.RequireEnrollment {
+			return fmt.Errorf("agent %s is not enrolled", metrics.AgentID)
+		}
+	}
+	return nil
+}
+
+// handleSecretRotation 代理仍在使用旧密钥时下发新密钥，代理开始使用新密钥后删除旧密钥
+func handleSecretRotation(client *agentConnection, key envelopeKey) {
+	if key.agentID == "" {
+		return
+	}
+
+	if key.previous {
+		var secret string
+		if err := db.QueryRow("SELECT COALESCE(secret, '') FROM agent_credentials WHERE agent_id = ?", key.agentID).Scan(&secret); err != nil || secret == "" {
+			return
+		}
+		if err := client.send(ServerMessage{Type: "rotate_secret", Secret: secret}); err != nil {
+			log.Printf("Failed to send rotated secret to agent %s: %v", key.agentID, err)
+			return
+		}
+		log.Printf("Sent rotated secret to agent %s", key.agentID)
+		return
+	}
+
+	envelopeKeysMutex.RLock()
+	pending := pendingRotations[key.agentID]
+	envelopeKeysMutex.RUnlock()
+	if !pending {
+		return
+	}
+	if _, err := db.Exec("UPDATE agent_credentials SET previous_secret = NULL WHERE agent_id = ?", key.agentID); err != nil {
+		log.Printf("Failed to complete secret rotation for agent %s: %v", key.agentID, err)
+		return
+	}
+	var secret string
+	if err := db.QueryRow("SELECT COALESCE(secret, '') FROM agent_credentials WHERE agent_id = ?", key.agentID).Scan(&secret); err == nil {
+		registerAgentCredential(key.agentID, secret, "", false)
+	}
+	log.Printf("Agent %s switched to rotated secret", key.agentID)
+}
+
+// send 使用代理最近一次上报所用的密钥封装消息并下发
+func (c *agentConnection) send(message ServerMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.key.aead == nil {
+		return fmt.Errorf("agent does not use authenticated envelopes")
+	}
+	envelope, err := sealEnvelope(data, c.key)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, envelope)
+}
+
+// sealEnvelope 使用指定密钥加密下发给代理的数据
+func sealEnvelope(data []byte, key envelopeKey) ([]byte, error) {
+	header := make([]byte, 0, len(envelopeMagic)+1+envelopeKeyIDSize+key.aead.NonceSize())
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion)
+	header = append(header, key.id...)
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := append(header, nonce...)
+	return key.aead.Seal(envelope, nonce, data, header), nil
+}
+
+// isEnvelope 判断数据是否以认证加密信封的魔数开头
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+// openEnvelope 校验并解密认证加密信封，同时返回所使用的密钥
+func openEnvelope(data []byte) ([]byte, envelopeKey, error) {
+	headerSize := len(envelopeMagic) + 1 + envelopeKeyIDSize
+	if len(data) < headerSize {
+		return nil, envelopeKey{}, fmt.Errorf("envelope too short: %d bytes", len(data))
+	}
+	if version := data[len(envelopeMagic)]; version != envelopeVersion {
+		return nil, envelopeKey{}, fmt.Errorf("unsupported envelope version: %d", version)
+	}
+	keyID := data[len(envelopeMagic)+1 : headerSize]
+	envelopeKeysMutex.RLock()
+	key, ok := envelopeKeys[string(keyID)]
+	envelopeKeysMutex.RUnlock()
+	if !ok {
+		return nil, envelopeKey{}, fmt.Errorf("unknown key ID: %x", keyID)
+	}
+	aead := key.aead
+	if len(data) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, envelopeKey{}, fmt.Errorf("envelope too short: %d bytes", len(data))
+	}
+
+	header := data[:headerSize]
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return nil, envelopeKey{}, fmt.Errorf("envelope authentication failed: %v", err)
+	}
+	// 每个信封使用随机nonce，重复出现说明是被截获后重放的帧
+	if !rememberNonce(nonce) {
+		return nil, envelopeKey{}, fmt.Errorf("replayed envelope nonce: %x", nonce)
+	}
+	return plaintext, key, nil
+}
+
+// rememberNonce 记录信封nonce，窗口期内重复出现时返回false
+func rememberNonce(nonce []byte) bool {
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+
+	now := time.Now().Unix()
+	if now-lastNoncePrune >= 60 {
+		for key, seen := range seenNonces {
+			if now-seen > nonceWindowSeconds {
+				delete(seenNonces, key)
+			}
+		}
+		lastNoncePrune = now
+	}
+
+	key := string(nonce)
+	if _, ok := seenNonces[key]; ok {
+		return false
+	}
+	seenNonces[key] = now
+	return true
+}
+
+// acceptSequence 检查样本序列号是否大于该代理已接受的最大序列号，通过时先预留该序列号，使并发重放的同一帧被拒绝
+// 认证加密的帧必须带序列号；旧版代理的明文和AES-CFB帧不带序列号时直接接受，它们本身无法防止伪造
+// 返回预留前的序列号，样本存储失败时用releaseSequence恢复
+func acceptSequence(agentID string, seq uint64, authenticated bool) (uint64, bool) {
+	if seq == 0 {
+		return 0, !authenticated
+	}
+
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+
+	last, ok := agentSequences[agentID]
+	if !ok {
+		// 服务端重启后从数据库恢复，避免重启前的帧被重放
+		var stored int64
+		if err := db.QueryRow("SELECT COALESCE(last_seq, 0) FROM agents WHERE id = ?", agentID).Scan(&stored); err == nil {
+			last = uint64(stored)
+		}
+	}
+	if seq <= last {
+		agentSequences[agentID] = last
+		return last, false
+	}
+	agentSequences[agentID] = seq
+	return last, true
+}
+
+// releaseSequence 样本存储失败时撤销acceptSequence的预留，之后已接受了更大序列号时保持不变
+func releaseSequence(agentID string, seq, previous uint64) {
+	if seq == 0 {
+		return
+	}
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+	if agentSequences[agentID] == seq {
+		agentSequences[agentID] = previous
+	}
+}
+
+// clockSkewThresholdMs 返回时钟偏移告警阈值（毫秒）
+func clockSkewThresholdMs() int64 {
+	threshold := config.ClockSkewThresholdSeconds
+	if threshold <= 0 {
+		threshold = defaultClockSkewThresholdSeconds
+	}
+	return int64(threshold) * 1000
+}
+
+// abs64 返回int64的绝对值
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// decrypt decrypts data using AES
+func decrypt(data []byte, key string) ([]byte, error) {
+	if len(data) < aes.BlockSize {
+		return nil, fmt.Errorf("ciphertext too short: received only %d bytes, need at least %d bytes", len(data), aes.BlockSize)
+	}
+
+	// 打印解密信息
+	log.Printf("Trying to decrypt message of length: %d bytes", len(data))
+	
+	// Convert key to 32 bytes for AES-256
+	keyBytes := []byte(key)
+	if len(keyBytes) > 32 {
+		keyBytes = keyBytes[:32]
+	} else if len(keyBytes) < 32 {
+		// Pad key if too short
+		newKey := make([]byte, 32)
+		copy(newKey, keyBytes)
+		keyBytes = newKey
+	}
+	
+	log.Printf("Using encryption key (first 6 chars): %s...", key[:min(6, len(key))])
+
+	block, err := aes.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	// Get IV from first block
+	iv := data[:aes.BlockSize]
+	ciphertext := data[aes.BlockSize:]
+
+	// Decrypt
+	stream := cipher.NewCFBDecrypter(block, iv)
+	stream.XORKeyStream(ciphertext, ciphertext)
+	
+	// Log the first few bytes of decrypted data
+	if len(ciphertext) > 20 {
+		log.Printf("Decrypted data starts with: %s", string(ciphertext[:20]))
+	}
+
+	return ciphertext, nil
+}
+
+// min returns the smaller of a or b
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// handleWebSocket handles WebSocket connections from agents
+func handleWebSocket(c *gin.Context) {
+	// 校验客户端证书，证书中的代理ID在处理消息时与上报的代理ID比对
+	clientCert := clientCertificate(c.Request)
+	if clientCert == nil && config.RequireClientCert {
+		log.Printf("Rejected connection without client certificate from %s", c.Request.RemoteAddr)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "需要客户端证书"})
+		return
+	}
+	if clientCert != nil {
+		log.Printf("Client certificate for agent %s from %s", certificateAgentID(clientCert), c.Request.RemoteAddr)
+	}
+
+	// Upgrade HTTP connection to WebSocket
+	// 协商压缩算法，并告知代理服务端支持批量上报
+	responseHeader := http.Header{}
+	responseHeader.Set(featuresHeader, "batch")
+	if compression := negotiateCompression(c.GetHeader(compressionHeader)); compression != "" {
+		responseHeader.Set(compressionHeader, compression)
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	
+	// 增加缓冲区大小，批量上报时单帧会包含多个样本
+	conn.SetReadLimit(maxAgentMessageSize)
+	
+	// Set initial values
+	var agentID string
+	remoteAddr := c.Request.RemoteAddr
+	client := &agentConnection{conn: conn}
 	
 	// 设置处理Ping消息
 	conn.SetPingHandler(func(message string) error {
@@ -634,10 +2031,10 @@ func handleWebSocket(c *gin.Context) {
 		// Process the message based on its type
 		switch messageType {
 		case websocket.TextMessage:
-			handleAgentMessage(conn, message, &agentID, remoteAddr)
+			handleAgentMessage(client, message, &agentID, remoteAddr, clientCert)
 		case websocket.BinaryMessage:
 			log.Printf("Received binary message from %s", remoteAddr)
-			handleAgentMessage(conn, message, &agentID, remoteAddr)
+			handleAgentMessage(client, message, &agentID, remoteAddr, clientCert)
 		default:
 			log.Printf("Received message of type %d from %s", messageType, remoteAddr)
 		}
@@ -648,14 +2045,20 @@ func handleWebSocket(c *gin.Context) {
 	
 	// 如果有agent ID，从客户端映射中移除
 	if agentID != "" {
-		delete(clients, agentID)
+		clientsMutex.Lock()
+		if clients[agentID] == client {
+			delete(clients, agentID)
+		}
+		clientsMutex.Unlock()
 		// 记录agent断开连接的时间
 		log.Printf("Agent %s disconnected", agentID)
 	}
 }
 
 // handleAgentMessage processes messages received from agents
-func handleAgentMessage(conn *websocket.Conn, message []byte, agentID *string, remoteAddr string) {
+func handleAgentMessage(client *agentConnection, message []byte, agentID *string, remoteAddr string, clientCert *x509.Certificate) {
+	receivedAt := time.Now().UnixMilli()
+
 	// 记录接收到的消息
 	if *agentID != "" {
 		log.Printf("Received data from agent %s, message length: %d bytes", *agentID, len(message))
@@ -663,25 +2066,45 @@ func handleAgentMessage(conn *websocket.Conn, message []byte, agentID *string, r
 		log.Printf("Received data from %s, message length: %d bytes", remoteAddr, len(message))
 	}
 	
-	// 如果agentID已经存在（说明这是来自已知agent的消息），直接更新last_seen
-	if *agentID != "" {
-		// 获取当前时间戳
-		now := time.Now().Unix()
-		// 只更新last_seen时间
-		_, err := db.Exec("UPDATE agents SET last_seen = ? WHERE id = ?", now, *agentID)
-		if err != nil {
-			log.Printf("Failed to update agent last_seen: %v", err)
-		} else {
-			log.Printf("Updated last_seen for agent %s to %d", *agentID, now)
-		}
-	}
-	
 	// 如果是二进制消息，需要先解密
 	if len(message) > 0 {
-		var metrics SystemMetrics
-		
-		// 尝试解析JSON
-		err := json.Unmarshal(message, &metrics)
+		var samples []SystemMetrics
+		var err error
+		var frameKey envelopeKey
+		authenticated := false
+
+		// 优先按认证加密信封解析
+		if isEnvelope(message) {
+			plaintext, key, openErr := openEnvelope(message)
+			if openErr == nil {
+				frameKey = key
+				if bytes.HasPrefix(plaintext, commandResultPrefix) {
+					handleCommandResult(client, plaintext, key)
+					return
+				}
+				samples, err = decodeAgentPayload(plaintext)
+				if err != nil {
+					log.Printf("Failed to parse metrics JSON from envelope: %v", err)
+					return
+				}
+				log.Printf("Successfully opened authenticated envelope, length: %d bytes", len(plaintext))
+				authenticated = true
+			} else if config.RequireAuthenticated {
+				log.Printf("Rejected message from %s: %v", remoteAddr, openErr)
+				return
+			} else {
+				log.Printf("Failed to open envelope: %v, trying legacy format", openErr)
+			}
+		}
+		if !authenticated && config.RequireAuthenticated {
+			log.Printf("Rejected unauthenticated message from %s", remoteAddr)
+			return
+		}
+
+		// 兼容旧版代理：明文JSON或AES-CFB加密（可能经过压缩，也可能是批量上报的多个样本）
+		if !authenticated {
+			samples, err = decodeAgentPayload(message)
+		}
 		if err != nil {
 			log.Printf("Raw data is not valid JSON: %v, attempting to decrypt", err)
 			// 如果解析JSON失败，可能是加密数据，尝试解密
@@ -694,7 +2117,7 @@ func handleAgentMessage(conn *websocket.Conn, message []byte, agentID *string, r
 			log.Printf("Successfully decrypted message, length: %d bytes", len(decrypted))
 			
 			// 再次尝试解析解密后的JSON
-			err = json.Unmarshal(decrypted, &metrics)
+			samples, err = decodeAgentPayload(decrypted)
 			if err != nil {
 				log.Printf("Failed to parse metrics JSON after decryption: %v", err)
 				// 打印解密后的数据前20字节用于调试
@@ -704,66 +2127,260 @@ func handleAgentMessage(conn *websocket.Conn, message []byte, agentID *string, r
 				return
 			}
 			log.Printf("Successfully parsed metrics JSON from decrypted data")
-		} else {
+		} else if !authenticated {
 			log.Printf("Successfully parsed metrics JSON directly from message")
 		}
+		if len(samples) > 1 {
+			log.Printf("Received batch of %d metrics samples", len(samples))
+		}
+		// 批量中的样本按采集顺序排列，最后一个是最新的
+		latest := samples[len(samples)-1]
+
+		// 校验代理身份，并在轮换密钥期间下发或确认新密钥
+		if err := checkAgentCredential(samples, frameKey); err != nil {
+			log.Printf("Rejected message from %s: %v", remoteAddr, err)
+			return
+		}
+		if clientCert != nil {
+			certAgentID := certificateAgentID(clientCert)
+			for _, metrics := range samples {
+				if metrics.AgentID != certAgentID {
+					log.Printf("Rejected message from %s: certificate of agent %s used for agent %s", remoteAddr, certAgentID, metrics.AgentID)
+					return
+				}
+			}
+		}
+		if authenticated {
+			client.mutex.Lock()
+			client.key = frameKey
+			client.mutex.Unlock()
+		}
+		handleSecretRotation(client, frameKey)
+
+		// 根据发送时间计算代理时钟偏移，超过阈值时校正样本时间戳
+		var clockOffsetMs int64
+		clockSkewed := false
+		if latest.SentAt > 0 {
+			clockOffsetMs = latest.SentAt - receivedAt
+			if abs64(clockOffsetMs) > clockSkewThresholdMs() {
+				clockSkewed = true
+				log.Printf("Clock skew detected for agent %s: offset %d ms, correcting sample timestamps", latest.AgentID, clockOffsetMs)
+			}
+		}
 		
-		// 打印收到的metrics数据摘要
-		log.Printf("Received metrics - CPU: %.2f%%, Mem: %.2f%%, Disk: %.2f%%", 
-			metrics.CPUUsage,
-			getMemoryPercent(metrics.MemoryInfo),
-			getDiskPercent(metrics.DiskInfo))
+		// 如果agentID已经存在（说明这是来自已知agent的消息），直接更新last_seen
+		// 补发的历史数据不代表代理当前在线，不更新last_seen
+		if *agentID != "" && !latest.Backfill {
+			// 获取当前时间戳
+			now := time.Now().Unix()
+			// 只更新last_seen时间
+			_, err := db.Exec("UPDATE agents SET last_seen = ? WHERE id = ?", now, *agentID)
+			if err != nil {
+				log.Printf("Failed to update agent last_seen: %v", err)
+			} else {
+				log.Printf("Updated last_seen for agent %s to %d", *agentID, now)
+			}
+		}
 		
-		// 设置或更新agentID
-		if metrics.AgentID != "" {
-			*agentID = metrics.AgentID
+		stored := 0
+		var lastSeq uint64
+		for i, metrics := range samples {
+			// 拒绝序列号不大于已接受序列号的重放或过期样本，以及不带序列号的认证加密帧
+			if metrics.AgentID == "" {
+				log.Printf("Received metrics without agent ID from %s", remoteAddr)
+				continue
+			}
+			previousSeq, ok := acceptSequence(metrics.AgentID, metrics.Sequence, authenticated)
+			if !ok {
+				log.Printf("Rejected replayed or stale metrics from agent %s, seq: %d", metrics.AgentID, metrics.Sequence)
+				continue
+			}
+			if clockSkewed && metrics.Timestamp > 0 {
+				metrics.Timestamp -= clockOffsetMs / 1000
+			}
+
+			if metrics.Backfill {
+				log.Printf("Received backfilled metrics from agent %s, original timestamp: %d", metrics.AgentID, metrics.Timestamp)
+			}
 			
-			// 保存连接到客户端映射
-			clients[*agentID] = conn
+			// 打印收到的metrics数据摘要
+			log.Printf("Received metrics - CPU: %.2f%%, Mem: %.2f%%, Disk: %.2f%%", 
+				metrics.CPUUsage,
+				getMemoryPercent(metrics.MemoryInfo),
+				getDiskPercent(metrics.DiskInfo))
 			
-			log.Printf("Agent identified: %s", *agentID)
+			// 设置或更新agentID
+			if *agentID != metrics.AgentID {
+				*agentID = metrics.AgentID
+				
+				// 保存连接到客户端映射
+				clientsMutex.Lock()
+				clients[*agentID] = client
+				clientsMutex.Unlock()
+				
+				log.Printf("Agent identified: %s", *agentID)
+			}
 			
-			// 更新agent在数据库中的信息
-			updateAgentInfo(*agentID, metrics, remoteAddr)
+			// 更新agent在数据库中的信息，批量上报时只用最新的样本更新一次
+			if i == len(samples)-1 {
+				updateAgentInfo(*agentID, metrics, remoteAddr)
+			}
 			
-			// 存储指标到数据库
+			// 存储指标到数据库，存储成功后才确认序列号，失败时撤销预留
 			err = storeMetrics(metrics)
 			if err != nil {
 				log.Printf("Failed to store metrics: %v", err)
+				releaseSequence(metrics.AgentID, metrics.Sequence, previousSeq)
+				continue
+			}
+			stored++
+			if metrics.Sequence > lastSeq {
+				lastSeq = metrics.Sequence
+			}
+		}
+		
+		// 记录已接受的序列号和时钟偏移
+		if *agentID != "" && (lastSeq > 0 || latest.SentAt > 0) {
+			_, err := db.Exec("UPDATE agents SET last_seq = MAX(COALESCE(last_seq, 0), ?), clock_offset_ms = ?, clock_offset_at = ? WHERE id = ?",
+				int64(lastSeq), clockOffsetMs, receivedAt/1000, *agentID)
+			if err != nil {
+				log.Printf("Failed to update agent sequence and clock offset: %v", err)
+			}
+		}
+
+		// 记录代理使用的客户端证书
+		if *agentID != "" && clientCert != nil {
+			_, err := db.Exec("UPDATE agents SET cert_fingerprint = ?, cert_expires_at = ? WHERE id = ?",
+				certFingerprint(clientCert), clientCert.NotAfter.Unix(), *agentID)
+			if err != nil {
+				log.Printf("Failed to update agent certificate: %v", err)
+			}
+		}
+
+		// 记录代理已应用的配置版本和各采集项的状态，尚未应用期望配置时下发
+		if *agentID != "" && !latest.Backfill {
+			collectorStatus := ""
+			if len(latest.Collectors) > 0 {
+				data, _ := json.Marshal(latest.Collectors)
+				collectorStatus = string(data)
+			}
+			_, err := db.Exec(`UPDATE agents SET config_applied_at = CASE WHEN COALESCE(config_version, '') = ? THEN config_applied_at ELSE ? END,
+				config_version = ?, config_error = ?, collector_status = ? WHERE id = ?`,
+				latest.ConfigVersion, receivedAt/1000, latest.ConfigVersion, latest.ConfigError, collectorStatus, *agentID)
+			if err != nil {
+				log.Printf("Failed to update agent config version: %v", err)
+			}
+			client.mutex.Lock()
+			client.appliedConfig = latest.ConfigVersion
+			client.mutex.Unlock()
+			pushAgentConfig(client, *agentID, latest.Labels[configGroupLabel])
+		}
+
+		if stored > 0 {
+			log.Printf("Successfully stored %d metrics for agent %s", stored, *agentID)
+			// 检查数据库中是否实际存储了数据
+			var count int
+			err := db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ?", *agentID).Scan(&count)
+			if err != nil {
+				log.Printf("Failed to check metrics count: %v", err)
 			} else {
-				log.Printf("Successfully stored metrics for agent %s", *agentID)
-				// 检查数据库中是否实际存储了数据
-				var count int
-				err := db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ?", *agentID).Scan(&count)
-				if err != nil {
-					log.Printf("Failed to check metrics count: %v", err)
-				} else {
-					log.Printf("Total metrics count for agent %s in database: %d", *agentID, count)
-				}
+				log.Printf("Total metrics count for agent %s in database: %d", *agentID, count)
 			}
-		} else {
-			log.Printf("Received metrics without agent ID from %s", remoteAddr)
 		}
 	} else {
 		log.Printf("Received empty message from %s", remoteAddr)
 	}
 }
 
-// 辅助函数，从内存信息map中获取percent值
-func getMemoryPercent(memoryInfo map[string]interface{}) float64 {
-	if memoryInfo == nil {
-		return 0
-	}
-	
-	if percent, ok := memoryInfo["percent"].(float64); ok {
-		return percent
+// decodeAgentPayload 解压并解析代理上报的数据，既支持单个指标对象，也支持批量信封
+func decodeAgentPayload(data []byte) ([]SystemMetrics, error) {
+	data, err := decompressPayload(data)
+	if err != nil {
+		return nil, err
 	}
-	return 0
-}
 
-// 辅助函数，从磁盘信息map中获取percent值
-func getDiskPercent(diskInfo map[string]interface{}) float64 {
-	if diskInfo == nil {
+	var batch MetricsBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return nil, err
+	}
+	if batch.Batch != nil {
+		if len(batch.Batch) == 0 {
+			return nil, fmt.Errorf("empty metrics batch")
+		}
+		for i := range batch.Batch {
+			if batch.Batch[i].AgentID == "" {
+				batch.Batch[i].AgentID = batch.AgentID
+			}
+		}
+		return batch.Batch, nil
+	}
+
+	var metrics SystemMetrics
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, err
+	}
+	return []SystemMetrics{metrics}, nil
+}
+
+// decompressPayload 根据数据头部的魔数识别gzip或zstd压缩，未压缩的数据原样返回
+func decompressPayload(data []byte) ([]byte, error) {
+	var reader io.Reader
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case bytes.HasPrefix(data, zstdMagic):
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return data, nil
+	}
+
+	// 限制解压后的大小，防止压缩炸弹
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %v", err)
+	}
+	if len(decompressed) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxDecompressedSize)
+	}
+	return decompressed, nil
+}
+
+// negotiateCompression 从代理请求的压缩算法中选出服务端支持的第一个
+func negotiateCompression(requested string) string {
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "gzip" || name == "zstd" {
+			return name
+		}
+	}
+	return ""
+}
+
+// 辅助函数，从内存信息map中获取percent值
+func getMemoryPercent(memoryInfo map[string]interface{}) float64 {
+	if memoryInfo == nil {
+		return 0
+	}
+	
+	if percent, ok := memoryInfo["percent"].(float64); ok {
+		return percent
+	}
+	return 0
+}
+
+// 辅助函数，从磁盘信息map中获取percent值
+func getDiskPercent(diskInfo map[string]interface{}) float64 {
+	if diskInfo == nil {
 		return 0
 	}
 	
@@ -777,6 +2394,11 @@ func getDiskPercent(diskInfo map[string]interface{}) float64 {
 func updateAgentInfo(agentID string, metrics SystemMetrics, remoteAddr string) {
 	// 获取当前时间戳
 	now := time.Now().Unix()
+	// 补发的历史数据以其原始时间作为最后在线时间
+	lastSeen := now
+	if metrics.Backfill && metrics.Timestamp > 0 {
+		lastSeen = metrics.Timestamp
+	}
 
 	// 1. 读取hostname.json
 	hostnameOverride := ""
@@ -851,16 +2473,16 @@ func updateAgentInfo(agentID string, metrics SystemMetrics, remoteAddr string) {
 		
 		if hasCreatedAt && hasUpdatedAt {
 			insertQuery = "INSERT INTO agents (id, name, last_seen, hostname, platform, ip_address, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-			insertArgs = []interface{}{agentID, hostname, now, hostname, platform, ipAddress, now, now}
+			insertArgs = []interface{}{agentID, hostname, lastSeen, hostname, platform, ipAddress, now, now}
 		} else if hasCreatedAt {
 			insertQuery = "INSERT INTO agents (id, name, last_seen, hostname, platform, ip_address, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			insertArgs = []interface{}{agentID, hostname, now, hostname, platform, ipAddress, now}
+			insertArgs = []interface{}{agentID, hostname, lastSeen, hostname, platform, ipAddress, now}
 		} else if hasUpdatedAt {
 			insertQuery = "INSERT INTO agents (id, name, last_seen, hostname, platform, ip_address, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			insertArgs = []interface{}{agentID, hostname, now, hostname, platform, ipAddress, now}
+			insertArgs = []interface{}{agentID, hostname, lastSeen, hostname, platform, ipAddress, now}
 		} else {
 			insertQuery = "INSERT INTO agents (id, name, last_seen, hostname, platform, ip_address) VALUES (?, ?, ?, ?, ?, ?)"
-			insertArgs = []interface{}{agentID, hostname, now, hostname, platform, ipAddress}
+			insertArgs = []interface{}{agentID, hostname, lastSeen, hostname, platform, ipAddress}
 		}
 		
 		_, err = db.Exec(insertQuery, insertArgs...)
@@ -869,6 +2491,9 @@ func updateAgentInfo(agentID string, metrics SystemMetrics, remoteAddr string) {
 		} else {
 			log.Printf("New agent registered: %s (hostname: %s, platform: %s)", agentID, hostname, platform)
 		}
+	} else if metrics.Backfill {
+		// 补发的历史数据不覆盖代理的当前信息和最后在线时间
+		return
 	} else {
 		// Agent存在，更新记录
 		var updateQuery string
@@ -889,6 +2514,17 @@ func updateAgentInfo(agentID string, metrics SystemMetrics, remoteAddr string) {
 			log.Printf("Updated agent info: %s", agentID)
 		}
 	}
+
+	// 保存代理配置的标签，代理删除全部标签时清空
+	labels := ""
+	if len(metrics.Labels) > 0 {
+		if data, err := json.Marshal(metrics.Labels); err == nil {
+			labels = string(data)
+		}
+	}
+	if _, err := db.Exec("UPDATE agents SET labels = ? WHERE id = ?", labels, agentID); err != nil {
+		log.Printf("Failed to update labels of agent %s: %v", agentID, err)
+	}
 }
 
 // 存储代理上报的指标数据
@@ -905,6 +2541,16 @@ func storeMetrics(metrics SystemMetrics) error {
 	}
 	
 	log.Printf("存储代理 %s 的指标数据，时间戳: %d", metrics.AgentID, timestamp)
+
+	// 补发的数据可能因发送结果未确认而重复上报，已存在同一时间戳的记录时跳过
+	if metrics.Backfill {
+		var exists int
+		err := db.QueryRow("SELECT 1 FROM metrics WHERE agent_id = ? AND timestamp = ? LIMIT 1", metrics.AgentID, timestamp).Scan(&exists)
+		if err == nil {
+			log.Printf("代理 %s 时间戳 %d 的补发数据已存在，跳过", metrics.AgentID, timestamp)
+			return nil
+		}
+	}
 	
 	// 提取CPU使用率
 	cpuUsage := metrics.CPUUsage
@@ -1044,6 +2690,72 @@ func storeMetrics(metrics SystemMetrics) error {
 	}
 	
 	log.Printf("成功存储代理 %s 的指标数据", metrics.AgentID)
+
+	// 存储CPU模式占比
+	if err := storeCPUStats(metrics.AgentID, timestamp, metrics.CPUStats); err != nil {
+		log.Printf("存储CPU模式数据失败: %v", err)
+	}
+
+	// 存储各挂载点的文件系统数据
+	if err := storeFilesystems(metrics.AgentID, timestamp, metrics.Filesystems); err != nil {
+		log.Printf("存储文件系统数据失败: %v", err)
+	}
+
+	// 存储各块设备的IO速率
+	if err := storeDiskIO(metrics.AgentID, timestamp, metrics.DiskIO); err != nil {
+		log.Printf("存储磁盘IO数据失败: %v", err)
+	}
+
+	// 存储各网卡的流量速率
+	if err := storeNetInterfaces(metrics.AgentID, timestamp, metrics.NetInterfaces); err != nil {
+		log.Printf("存储网卡数据失败: %v", err)
+	}
+
+	// 存储连接状态统计和监听端口
+	if err := storeConnStates(metrics.AgentID, timestamp, metrics.ConnStates); err != nil {
+		log.Printf("存储连接状态数据失败: %v", err)
+	}
+	// 监听端口和systemd单元保存的是当前状态，补发的历史数据不应覆盖
+	if !metrics.Backfill {
+		if err := storeListeningPorts(metrics.AgentID, timestamp, metrics.ListeningPorts); err != nil {
+			log.Printf("存储监听端口数据失败: %v", err)
+		}
+	}
+
+	// 存储进程快照
+	if err := storeProcesses(metrics.AgentID, timestamp, metrics.TopProcesses); err != nil {
+		log.Printf("存储进程快照失败: %v", err)
+	}
+
+	// 存储内存明细和压力阻塞信息
+	if err := storeMemoryStat(metrics.AgentID, timestamp, metrics.Memory); err != nil {
+		log.Printf("存储内存明细失败: %v", err)
+	}
+	if err := storePressure(metrics.AgentID, timestamp, metrics.Pressure); err != nil {
+		log.Printf("存储压力阻塞数据失败: %v", err)
+	}
+
+	// 存储温度和风扇传感器读数
+	if err := storeSensors(metrics.AgentID, timestamp, metrics.Sensors); err != nil {
+		log.Printf("存储传感器数据失败: %v", err)
+	}
+
+	// 存储容器和systemd服务的资源占用
+	if err := storeCgroups(metrics.AgentID, timestamp, metrics.Cgroups); err != nil {
+		log.Printf("存储cgroup数据失败: %v", err)
+	}
+
+	// 存储外部程序等来源的自定义指标
+	if err := storeCustomMetrics(metrics.AgentID, timestamp, metrics.CustomMetrics); err != nil {
+		log.Printf("存储自定义指标失败: %v", err)
+	}
+
+	// 更新systemd单元状态
+	if !metrics.Backfill {
+		if err := storeSystemdUnits(metrics.AgentID, timestamp, metrics.SystemdUnits); err != nil {
+			log.Printf("存储systemd单元状态失败: %v", err)
+		}
+	}
 	
 	// 清理旧数据（保留30天内的数据）
 	thirtyDaysAgo := time.Now().AddDate(0, 0, -30).Unix()
@@ -1057,960 +2769,3753 @@ func storeMetrics(metrics SystemMetrics) error {
 	return nil
 }
 
-// 创建JWT令牌
-func createToken(username, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Username: username,
-		Role:     role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+// storeCPUStats 存储汇总及每个核心的CPU模式占比
+func storeCPUStats(agentID string, timestamp int64, stats []CPUStat) error {
+	if len(stats) == 0 {
+		return nil
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(config.JWTSecret))
+	tx, err := db.Begin()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return signedToken, nil
-}
-
-// API中间件：验证API密钥
-func apiKeyMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// 首先检查Authorization头部（Bearer令牌）
-		authHeader := c.GetHeader("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(config.JWTSecret), nil
-			})
+	stmt, err := tx.Prepare(`
+		INSERT INTO cpu_metrics (
+			agent_id, timestamp, cpu,
+			usage, user, system, nice, iowait, irq, softirq, steal, guest
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
 
-			if err == nil && token.Valid {
-				if claims, ok := token.Claims.(*Claims); ok {
-					c.Set("username", claims.Username)
-					c.Set("role", claims.Role)
-					c.Next()
-					return
-				}
-			}
+	for _, s := range stats {
+		_, err = stmt.Exec(
+			agentID, timestamp, s.CPU,
+			s.Usage, s.User, s.System, s.Nice, s.Iowait, s.Irq, s.Softirq, s.Steal, s.Guest,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
+	}
 
-		// 然后检查X-API-Key头部
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == config.APIKey {
-			// API密钥有效
-			c.Set("role", "admin") // API密钥授予管理员权限
-			c.Next()
-			return
-		}
+	return tx.Commit()
+}
 
-		// 如果没有有效的令牌或API密钥，检查是否有例外路由
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
-		c.Abort()
+// storeFilesystems 存储各挂载点的空间和inode使用情况
+func storeFilesystems(agentID string, timestamp int64, filesystems []FilesystemInfo) error {
+	if len(filesystems) == 0 {
+		return nil
 	}
-}
 
-// 身份验证中间件：验证JWT令牌
-func authMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// 首先尝试解析JWT令牌
-		authHeader := c.GetHeader("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(config.JWTSecret), nil
-			})
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
 
-			if err == nil && token.Valid {
-				if claims, ok := token.Claims.(*Claims); ok {
-					c.Set("username", claims.Username)
-					c.Set("role", claims.Role)
-					c.Next()
-					return
-				}
-			}
-		}
+	stmt, err := tx.Prepare(`
+		INSERT INTO filesystem_metrics (
+			agent_id, timestamp, mountpoint, device, fstype,
+			total, used, free, used_percent,
+			inodes_total, inodes_used, inodes_free, inodes_used_percent
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
 
-		// 然后检查API密钥
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == config.APIKey {
-			c.Set("role", "admin")
-			c.Next()
-			return
+	for _, fs := range filesystems {
+		_, err = stmt.Exec(
+			agentID, timestamp, fs.Mountpoint, fs.Device, fs.Fstype,
+			fs.Total, fs.Used, fs.Free, fs.UsedPercent,
+			fs.InodesTotal, fs.InodesUsed, fs.InodesFree, fs.InodesUsedPercent,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
-
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
-		c.Abort()
 	}
+
+	return tx.Commit()
 }
 
-// 管理员权限中间件
-func adminMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// 验证身份
-		role, exists := c.Get("role")
-		if !exists {
-			// 先验证JWT
-			authHeader := c.GetHeader("Authorization")
-			log.Printf("管理员API请求，Authorization: %s", authHeader)
-			
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-				token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-					return []byte(config.JWTSecret), nil
-				})
+// storeDiskIO 存储各块设备的IO速率
+func storeDiskIO(agentID string, timestamp int64, stats []DiskIOStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
 
-				if err != nil {
-					log.Printf("JWT解析错误: %v", err)
-				} else if token.Valid {
-					if claims, ok := token.Claims.(*Claims); ok {
-						role = claims.Role
-						c.Set("role", role)
-						log.Printf("验证成功，用户: %s, 角色: %s", claims.Username, claims.Role)
-						exists = true
-					}
-				}
-			}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
 
-			// 如果JWT验证失败，检查API密钥
-			if !exists {
-				apiKey := c.GetHeader("X-API-Key")
-				if apiKey == config.APIKey {
-					role = "admin"
-					c.Set("role", role)
-					log.Printf("API密钥验证成功")
-					exists = true
-				}
-			}
-		}
+	stmt, err := tx.Prepare(`
+		INSERT INTO diskio_metrics (
+			agent_id, timestamp, device,
+			read_bytes_per_sec, write_bytes_per_sec, read_iops, write_iops,
+			read_await_ms, write_await_ms, await_ms, util_percent
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
 
-		// 检查是否有管理员权限
-		if exists && role == "admin" {
-			log.Printf("管理员权限验证通过: %v", role)
-			c.Next()
-			return
+	for _, s := range stats {
+		_, err = stmt.Exec(
+			agentID, timestamp, s.Device,
+			s.ReadBytesPerSec, s.WriteBytesPerSec, s.ReadIOPS, s.WriteIOPS,
+			s.ReadAwaitMs, s.WriteAwaitMs, s.AwaitMs, s.UtilPercent,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
-
-		log.Printf("管理员权限验证失败，角色: %v, 存在: %v", role, exists)
-		c.JSON(http.StatusForbidden, gin.H{"error": "需要管理员权限"})
-		c.Abort()
 	}
+
+	return tx.Commit()
 }
 
-// 登录处理函数
-func login(c *gin.Context) {
-	var credentials struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
+// storeNetInterfaces 存储各网卡的流量速率、错误和丢包
+func storeNetInterfaces(agentID string, timestamp int64, stats []NetInterfaceStat) error {
+	if len(stats) == 0 {
+		return nil
 	}
 
-	if err := c.ShouldBindJSON(&credentials); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
-		return
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
 
-	// 查询用户
-	var user User
-	err := db.QueryRow("SELECT username, password, role FROM users WHERE username = ?", credentials.Username).Scan(&user.Username, &user.Password, &user.Role)
+	stmt, err := tx.Prepare(`
+		INSERT INTO netif_metrics (
+			agent_id, timestamp, interface,
+			bytes_sent, bytes_recv, bytes_sent_per_sec, bytes_recv_per_sec,
+			packets_sent_per_sec, packets_recv_per_sec,
+			errors_in, errors_out, drops_in, drops_out
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range stats {
+		_, err = stmt.Exec(
+			agentID, timestamp, s.Interface,
+			s.BytesSent, s.BytesRecv, s.BytesSentPerSec, s.BytesRecvPerSec,
+			s.PacketsSentPerSec, s.PacketsRecvPerSec,
+			s.ErrorsIn, s.ErrorsOut, s.DropsIn, s.DropsOut,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeConnStates 存储按协议和状态统计的连接数
+func storeConnStates(agentID string, timestamp int64, states []ConnStateCount) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO conn_metrics (agent_id, timestamp, protocol, state, count)
+		VALUES (?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range states {
+		if _, err = stmt.Exec(agentID, timestamp, s.Protocol, s.State, s.Count); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeListeningPorts 更新代理的监听端口清单，本次上报中出现的端口将last_seen更新为上报时间，并记录监听端口的上报时间
+// ports为nil表示本次上报没有采集监听端口（采集失败、被关闭或超时），清单保持不变；空列表表示没有端口在监听
+func storeListeningPorts(agentID string, timestamp int64, ports []ListeningPort) error {
+	if ports == nil {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO listening_ports (agent_id, protocol, address, port, pid, process, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(agent_id, protocol, address, port) DO UPDATE SET
+			pid = excluded.pid,
+			process = excluded.process,
+			last_seen = excluded.last_seen
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range ports {
+		if _, err = stmt.Exec(agentID, p.Protocol, p.Address, p.Port, p.PID, p.Process, timestamp, timestamp); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("UPDATE agents SET ports_reported_at = MAX(COALESCE(ports_reported_at, 0), ?) WHERE id = ?", timestamp, agentID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// storeProcesses 存储CPU和内存占用最高的进程快照
+func storeProcesses(agentID string, timestamp int64, processes []ProcessInfo) error {
+	if len(processes) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO process_snapshots (
+			agent_id, timestamp, pid, name, cmdline, username,
+			cpu_percent, rss, num_fds, read_bytes, write_bytes, top_cpu, top_memory
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range processes {
+		_, err = stmt.Exec(
+			agentID, timestamp, p.PID, p.Name, p.Cmdline, p.Username,
+			p.CPUPercent, p.RSS, p.NumFDs, p.ReadBytes, p.WriteBytes, p.TopCPU, p.TopMemory,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeMemoryStat 存储内存和交换分区明细
+func storeMemoryStat(agentID string, timestamp int64, m *MemoryStat) error {
+	if m == nil {
+		return nil
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO memory_metrics (
+			agent_id, timestamp, total, used, available, cached, buffers, dirty, slab,
+			swap_total, swap_used, swap_in_per_sec, swap_out_per_sec
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		agentID, timestamp, m.Total, m.Used, m.Available, m.Cached, m.Buffers, m.Dirty, m.Slab,
+		m.SwapTotal, m.SwapUsed, m.SwapInPerSec, m.SwapOutPerSec,
+	)
+	return err
+}
+
+// storePressure 存储CPU、内存和IO的压力阻塞信息
+func storePressure(agentID string, timestamp int64, stats []PressureStat) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO pressure_metrics (agent_id, timestamp, resource, kind, avg10, avg60, avg300, total)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range stats {
+		if _, err = stmt.Exec(agentID, timestamp, s.Resource, s.Kind, s.Avg10, s.Avg60, s.Avg300, s.Total); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeSensors 存储温度和风扇传感器读数
+func storeSensors(agentID string, timestamp int64, sensors []SensorStat) error {
+	if len(sensors) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO sensor_metrics (agent_id, timestamp, sensor, type, value, critical)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range sensors {
+		if _, err = stmt.Exec(agentID, timestamp, s.Sensor, s.Type, s.Value, s.Critical); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeCustomMetrics 存储自定义指标，标签按键排序后序列化为JSON，相同的标签得到相同的字符串
+// 每次上报最多存储maxCustomMetrics个，名称为空或过长的指标忽略；类型和说明按来源和指标名称单独保存最新的一份
+func storeCustomMetrics(agentID string, timestamp int64, metrics []CustomMetric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if len(metrics) > maxCustomMetrics {
+		log.Printf("代理 %s 上报了%d个自定义指标，只存储前%d个", agentID, len(metrics), maxCustomMetrics)
+		metrics = metrics[:maxCustomMetrics]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO custom_metrics (agent_id, timestamp, name, labels, value, unit, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	metaStmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO custom_metric_meta (agent_id, source, name, type, help, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer metaStmt.Close()
+
+	described := make(map[customMetricID]bool)
+	for _, m := range metrics {
+		if m.Name == "" || len(m.Name) > maxCustomMetricName {
+			continue
+		}
+		if _, err = stmt.Exec(agentID, timestamp, m.Name, customMetricLabels(m.Labels), m.Value, m.Unit, m.Source); err != nil {
+			tx.Rollback()
+			return err
+		}
+		id := customMetricID{m.Source, m.Name}
+		if (m.Type != "" || m.Help != "") && !described[id] {
+			described[id] = true
+			if _, err = metaStmt.Exec(agentID, m.Source, m.Name, m.Type, m.Help, timestamp); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// customMetricLabels 把标签序列化为存储使用的JSON字符串，没有标签时为{}
+func customMetricLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// storeCgroups 存储各容器、systemd服务和slice的资源占用
+func storeCgroups(agentID string, timestamp int64, cgroups []CgroupStat) error {
+	if len(cgroups) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO cgroup_metrics (
+			agent_id, timestamp, name, kind, path, container_id,
+			cpu_percent, memory_current, memory_max, oom_kills,
+			io_read_bytes, io_write_bytes, io_read_bytes_per_sec, io_write_bytes_per_sec
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range cgroups {
+		_, err = stmt.Exec(
+			agentID, timestamp, s.Name, s.Kind, s.Path, s.ContainerID,
+			s.CPUPercent, s.MemoryCurrent, s.MemoryMax, s.OOMKills,
+			s.IOReadBytes, s.IOWriteBytes, s.IOReadBytesPerSec, s.IOWriteBytesPerSec,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// storeSystemdUnits 更新代理的systemd单元状态，本次上报中出现的单元将last_seen更新为上报时间
+func storeSystemdUnits(agentID string, timestamp int64, units []UnitStat) error {
+	if len(units) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO systemd_units (
+			agent_id, unit, load_state, active_state, sub_state,
+			restarts, state_changed_at, watched, last_seen
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, u := range units {
+		_, err = stmt.Exec(
+			agentID, u.Unit, u.LoadState, u.ActiveState, u.SubState,
+			u.Restarts, u.StateChangedAt, u.Watched, timestamp,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("UPDATE agents SET systemd_reported_at = MAX(COALESCE(systemd_reported_at, 0), ?) WHERE id = ?", timestamp, agentID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 创建JWT令牌
+func createToken(username, role string) (string, error) {
+	expirationTime := time.Now().Add(24 * time.Hour)
+	claims := &Claims{
+		Username: username,
+		Role:     role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signedToken, err := token.SignedString([]byte(config.JWTSecret))
+	if err != nil {
+		return "", err
+	}
+
+	return signedToken, nil
+}
+
+// API中间件：验证API密钥
+func apiKeyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 首先检查Authorization头部（Bearer令牌）
+		authHeader := c.GetHeader("Authorization")
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+				return []byte(config.JWTSecret), nil
+			})
+
+			if err == nil && token.Valid {
+				if claims, ok := token.Claims.(*Claims); ok {
+					c.Set("username", claims.Username)
+					c.Set("role", claims.Role)
+					c.Next()
+					return
+				}
+			}
+		}
+
+		// 然后检查X-API-Key头部
+		apiKey := c.GetHeader("X-API-Key")
+		if apiKey == config.APIKey {
+			// API密钥有效
+			c.Set("role", "admin") // API密钥授予管理员权限
+			c.Next()
+			return
+		}
+
+		// 如果没有有效的令牌或API密钥，检查是否有例外路由
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+		c.Abort()
+	}
+}
+
+// 身份验证中间件：验证JWT令牌
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 首先尝试解析JWT令牌
+		authHeader := c.GetHeader("Authorization")
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+				return []byte(config.JWTSecret), nil
+			})
+
+			if err == nil && token.Valid {
+				if claims, ok := token.Claims.(*Claims); ok {
+					c.Set("username", claims.Username)
+					c.Set("role", claims.Role)
+					c.Next()
+					return
+				}
+			}
+		}
+
+		// 然后检查API密钥
+		apiKey := c.GetHeader("X-API-Key")
+		if apiKey == config.APIKey {
+			c.Set("role", "admin")
+			c.Next()
+			return
+		}
+
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+		c.Abort()
+	}
+}
+
+// 管理员权限中间件
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 验证身份
+		role, exists := c.Get("role")
+		if !exists {
+			// 先验证JWT
+			authHeader := c.GetHeader("Authorization")
+			log.Printf("管理员API请求，Authorization: %s", authHeader)
+			
+			if strings.HasPrefix(authHeader, "Bearer ") {
+				tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+				token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+					return []byte(config.JWTSecret), nil
+				})
+
+				if err != nil {
+					log.Printf("JWT解析错误: %v", err)
+				} else if token.Valid {
+					if claims, ok := token.Claims.(*Claims); ok {
+						role = claims.Role
+						c.Set("role", role)
+						c.Set("username", claims.Username)
+						log.Printf("验证成功，用户: %s, 角色: %s", claims.Username, claims.Role)
+						exists = true
+					}
+				}
+			}
+
+			// 如果JWT验证失败，检查API密钥
+			if !exists {
+				apiKey := c.GetHeader("X-API-Key")
+				if apiKey == config.APIKey {
+					role = "admin"
+					c.Set("role", role)
+					log.Printf("API密钥验证成功")
+					exists = true
+				}
+			}
+		}
+
+		// 检查是否有管理员权限
+		if exists && role == "admin" {
+			log.Printf("管理员权限验证通过: %v", role)
+			c.Next()
+			return
+		}
+
+		log.Printf("管理员权限验证失败，角色: %v, 存在: %v", role, exists)
+		c.JSON(http.StatusForbidden, gin.H{"error": "需要管理员权限"})
+		c.Abort()
+	}
+}
+
+// 登录处理函数
+func login(c *gin.Context) {
+	var credentials struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+		return
+	}
+
+	// 查询用户
+	var user User
+	err := db.QueryRow("SELECT username, password, role FROM users WHERE username = ?", credentials.Username).Scan(&user.Username, &user.Password, &user.Role)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的用户名或密码"})
+		} else {
+			log.Printf("数据库查询错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		}
+		return
+	}
+
+	// 验证密码
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
+	if err == nil { // 密码正确
+		// 创建JWT令牌
+		token, err := createToken(user.Username, user.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建令牌"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"token": token,
+			"user": gin.H{
+				"username": user.Username,
+				"role":     user.Role,
+			},
+		})
+	} else {
+		log.Printf("密码验证失败: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的用户名或密码"})
+	}
+}
+
+// 注册处理函数
+func register(c *gin.Context) {
+	var credentials struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&credentials); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+		return
+	}
+
+	// 检查用户名是否已存在
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", credentials.Username).Scan(&exists)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("数据库查询错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	if err == nil { // 用户已存在
+		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		return
+	}
+
+	// 哈希密码
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("密码哈希错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	// 插入新用户
+	_, err = db.Exec(
+		"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
+		credentials.Username, string(hashedPassword), "user", time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("创建用户错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建用户"})
+		return
+	}
+
+	// 创建JWT令牌
+	token, err := createToken(credentials.Username, "user")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建令牌"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+		"user": gin.H{
+			"username": credentials.Username,
+			"role":     "user",
+		},
+	})
+}
+
+// 获取当前用户信息
+func getCurrentUser(c *gin.Context) {
+	username, exists := c.Get("username")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+		return
+	}
+
+	var user User
+	err := db.QueryRow("SELECT username, role, created_at FROM users WHERE username = ?", username).Scan(&user.Username, &user.Role, &user.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取用户信息"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":  user.Username,
+		"role":      user.Role,
+		"createdAt": user.CreatedAt,
+	})
+}
+
+// 更新密码
+func updatePassword(c *gin.Context) {
+	username, exists := c.Get("username")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+		return
+	}
+
+	var passwordData struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&passwordData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+		return
+	}
+
+	// 验证当前密码
+	var storedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&storedPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(passwordData.CurrentPassword))
+	if err != nil { // 密码不正确
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "当前密码不正确"})
+		return
+	}
+
+	// 哈希新密码
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordData.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("密码哈希错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	// 更新密码
+	_, err = db.Exec("UPDATE users SET password = ? WHERE username = ?", string(hashedPassword), username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新密码失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "密码已更新"})
+}
+
+// 获取所有用户（仅管理员）
+func getUsers(c *gin.Context) {
+	log.Printf("请求获取用户列表")
+	
+	rows, err := db.Query("SELECT username, role, created_at FROM users ORDER BY created_at DESC")
+	if err != nil {
+		log.Printf("获取用户列表查询错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取用户列表"})
+		return
+	}
+	defer rows.Close()
+
+	var users []gin.H
+	for rows.Next() {
+		var username, role string
+		var createdAt int64
+		
+		if err := rows.Scan(&username, &role, &createdAt); err != nil {
+			log.Printf("扫描用户数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理用户数据错误"})
+			return
+		}
+		
+		users = append(users, gin.H{
+			"username":  username,
+			"role":      role,
+			"createdAt": createdAt,
+		})
+	}
+	
+	if err := rows.Err(); err != nil {
+		log.Printf("遍历用户数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "处理用户数据错误"})
+		return
+	}
+
+	log.Printf("成功获取用户列表，共 %d 个用户", len(users))
+	c.JSON(http.StatusOK, users)
+}
+
+// 创建用户（仅管理员）
+func createUser(c *gin.Context) {
+	var userData struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		Role     string `json:"role" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&userData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+		return
+	}
+
+	// 检查角色有效性
+	if userData.Role != "admin" && userData.Role != "user" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "角色必须是 'admin' 或 'user'"})
+		return
+	}
+
+	// 检查用户名是否已存在
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", userData.Username).Scan(&exists)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	if err == nil { // 用户已存在
+		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		return
+	}
+
+	// 哈希密码
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("密码哈希错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	// 开始事务
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("创建事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	// 创建用户 - 移除last_login字段
+	_, err = tx.Exec(
+		"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
+		userData.Username, string(hashedPassword), userData.Role, time.Now().Unix(),
+	)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("创建用户失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建用户失败"})
+		return
+	}
+
+	// 提交事务
+	if err := tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	log.Printf("成功创建用户: %s, 角色: %s", userData.Username, userData.Role)
+	c.JSON(http.StatusCreated, gin.H{
+		"username":  userData.Username,
+		"role":      userData.Role,
+		"createdAt": time.Now().Unix(),
+	})
+}
+
+// 删除用户（仅管理员）
+func deleteUser(c *gin.Context) {
+	username := c.Param("username")
+
+	// 检查用户是否存在
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", username).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		} else {
+			log.Printf("检查用户存在性错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		}
+		return
+	}
+
+	// 防止删除管理员账户
+	if username == "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能删除系统管理员账户"})
+		return
+	}
+
+	// 开始事务
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("创建事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	// 删除用户
+	result, err := tx.Exec("DELETE FROM users WHERE username = ?", username)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("删除用户错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除用户失败"})
+		return
+	}
+
+	// 检查是否实际删除了用户
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		log.Printf("获取受影响行数错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	if rowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在或已被删除"})
+		return
+	}
+
+	// 提交事务
+	if err := tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+
+	log.Printf("成功删除用户: %s", username)
+	c.JSON(http.StatusOK, gin.H{"message": "用户已删除"})
+}
+
+// 获取所有代理
+func getAgents(c *gin.Context) {
+	log.Printf("API call: %s %s", c.Request.Method, c.Request.URL.Path)
+	
+	// 执行查询获取所有代理
+	query := "SELECT id, name, hostname, platform, ip_address, last_seen, COALESCE(created_at, 0) as created_at, COALESCE(updated_at, 0) as updated_at, COALESCE(clock_offset_ms, 0) as clock_offset_ms, COALESCE(cert_fingerprint, ''), COALESCE(cert_expires_at, 0), COALESCE(labels, ''), COALESCE(config_version, ''), COALESCE(config_error, ''), COALESCE(config_applied_at, 0) FROM agents ORDER BY created_at DESC"
+	
+	log.Printf("执行查询: %s", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		log.Printf("数据库查询错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取代理列表失败", "detail": "数据库查询出现错误", "message": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var agents []Agent
+	for rows.Next() {
+		var agent Agent
+		var lastSeenUnix sql.NullInt64
+		var createdAtUnix, updatedAtUnix sql.NullInt64
+		var labels string
+		
+		err := rows.Scan(
+			&agent.ID, 
+			&agent.Name, 
+			&agent.Hostname, 
+			&agent.Platform, 
+			&agent.IPAddress, 
+			&lastSeenUnix, 
+			&createdAtUnix, 
+			&updatedAtUnix,
+			&agent.ClockOffsetMs,
+			&agent.ClientCertFingerprint,
+			&agent.ClientCertExpiresAt,
+			&labels,
+			&agent.AppliedConfigVersion,
+			&agent.ConfigError,
+			&agent.ConfigAppliedAt)
+		
+		if err != nil {
+			log.Printf("数据行扫描错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "解析代理数据失败", "detail": "处理数据库结果时出错", "message": err.Error()})
+			return
+		}
+		
+		// 处理可能为空的时间字段
+		if lastSeenUnix.Valid {
+			agent.LastSeen = time.Unix(lastSeenUnix.Int64, 0)
+			// 检查是否在线 - 如果最后一次通信在10秒内则视为在线
+			agent.IsOnline = time.Since(agent.LastSeen) < 10*time.Second
+		} else {
+			agent.LastSeen = time.Time{}
+			agent.IsOnline = false
+		}
+		
+		if createdAtUnix.Valid {
+			agent.CreatedAt = time.Unix(createdAtUnix.Int64, 0)
+		}
+		
+		if updatedAtUnix.Valid {
+			agent.UpdatedAt = time.Unix(updatedAtUnix.Int64, 0)
+		}
+		
+		agent.ClockSkewed = abs64(agent.ClockOffsetMs) > clockSkewThresholdMs()
+		if labels != "" {
+			json.Unmarshal([]byte(labels), &agent.Labels)
+		}
+		fillAgentConfigState(&agent)
+
+		// 设置默认值
+		if agent.Name == "" {
+			agent.Name = agent.Hostname
+		}
+		if agent.Platform == "" {
+			agent.Platform = "Unknown"
+		}
+		
+		agents = append(agents, agent)
+	}
+	
+	if err = rows.Err(); err != nil {
+		log.Printf("数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取代理列表失败", "detail": "遍历结果集时发生错误", "message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, agents)
+}
+
+// 根据ID获取代理
+func getAgentByID(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	// 查询代理详情
+	query := "SELECT id, name, hostname, platform, ip_address, last_seen, COALESCE(created_at, 0) as created_at, COALESCE(updated_at, 0) as updated_at, COALESCE(clock_offset_ms, 0) as clock_offset_ms, COALESCE(cert_fingerprint, ''), COALESCE(cert_expires_at, 0), COALESCE(labels, ''), COALESCE(config_version, ''), COALESCE(config_error, ''), COALESCE(config_applied_at, 0), COALESCE(collector_status, '') FROM agents WHERE id = ?"
+	
+	log.Printf("执行查询: %s", query)
+	
+	var agent Agent
+	var lastSeenUnix sql.NullInt64
+	var createdAtUnix, updatedAtUnix sql.NullInt64
+	var labels, collectorStatus string
+	
+	err := db.QueryRow(query, agentID).Scan(
+		&agent.ID, 
+		&agent.Name, 
+		&agent.Hostname, 
+		&agent.Platform, 
+		&agent.IPAddress, 
+		&lastSeenUnix, 
+		&createdAtUnix, 
+		&updatedAtUnix,
+		&agent.ClockOffsetMs,
+		&agent.ClientCertFingerprint,
+		&agent.ClientCertExpiresAt,
+		&labels,
+		&agent.AppliedConfigVersion,
+		&agent.ConfigError,
+		&agent.ConfigAppliedAt,
+		&collectorStatus)
+		
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("代理不存在: %s", agentID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
+		} else {
+			log.Printf("获取代理错误: %s, %v", agentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		}
+		return
+	}
+	
+	// 设置LastSeen和在线状态
+	if lastSeenUnix.Valid {
+		agent.LastSeen = time.Unix(lastSeenUnix.Int64, 0)
+		// 将在线状态判断从5分钟改为10秒以减少误导
+		agent.IsOnline = time.Since(agent.LastSeen) < 10*time.Second
+	} else {
+		agent.LastSeen = time.Time{}
+		agent.IsOnline = false
+	}
+	
+	if createdAtUnix.Valid {
+		agent.CreatedAt = time.Unix(createdAtUnix.Int64, 0)
+	}
+	
+	if updatedAtUnix.Valid {
+		agent.UpdatedAt = time.Unix(updatedAtUnix.Int64, 0)
+	}
+	
+	agent.ClockSkewed = abs64(agent.ClockOffsetMs) > clockSkewThresholdMs()
+	if labels != "" {
+		json.Unmarshal([]byte(labels), &agent.Labels)
+	}
+	if collectorStatus != "" {
+		json.Unmarshal([]byte(collectorStatus), &agent.Collectors)
+	}
+	fillAgentConfigState(&agent)
+
+	if agent.Name == "" {
+		agent.Name = agent.Hostname
+	}
+	if agent.Platform == "" {
+		agent.Platform = "Unknown"
+	}
+
+	c.JSON(http.StatusOK, agent)
+}
+
+// 更新代理
+func updateAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	var updateData struct {
+		Name     string `json:"name"`
+		Hostname string `json:"hostname"`
+	}
+
+	if err := c.ShouldBindJSON(&updateData); err != nil {
+		log.Printf("无效的请求数据: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return
+	}
+
+	// 检查代理是否存在
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("要更新的代理不存在: %s", agentID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
+		} else {
+			log.Printf("检查代理存在性错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		}
+		return
+	}
+
+	// 更新代理名称和主机名
+	now := time.Now().Unix()
+	result, err := db.Exec("UPDATE agents SET name = ?, hostname = ?, updated_at = ? WHERE id = ?", updateData.Name, updateData.Hostname, now, agentID)
+	if err != nil {
+		log.Printf("更新代理失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新代理失败", "detail": err.Error()})
+		return
+	}
+
+	// 同步写入hostname.json
+	hostnameFile := "hostname.json"
+	hostnameMap := map[string]string{}
+	if data, err := ioutil.ReadFile(hostnameFile); err == nil {
+		_ = json.Unmarshal(data, &hostnameMap)
+	}
+	if updateData.Hostname != "" {
+		hostnameMap[agentID] = updateData.Hostname
+		if data, err := json.MarshalIndent(hostnameMap, "", "  "); err == nil {
+			_ = ioutil.WriteFile(hostnameFile, data, 0644)
+		}
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	log.Printf("已更新代理 %s, 影响行数: %d", agentID, rowsAffected)
+
+	c.JSON(http.StatusOK, gin.H{"message": "代理已更新", "agent_id": agentID})
+}
+
+// 删除代理
+func deleteAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	// 检查代理是否存在
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("要删除的代理不存在: %s", agentID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
+		} else {
+			log.Printf("检查代理存在性错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		}
+		return
+	}
+
+	// 开始事务
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		return
+	}
+
+	// 删除相关的指标
+	result, err := tx.Exec("DELETE FROM metrics WHERE agent_id = ?", agentID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("删除代理指标失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理指标失败", "detail": err.Error()})
+		return
+	}
+	
+	metricsRowsDeleted, _ := result.RowsAffected()
+	log.Printf("已删除代理 %s 的 %d 条指标记录", agentID, metricsRowsDeleted)
+
+	// 删除代理的各类明细指标
+	for _, table := range agentSeriesTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE agent_id = ?", table), agentID); err != nil {
+			tx.Rollback()
+			log.Printf("删除代理%s数据失败: %v", table, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理指标失败", "detail": err.Error()})
+			return
+		}
+	}
+
+	for _, table := range agentStateTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE agent_id = ?", table), agentID); err != nil {
+			tx.Rollback()
+			log.Printf("删除代理%s数据失败: %v", table, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理指标失败", "detail": err.Error()})
+			return
+		}
+	}
+
+	// 删除代理
+	result, err = tx.Exec("DELETE FROM agents WHERE id = ?", agentID)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("删除代理失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理失败", "detail": err.Error()})
+		return
+	}
+	
+	agentRowsDeleted, _ := result.RowsAffected()
+	if agentRowsDeleted == 0 {
+		tx.Rollback()
+		log.Printf("代理 %s 可能已被删除", agentID)
+		c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "代理可能已被删除"})
+		return
+	}
+
+	// 提交事务
+	if err := tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		return
+	}
+	
+	log.Printf("已成功删除代理 %s 及其所有指标数据", agentID)
+
+	// 清除内存中的序列号和专属密钥，代理重新注册时从头开始
+	replayMutex.Lock()
+	delete(agentSequences, agentID)
+	replayMutex.Unlock()
+	forgetAgentCredential(agentID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "代理已删除",
+		"agent_id": agentID,
+		"metrics_deleted": metricsRowsDeleted,
+	})
+}
+
+// 获取代理指标
+func getAgentMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+	
+	// 获取时间范围参数
+	timeFromStr := c.DefaultQuery("from", "0")
+	timeToStr := c.DefaultQuery("to", fmt.Sprintf("%d", time.Now().Unix()))
+	
+	timeFrom, err := strconv.ParseInt(timeFromStr, 10, 64)
+	if err != nil {
+		log.Printf("无效的from时间参数: %s, %v", timeFromStr, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("from参数格式错误: %v", err)})
+		return
+	}
+	
+	timeTo, err := strconv.ParseInt(timeToStr, 10, 64)
+	if err != nil {
+		log.Printf("无效的to时间参数: %s, %v", timeToStr, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("to参数格式错误: %v", err)})
+		return
+	}
+	
+	// 获取数据限制
+	limitStr := c.DefaultQuery("limit", "100")
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		log.Printf("无效的limit参数: %s, 使用默认值100", limitStr)
+		limit = 100
+	}
+
+	// 首先检查代理是否存在
+	var exists bool
+	err = db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("要查询的代理不存在: %s", agentID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
+		} else {
+			log.Printf("检查代理存在性错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("检查代理存在性错误: %v", err)})
+		}
+		return
+	}
+	
+	log.Printf("查询代理 %s 的指标, 从 %d 到 %d, 限制 %d 条", agentID, timeFrom, timeTo, limit)
+	
+	// 查询该agent的metrics总记录数
+	var metricsCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ?", agentID).Scan(&metricsCount)
+	if err != nil {
+		log.Printf("查询metrics总数量错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("查询指标数量时出错: %v", err)})
+		return
+	}
+	
+	log.Printf("找到 %d 条代理 %s 的指标记录", metricsCount, agentID)
+	
+	// 如果该agent没有任何metrics记录，直接返回空数组
+	if metricsCount == 0 {
+		log.Printf("代理 %s 没有任何指标数据，返回空数组", agentID)
+		c.JSON(http.StatusOK, []map[string]interface{}{})
+		return
+	}
+	
+	// 查询指定时间范围内的记录数
+	var rangeCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?", 
+		agentID, timeFrom, timeTo).Scan(&rangeCount)
+	if err != nil {
+		log.Printf("查询时间范围内的metrics数量错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("查询时间范围内的指标数量时出错: %v", err)})
+		return
+	}
+	
+	log.Printf("时间范围内找到 %d 条代理 %s 的指标记录", rangeCount, agentID)
+	
+	// 如果时间范围内没有记录，返回空数组
+	if rangeCount == 0 {
+		log.Printf("指定时间范围内没有数据，返回空数组")
+		c.JSON(http.StatusOK, []map[string]interface{}{})
+		return
+	}
+	
+	// 查询指标
+	query := `
+		SELECT 
+			timestamp, cpu_usage, 
+			memory_total, memory_used, memory_percent,
+			disk_total, disk_used, disk_percent,
+			network_sent, network_recv,
+			load_avg_1, load_avg_5, load_avg_15,
+			process_count
+		FROM metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp DESC
+		LIMIT ?
+	`
+	
+	log.Printf("执行查询: %s", query)
+	rows, err := db.Query(query, agentID, timeFrom, timeTo, limit)
+	
+	if err != nil {
+		log.Printf("查询代理指标错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+	
+	var metrics []map[string]interface{}
+	for rows.Next() {
+		var (
+			timestamp                                                          int64
+			cpuUsage, memPercent, diskPercent                                 float64
+			loadAvg1, loadAvg5, loadAvg15                                     float64
+			memTotal, memUsed, diskTotal, diskUsed, netSent, netRecv          int64
+			processCount                                                       int
+		)
+		
+		if err := rows.Scan(
+			&timestamp, &cpuUsage,
+			&memTotal, &memUsed, &memPercent,
+			&diskTotal, &diskUsed, &diskPercent,
+			&netSent, &netRecv,
+			&loadAvg1, &loadAvg5, &loadAvg15,
+			&processCount,
+		); err != nil {
+			log.Printf("扫描指标行数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		
+		log.Printf("行数据: timestamp=%d, cpu=%.2f%%, mem=%.2f%%, disk=%.2f%%", 
+			timestamp, cpuUsage, memPercent, diskPercent)
+		
+		metric := map[string]interface{}{
+			"timestamp":    timestamp,
+			"cpu_usage":    cpuUsage,
+			"memory_info": map[string]interface{}{
+				"total":   memTotal,
+				"used":    memUsed,
+				"percent": memPercent,
+			},
+			"disk_info": map[string]interface{}{
+				"total":   diskTotal,
+				"used":    diskUsed,
+				"percent": diskPercent,
+			},
+			"network_info": map[string]interface{}{
+				"bytes_sent": netSent,
+				"bytes_recv": netRecv,
+			},
+			"load_average": map[string]interface{}{
+				"load1":  loadAvg1,
+				"load5":  loadAvg5,
+				"load15": loadAvg15,
+			},
+			"process_count": processCount,
+		}
+		
+		metrics = append(metrics, metric)
+	}
+	
+	if err = rows.Err(); err != nil {
+		log.Printf("指标数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+	
+	log.Printf("成功获取代理 %s 的 %d 条指标记录", agentID, len(metrics))
+	
+	// 如果查询结果为空（理论上不应该发生，因为之前已经检查了），也返回空数组
+	if len(metrics) == 0 {
+		log.Printf("查询结果为空，返回空数组")
+		c.JSON(http.StatusOK, []map[string]interface{}{})
+		return
+	}
+	
+	c.JSON(http.StatusOK, metrics)
+}
+
+// parseMetricsQuery 解析指标查询的from、to和limit参数，参数无效时直接返回错误响应
+func parseMetricsQuery(c *gin.Context) (int64, int64, int, bool) {
+	timeFromStr := c.DefaultQuery("from", "0")
+	timeToStr := c.DefaultQuery("to", fmt.Sprintf("%d", time.Now().Unix()))
+
+	timeFrom, err := strconv.ParseInt(timeFromStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("from参数格式错误: %v", err)})
+		return 0, 0, 0, false
+	}
+
+	timeTo, err := strconv.ParseInt(timeToStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("to参数格式错误: %v", err)})
+		return 0, 0, 0, false
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil || limit <= 0 {
+		limit = 1000
+	}
+
+	return timeFrom, timeTo, limit, true
+}
+
+// checkAgentExists 检查代理是否存在，不存在时直接返回错误响应
+func checkAgentExists(c *gin.Context, agentID string) bool {
+	var exists bool
+	err := db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
+		} else {
+			log.Printf("检查代理存在性错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("检查代理存在性错误: %v", err)})
+		}
+		return false
+	}
+	return true
+}
+
+// 获取代理的CPU模式占比，可通过cpu参数筛选单个核心（默认cpu-total）
+func getAgentCPUMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, cpu, usage, user, system, nice, iowait, irq, softirq, steal, guest
+		FROM cpu_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if cpuName := c.Query("cpu"); cpuName != "all" {
+		if cpuName == "" {
+			cpuName = "cpu-total"
+		}
+		query += " AND cpu = ?"
+		args = append(args, cpuName)
+	}
+	query += " ORDER BY timestamp DESC, cpu LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询CPU模式数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s CPUStat
+		if err := rows.Scan(&timestamp, &s.CPU, &s.Usage, &s.User, &s.System, &s.Nice, &s.Iowait, &s.Irq, &s.Softirq, &s.Steal, &s.Guest); err != nil {
+			log.Printf("扫描CPU模式数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp": timestamp,
+			"cpu":       s.CPU,
+			"usage":     s.Usage,
+			"user":      s.User,
+			"system":    s.System,
+			"nice":      s.Nice,
+			"iowait":    s.Iowait,
+			"irq":       s.Irq,
+			"softirq":   s.Softirq,
+			"steal":     s.Steal,
+			"guest":     s.Guest,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("CPU模式数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理各挂载点的文件系统使用情况，可通过mountpoint参数筛选单个挂载点
+func getAgentFilesystemMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, mountpoint, device, fstype,
+			total, used, free, used_percent,
+			inodes_total, inodes_used, inodes_free, inodes_used_percent
+		FROM filesystem_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if mountpoint := c.Query("mountpoint"); mountpoint != "" {
+		query += " AND mountpoint = ?"
+		args = append(args, mountpoint)
+	}
+	query += " ORDER BY timestamp DESC, mountpoint LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询文件系统数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var fs FilesystemInfo
+		var device, fstype sql.NullString
+		if err := rows.Scan(
+			&timestamp, &fs.Mountpoint, &device, &fstype,
+			&fs.Total, &fs.Used, &fs.Free, &fs.UsedPercent,
+			&fs.InodesTotal, &fs.InodesUsed, &fs.InodesFree, &fs.InodesUsedPercent,
+		); err != nil {
+			log.Printf("扫描文件系统数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp":           timestamp,
+			"mountpoint":          fs.Mountpoint,
+			"device":              device.String,
+			"fstype":              fstype.String,
+			"total":               fs.Total,
+			"used":                fs.Used,
+			"free":                fs.Free,
+			"used_percent":        fs.UsedPercent,
+			"inodes_total":        fs.InodesTotal,
+			"inodes_used":         fs.InodesUsed,
+			"inodes_free":         fs.InodesFree,
+			"inodes_used_percent": fs.InodesUsedPercent,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("文件系统数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理各块设备的IO速率，可通过device参数筛选单个设备
+func getAgentDiskIOMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, device,
+			read_bytes_per_sec, write_bytes_per_sec, read_iops, write_iops,
+			read_await_ms, write_await_ms, await_ms, util_percent
+		FROM diskio_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if device := c.Query("device"); device != "" {
+		query += " AND device = ?"
+		args = append(args, device)
+	}
+	query += " ORDER BY timestamp DESC, device LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询磁盘IO数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s DiskIOStat
+		if err := rows.Scan(
+			&timestamp, &s.Device,
+			&s.ReadBytesPerSec, &s.WriteBytesPerSec, &s.ReadIOPS, &s.WriteIOPS,
+			&s.ReadAwaitMs, &s.WriteAwaitMs, &s.AwaitMs, &s.UtilPercent,
+		); err != nil {
+			log.Printf("扫描磁盘IO数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp":           timestamp,
+			"device":              s.Device,
+			"read_bytes_per_sec":  s.ReadBytesPerSec,
+			"write_bytes_per_sec": s.WriteBytesPerSec,
+			"read_iops":           s.ReadIOPS,
+			"write_iops":          s.WriteIOPS,
+			"read_await_ms":       s.ReadAwaitMs,
+			"write_await_ms":      s.WriteAwaitMs,
+			"await_ms":            s.AwaitMs,
+			"util_percent":        s.UtilPercent,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("磁盘IO数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理各网卡的流量速率、错误和丢包，可通过interface参数筛选单个网卡
+func getAgentNetworkMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, interface,
+			bytes_sent, bytes_recv, bytes_sent_per_sec, bytes_recv_per_sec,
+			packets_sent_per_sec, packets_recv_per_sec,
+			errors_in, errors_out, drops_in, drops_out
+		FROM netif_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if iface := c.Query("interface"); iface != "" {
+		query += " AND interface = ?"
+		args = append(args, iface)
+	}
+	query += " ORDER BY timestamp DESC, interface LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询网卡数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s NetInterfaceStat
+		if err := rows.Scan(
+			&timestamp, &s.Interface,
+			&s.BytesSent, &s.BytesRecv, &s.BytesSentPerSec, &s.BytesRecvPerSec,
+			&s.PacketsSentPerSec, &s.PacketsRecvPerSec,
+			&s.ErrorsIn, &s.ErrorsOut, &s.DropsIn, &s.DropsOut,
+		); err != nil {
+			log.Printf("扫描网卡数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp":            timestamp,
+			"interface":            s.Interface,
+			"bytes_sent":           s.BytesSent,
+			"bytes_recv":           s.BytesRecv,
+			"bytes_sent_per_sec":   s.BytesSentPerSec,
+			"bytes_recv_per_sec":   s.BytesRecvPerSec,
+			"packets_sent_per_sec": s.PacketsSentPerSec,
+			"packets_recv_per_sec": s.PacketsRecvPerSec,
+			"errors_in":            s.ErrorsIn,
+			"errors_out":           s.ErrorsOut,
+			"drops_in":             s.DropsIn,
+			"drops_out":            s.DropsOut,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("网卡数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理各协议的连接状态统计，可通过protocol参数筛选（如tcp4）
+func getAgentConnectionMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, protocol, state, count
+		FROM conn_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if protocol := c.Query("protocol"); protocol != "" {
+		query += " AND protocol = ?"
+		args = append(args, protocol)
+	}
+	query += " ORDER BY timestamp DESC, protocol, state LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询连接状态数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s ConnStateCount
+		if err := rows.Scan(&timestamp, &s.Protocol, &s.State, &s.Count); err != nil {
+			log.Printf("扫描连接状态数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp": timestamp,
+			"protocol":  s.Protocol,
+			"state":     s.State,
+			"count":     s.Count,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("连接状态数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理的内存和交换分区明细
+func getAgentMemoryMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT timestamp, total, used, available, cached, buffers, dirty, slab,
+			swap_total, swap_used, swap_in_per_sec, swap_out_per_sec
+		FROM memory_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp DESC LIMIT ?`, agentID, timeFrom, timeTo, limit)
+	if err != nil {
+		log.Printf("查询内存明细错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var m MemoryStat
+		if err := rows.Scan(
+			&timestamp, &m.Total, &m.Used, &m.Available, &m.Cached, &m.Buffers, &m.Dirty, &m.Slab,
+			&m.SwapTotal, &m.SwapUsed, &m.SwapInPerSec, &m.SwapOutPerSec,
+		); err != nil {
+			log.Printf("扫描内存明细错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp":        timestamp,
+			"total":            m.Total,
+			"used":             m.Used,
+			"available":        m.Available,
+			"cached":           m.Cached,
+			"buffers":          m.Buffers,
+			"dirty":            m.Dirty,
+			"slab":             m.Slab,
+			"swap_total":       m.SwapTotal,
+			"swap_used":        m.SwapUsed,
+			"swap_in_per_sec":  m.SwapInPerSec,
+			"swap_out_per_sec": m.SwapOutPerSec,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("内存明细遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理的压力阻塞信息，可通过resource（cpu/memory/io）和kind（some/full）参数筛选
+func getAgentPressureMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, resource, kind, avg10, avg60, avg300, total
+		FROM pressure_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if resource := c.Query("resource"); resource != "" {
+		query += " AND resource = ?"
+		args = append(args, resource)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	query += " ORDER BY timestamp DESC, resource, kind LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询压力阻塞数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s PressureStat
+		if err := rows.Scan(&timestamp, &s.Resource, &s.Kind, &s.Avg10, &s.Avg60, &s.Avg300, &s.Total); err != nil {
+			log.Printf("扫描压力阻塞数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp": timestamp,
+			"resource":  s.Resource,
+			"kind":      s.Kind,
+			"avg10":     s.Avg10,
+			"avg60":     s.Avg60,
+			"avg300":    s.Avg300,
+			"total":     s.Total,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("压力阻塞数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理的温度和风扇传感器读数，可通过type（temperature/fan）和sensor参数筛选
+func getAgentSensorMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, sensor, type, value, critical
+		FROM sensor_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if sensorType := c.Query("type"); sensorType != "" {
+		query += " AND type = ?"
+		args = append(args, sensorType)
+	}
+	if sensor := c.Query("sensor"); sensor != "" {
+		query += " AND sensor = ?"
+		args = append(args, sensor)
+	}
+	query += " ORDER BY timestamp DESC, type, sensor LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询传感器数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var timestamp int64
+		var s SensorStat
+		if err := rows.Scan(&timestamp, &s.Sensor, &s.Type, &s.Value, &s.Critical); err != nil {
+			log.Printf("扫描传感器数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"timestamp": timestamp,
+			"sensor":    s.Sensor,
+			"type":      s.Type,
+			"value":     s.Value,
+			"critical":  s.Critical,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("传感器数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理的自定义指标历史，可通过name和source参数筛选指标名称和来源
+func getAgentCustomMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT timestamp, source, name, labels, value, COALESCE(unit, '')
+		FROM custom_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if name := c.Query("name"); name != "" {
+		query += " AND name = ?"
+		args = append(args, name)
+	}
+	if source, ok := c.GetQuery("source"); ok {
+		query += " AND source = ?"
+		args = append(args, source)
+	}
+	query += " ORDER BY timestamp DESC, name, labels LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询自定义指标错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		item, err := scanCustomMetricRow(rows)
+		if err != nil {
+			log.Printf("扫描自定义指标错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("自定义指标遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理最近一天上报过的自定义指标曲线，每条曲线返回最新的取值以及同一来源中该指标的类型和说明
+func getAgentCustomSeries(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	// SQLite中与MAX()一起查询的其他列取自最大值所在的行
+	rows, err := db.Query(`
+		SELECT MAX(timestamp), source, name, labels, value, COALESCE(unit, '')
+		FROM custom_metrics
+		WHERE agent_id = ? AND timestamp >= ?
+		GROUP BY source, name, labels
+		ORDER BY name, source, labels`, agentID, time.Now().Add(-24*time.Hour).Unix())
+	if err != nil {
+		log.Printf("查询自定义指标曲线错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取自定义指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		item, err := scanCustomMetricRow(rows)
+		if err != nil {
+			log.Printf("扫描自定义指标曲线错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理自定义指标错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("自定义指标曲线遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+	rows.Close()
+
+	// 补充各指标的类型和说明
+	meta, err := queryCustomMetricMeta(agentID)
+	if err != nil {
+		log.Printf("查询自定义指标说明错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取自定义指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	for _, item := range result {
+		m := meta[customMetricID{item["source"].(string), item["name"].(string)}]
+		item["type"] = m.Type
+		item["help"] = m.Help
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// queryCustomMetricMeta 查询代理各自定义指标最近一次上报的类型和说明，按来源和指标名称索引
+func queryCustomMetricMeta(agentID string) (map[customMetricID]CustomMetric, error) {
+	rows, err := db.Query(`
+		SELECT source, name, COALESCE(type, ''), COALESCE(help, '')
+		FROM custom_metric_meta
+		WHERE agent_id = ?`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	meta := make(map[customMetricID]CustomMetric)
+	for rows.Next() {
+		var m CustomMetric
+		if err := rows.Scan(&m.Source, &m.Name, &m.Type, &m.Help); err != nil {
+			return nil, err
+		}
+		meta[customMetricID{m.Source, m.Name}] = m
+	}
+	return meta, rows.Err()
+}
+
+// scanCustomMetricRow 扫描一行自定义指标（timestamp, source, name, labels, value, unit）并转换为响应格式
+func scanCustomMetricRow(rows *sql.Rows) (map[string]interface{}, error) {
+	var timestamp int64
+	var m CustomMetric
+	var labels string
+	if err := rows.Scan(&timestamp, &m.Source, &m.Name, &labels, &m.Value, &m.Unit); err != nil {
+		return nil, err
+	}
+	m.Labels = map[string]string{}
+	if err := json.Unmarshal([]byte(labels), &m.Labels); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"timestamp": timestamp,
+		"source":    m.Source,
+		"name":      m.Name,
+		"labels":    m.Labels,
+		"value":     m.Value,
+		"unit":      m.Unit,
+	}, nil
+}
+
+// cgroupColumns cgroup_metrics查询使用的列，与scanCgroupRow的扫描顺序一致
+const cgroupColumns = `timestamp, name, kind, path, container_id,
+			cpu_percent, memory_current, memory_max, oom_kills,
+			io_read_bytes, io_write_bytes, io_read_bytes_per_sec, io_write_bytes_per_sec`
+
+// scanCgroupRow 扫描一行cgroup数据并转换为响应格式
+func scanCgroupRow(rows *sql.Rows) (map[string]interface{}, error) {
+	var timestamp int64
+	var s CgroupStat
+	var containerID sql.NullString
+	if err := rows.Scan(
+		&timestamp, &s.Name, &s.Kind, &s.Path, &containerID,
+		&s.CPUPercent, &s.MemoryCurrent, &s.MemoryMax, &s.OOMKills,
+		&s.IOReadBytes, &s.IOWriteBytes, &s.IOReadBytesPerSec, &s.IOWriteBytesPerSec,
+	); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"timestamp":              timestamp,
+		"name":                   s.Name,
+		"kind":                   s.Kind,
+		"path":                   s.Path,
+		"container_id":           containerID.String,
+		"cpu_percent":            s.CPUPercent,
+		"memory_current":         s.MemoryCurrent,
+		"memory_max":             s.MemoryMax,
+		"oom_kills":              s.OOMKills,
+		"io_read_bytes":          s.IOReadBytes,
+		"io_write_bytes":         s.IOWriteBytes,
+		"io_read_bytes_per_sec":  s.IOReadBytesPerSec,
+		"io_write_bytes_per_sec": s.IOWriteBytesPerSec,
+	}, nil
+}
+
+// 获取代理各容器、服务和slice的资源占用历史，可通过kind和name参数筛选
+func getAgentCgroupMetrics(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	timeFrom, timeTo, limit, ok := parseMetricsQuery(c)
+	if !ok {
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT ` + cgroupColumns + `
+		FROM cgroup_metrics
+		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?`
+	args := []interface{}{agentID, timeFrom, timeTo}
+	if kind := c.Query("kind"); kind != "" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	if name := c.Query("name"); name != "" {
+		query += " AND name = ?"
+		args = append(args, name)
+	}
+	query += " ORDER BY timestamp DESC, path LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询cgroup数据错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		item, err := scanCgroupRow(rows)
+		if err != nil {
+			log.Printf("扫描cgroup数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("cgroup数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理最近一次上报的容器列表及其资源占用，kind参数默认为container，传all返回服务和slice
+func getAgentContainers(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	query := `
+		SELECT ` + cgroupColumns + `
+		FROM cgroup_metrics
+		WHERE agent_id = ? AND timestamp = (SELECT MAX(timestamp) FROM cgroup_metrics WHERE agent_id = ?)`
+	args := []interface{}{agentID, agentID}
+	if kind := c.DefaultQuery("kind", "container"); kind != "all" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	query += " ORDER BY kind, name"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询容器列表错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取容器列表", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		item, err := scanCgroupRow(rows)
+		if err != nil {
+			log.Printf("扫描容器数据错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理容器数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("容器数据遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// portsReportedAt 获取代理最近一次上报监听端口的时间戳，从未上报时返回0
+// 监听端口可能因采集失败、被关闭或单独设置了采集间隔而不在每次上报中出现，当前状态以这个时间为准
+func portsReportedAt(agentID string) (int64, error) {
+	var timestamp int64
+	err := db.QueryRow("SELECT COALESCE(ports_reported_at, 0) FROM agents WHERE id = ?", agentID).Scan(&timestamp)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return timestamp, err
+}
+
+// queryCurrentListeningPorts 查询代理最近一次上报的监听端口，ok为false表示代理从未上报过监听端口
+func queryCurrentListeningPorts(agentID string) (ports []ListeningPort, ok bool, err error) {
+	latest, err := portsReportedAt(agentID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的用户名或密码"})
-		} else {
-			log.Printf("数据库查询错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return nil, false, err
+	}
+	if latest == 0 {
+		return nil, false, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT protocol, address, port, pid, process
+		FROM listening_ports
+		WHERE agent_id = ? AND last_seen >= ?`, agentID, latest)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p ListeningPort
+		var process sql.NullString
+		if err := rows.Scan(&p.Protocol, &p.Address, &p.Port, &p.PID, &process); err != nil {
+			return nil, false, err
+		}
+		p.Process = process.String
+		ports = append(ports, p)
+	}
+	return ports, true, rows.Err()
+}
+
+// matchExpectedPort 判断期望端口是否在监听列表中，tcp、udp同时匹配IPv4和IPv6
+func matchExpectedPort(expected ExpectedPort, ports []ListeningPort) bool {
+	for _, p := range ports {
+		if p.Port != expected.Port {
+			continue
+		}
+		if p.Protocol == expected.Protocol || p.Protocol == expected.Protocol+"4" || p.Protocol == expected.Protocol+"6" {
+			return true
+		}
+	}
+	return false
+}
+
+// queryExpectedPorts 查询代理配置的期望监听端口
+func queryExpectedPorts(agentID string) ([]ExpectedPort, error) {
+	rows, err := db.Query(`
+		SELECT protocol, port, description
+		FROM expected_ports
+		WHERE agent_id = ?
+		ORDER BY port, protocol`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ports := []ExpectedPort{}
+	for rows.Next() {
+		var p ExpectedPort
+		var description sql.NullString
+		if err := rows.Scan(&p.Protocol, &p.Port, &description); err != nil {
+			return nil, err
 		}
+		p.Description = description.String
+		ports = append(ports, p)
+	}
+	return ports, rows.Err()
+}
+
+// 获取代理的监听端口清单，listening表示最近一次上报中是否仍在监听
+func getAgentListeningPorts(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	if !checkAgentExists(c, agentID) {
 		return
 	}
 
-	// 验证密码
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password))
-	if err == nil { // 密码正确
-		// 创建JWT令牌
-		token, err := createToken(user.Username, user.Role)
+	latest, err := portsReportedAt(agentID)
+	if err != nil {
+		log.Printf("查询代理监听端口上报时间错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		return
+	}
+
+	query := `
+		SELECT protocol, address, port, pid, process, first_seen, last_seen
+		FROM listening_ports
+		WHERE agent_id = ?`
+	args := []interface{}{agentID}
+	if c.Query("all") != "true" {
+		// 尚未记录上报时间时不能判断哪些端口仍在监听
+		query += " AND last_seen >= ? AND ? > 0"
+		args = append(args, latest, latest)
+	}
+	query += " ORDER BY port, protocol, address"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("查询监听端口错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取监听端口", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+	defer rows.Close()
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var p ListeningPort
+		var process sql.NullString
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&p.Protocol, &p.Address, &p.Port, &p.PID, &process, &firstSeen, &lastSeen); err != nil {
+			log.Printf("扫描监听端口错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理监听端口错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+			return
+		}
+		result = append(result, map[string]interface{}{
+			"protocol":   p.Protocol,
+			"address":    p.Address,
+			"port":       p.Port,
+			"pid":        p.PID,
+			"process":    process.String,
+			"first_seen": firstSeen,
+			"last_seen":  lastSeen,
+			"listening":  latest > 0 && lastSeen >= latest,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("监听端口遍历错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取代理的期望监听端口及其当前是否在监听
+func getAgentExpectedPorts(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	expected, err := queryExpectedPorts(agentID)
+	if err != nil {
+		log.Printf("查询期望端口错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取期望端口", "detail": err.Error()})
+		return
+	}
+	current, reported, err := queryCurrentListeningPorts(agentID)
+	if err != nil {
+		log.Printf("查询监听端口错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取监听端口", "detail": err.Error()})
+		return
+	}
+
+	result := []map[string]interface{}{}
+	for _, p := range expected {
+		item := map[string]interface{}{
+			"protocol":    p.Protocol,
+			"port":        p.Port,
+			"description": p.Description,
+			"listening":   nil,
+		}
+		if reported {
+			item["listening"] = matchExpectedPort(p, current)
+		}
+		result = append(result, item)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// 设置代理的期望监听端口，整体替换原有配置
+func setAgentExpectedPorts(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	var ports []ExpectedPort
+	if err := c.ShouldBindJSON(&ports); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return
+	}
+	for i, p := range ports {
+		switch p.Protocol {
+		case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		case "":
+			ports[i].Protocol = "tcp"
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": fmt.Sprintf("不支持的协议: %s", p.Protocol)})
+			return
+		}
+		if p.Port <= 0 || p.Port > 65535 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": fmt.Sprintf("无效的端口: %d", p.Port)})
+			return
+		}
+	}
+
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("开始事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM expected_ports WHERE agent_id = ?", agentID); err != nil {
+		tx.Rollback()
+		log.Printf("清除期望端口失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存期望端口失败", "detail": err.Error()})
+		return
+	}
+	now := time.Now().Unix()
+	for _, p := range ports {
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO expected_ports (agent_id, protocol, port, description, created_at)
+			VALUES (?, ?, ?, ?, ?)`, agentID, p.Protocol, p.Port, p.Description, now)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建令牌"})
+			tx.Rollback()
+			log.Printf("保存期望端口失败: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存期望端口失败", "detail": err.Error()})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+		return
+	}
+
+	log.Printf("已更新代理 %s 的期望端口，共 %d 个", agentID, len(ports))
+	c.JSON(http.StatusOK, gin.H{"message": "已保存", "agent_id": agentID, "count": len(ports)})
+}
+
+// systemdReportedAt 获取代理最近一次上报systemd单元的时间戳，从未上报时返回0
+// systemd采集项可能单独设置了采集间隔而不在每次上报中出现，当前状态以这个时间为准
+func systemdReportedAt(agentID string) (int64, error) {
+	var timestamp int64
+	err := db.QueryRow("SELECT COALESCE(systemd_reported_at, 0) FROM agents WHERE id = ?", agentID).Scan(&timestamp)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return timestamp, err
+}
+
+// queryCurrentSystemdUnits 查询代理最近一次上报中的systemd单元状态
+func queryCurrentSystemdUnits(agentID string) ([]UnitStat, error) {
+	latest, err := systemdReportedAt(agentID)
+	if err != nil {
+		return nil, err
+	}
+	if latest == 0 {
+		return []UnitStat{}, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT unit, load_state, active_state, sub_state, restarts, state_changed_at, watched
+		FROM systemd_units
+		WHERE agent_id = ? AND last_seen >= ?
+		ORDER BY watched DESC, unit`, agentID, latest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	units := []UnitStat{}
+	for rows.Next() {
+		var u UnitStat
+		if err := rows.Scan(&u.Unit, &u.LoadState, &u.ActiveState, &u.SubState, &u.Restarts, &u.StateChangedAt, &u.Watched); err != nil {
+			return nil, err
+		}
+		units = append(units, u)
+	}
+	return units, rows.Err()
+}
+
+// 获取代理最近一次上报的systemd单元状态，包括关注的单元和所有failed单元
+func getAgentServices(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	units, err := queryCurrentSystemdUnits(agentID)
+	if err != nil {
+		log.Printf("查询systemd单元状态错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取服务状态", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, units)
+}
+
+// 获取代理在at时刻（默认当前时间）或之前最近一次的进程快照，可通过sort参数按cpu或memory排序
+func getAgentProcesses(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+
+	at, err := strconv.ParseInt(c.DefaultQuery("at", fmt.Sprintf("%d", time.Now().Unix())), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间参数", "detail": fmt.Sprintf("at参数格式错误: %v", err)})
+		return
+	}
+	orderBy := "cpu_percent DESC, rss DESC"
+	switch c.DefaultQuery("sort", "cpu") {
+	case "cpu":
+	case "memory":
+		orderBy = "rss DESC, cpu_percent DESC"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的排序参数", "detail": "sort参数只支持cpu或memory"})
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
+	}
+
+	var snapshotTime int64
+	err = db.QueryRow("SELECT COALESCE(MAX(timestamp), 0) FROM process_snapshots WHERE agent_id = ? AND timestamp <= ?", agentID, at).Scan(&snapshotTime)
+	if err != nil {
+		log.Printf("查询进程快照时间错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取进程快照", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		return
+	}
+
+	processes := []ProcessInfo{}
+	if snapshotTime > 0 {
+		rows, err := db.Query(`
+			SELECT pid, name, cmdline, username, cpu_percent, rss, num_fds,
+				read_bytes, write_bytes, top_cpu, top_memory
+			FROM process_snapshots
+			WHERE agent_id = ? AND timestamp = ?
+			ORDER BY `+orderBy, agentID, snapshotTime)
+		if err != nil {
+			log.Printf("查询进程快照错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取进程快照", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var p ProcessInfo
+			var name, cmdline, username sql.NullString
+			if err := rows.Scan(
+				&p.PID, &name, &cmdline, &username, &p.CPUPercent, &p.RSS, &p.NumFDs,
+				&p.ReadBytes, &p.WriteBytes, &p.TopCPU, &p.TopMemory,
+			); err != nil {
+				log.Printf("扫描进程快照错误: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "处理进程快照错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
+				return
+			}
+			p.Name, p.Cmdline, p.Username = name.String, cmdline.String, username.String
+			processes = append(processes, p)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("进程快照遍历错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
 			return
 		}
+	}
 
-		c.JSON(http.StatusOK, gin.H{
-			"token": token,
-			"user": gin.H{
-				"username": user.Username,
-				"role":     user.Role,
-			},
-		})
-	} else {
-		log.Printf("密码验证失败: %v", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的用户名或密码"})
+	c.JSON(http.StatusOK, gin.H{
+		"timestamp": snapshotTime,
+		"processes": processes,
+	})
+}
+
+// 获取注册令牌列表
+func getEnrollmentTokens(c *gin.Context) {
+	rows, err := db.Query("SELECT id, COALESCE(description, ''), max_uses, uses, created_at, expires_at, revoked FROM enrollment_tokens ORDER BY created_at DESC")
+	if err != nil {
+		log.Printf("查询注册令牌失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取注册令牌失败"})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []EnrollmentToken{}
+	for rows.Next() {
+		var t EnrollmentToken
+		if err := rows.Scan(&t.ID, &t.Description, &t.MaxUses, &t.Uses, &t.CreatedAt, &t.ExpiresAt, &t.Revoked); err != nil {
+			log.Printf("读取注册令牌失败: %v", err)
+			continue
+		}
+		tokens = append(tokens, t)
 	}
+	c.JSON(http.StatusOK, tokens)
 }
 
-// 注册处理函数
-func register(c *gin.Context) {
-	var credentials struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
+// 创建注册令牌，令牌明文只在响应中返回一次
+func createEnrollmentToken(c *gin.Context) {
+	var req struct {
+		Description string `json:"description"`
+		MaxUses     *int   `json:"max_uses"`
+		TTLHours    int    `json:"ttl_hours"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return
+	}
+
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	if maxUses < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_uses不能为负数"})
+		return
+	}
+	ttlHours := req.TTLHours
+	if ttlHours <= 0 {
+		ttlHours = defaultEnrollmentTokenTTLHours
+	}
+
+	token, err := randomHex(24)
+	if err != nil {
+		log.Printf("生成注册令牌失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+	now := time.Now().Unix()
+	t := EnrollmentToken{
+		ID:          uuid.New().String(),
+		Description: req.Description,
+		MaxUses:     maxUses,
+		CreatedAt:   now,
+		ExpiresAt:   now + int64(ttlHours)*3600,
+	}
+	_, err = db.Exec("INSERT INTO enrollment_tokens (id, token_hash, description, max_uses, uses, created_at, expires_at, revoked) VALUES (?, ?, ?, ?, 0, ?, ?, 0)",
+		t.ID, hashToken(token), t.Description, t.MaxUses, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		log.Printf("保存注册令牌失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建注册令牌失败"})
+		return
+	}
+
+	log.Printf("已创建注册令牌 %s（最多使用%d次，%d小时后过期）", t.ID, t.MaxUses, ttlHours)
+	c.JSON(http.StatusCreated, gin.H{
+		"token":       token,
+		"id":          t.ID,
+		"description": t.Description,
+		"max_uses":    t.MaxUses,
+		"created_at":  t.CreatedAt,
+		"expires_at":  t.ExpiresAt,
+	})
+}
+
+// 吊销注册令牌，已用该令牌注册的代理不受影响
+func revokeEnrollmentToken(c *gin.Context) {
+	tokenID := c.Param("id")
+	result, err := db.Exec("UPDATE enrollment_tokens SET revoked = 1 WHERE id = ?", tokenID)
+	if err != nil {
+		log.Printf("吊销注册令牌失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "吊销注册令牌失败"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "注册令牌不存在"})
+		return
+	}
+	log.Printf("已吊销注册令牌 %s", tokenID)
+	c.JSON(http.StatusOK, gin.H{"message": "注册令牌已吊销", "id": tokenID})
+}
+
+// 代理使用注册令牌换取专属密钥
+func enrollAgent(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		AgentID  string `json:"agent_id" binding:"required"`
+		Hostname string `json:"hostname"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return
+	}
+	if len(req.AgentID) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "代理ID过长"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("创建事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
 	}
+	defer tx.Rollback()
 
-	if err := c.ShouldBindJSON(&credentials); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+	// 已有有效专属密钥的代理需先由管理员吊销，防止持有令牌者冒用其他代理的身份
+	var revokedAt int64
+	err = tx.QueryRow("SELECT COALESCE(revoked_at, 0) FROM agent_credentials WHERE agent_id = ?", req.AgentID).Scan(&revokedAt)
+	if err == nil && revokedAt == 0 {
+		log.Printf("代理 %s 已注册，拒绝重复注册", req.AgentID)
+		c.JSON(http.StatusConflict, gin.H{"error": "代理已注册", "detail": "请先吊销该代理的专属密钥"})
 		return
 	}
-
-	// 检查用户名是否已存在
-	var exists bool
-	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", credentials.Username).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
-		log.Printf("数据库查询错误: %v", err)
+		log.Printf("查询代理专属密钥失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
 
-	if err == nil { // 用户已存在
-		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+	// 消耗一次令牌使用次数，令牌无效、过期、已吊销或次数用完时不会更新
+	now := time.Now().Unix()
+	var tokenID string
+	err = tx.QueryRow("SELECT id FROM enrollment_tokens WHERE token_hash = ?", hashToken(req.Token)).Scan(&tokenID)
+	if err != nil {
+		log.Printf("代理 %s 使用了无效的注册令牌", req.AgentID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "注册令牌无效"})
 		return
 	}
-
-	// 哈希密码
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+	result, err := tx.Exec("UPDATE enrollment_tokens SET uses = uses + 1 WHERE id = ? AND revoked = 0 AND expires_at > ? AND (max_uses = 0 OR uses < max_uses)", tokenID, now)
 	if err != nil {
-		log.Printf("密码哈希错误: %v", err)
+		log.Printf("更新注册令牌失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		log.Printf("代理 %s 使用的注册令牌 %s 已过期、已吊销或次数已用完", req.AgentID, tokenID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "注册令牌已失效"})
+		return
+	}
 
-	// 插入新用户
-	_, err = db.Exec(
-		"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
-		credentials.Username, string(hashedPassword), "user", time.Now().Unix(),
-	)
+	secret, err := randomHex(32)
 	if err != nil {
-		log.Printf("创建用户错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建用户"})
+		log.Printf("生成专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
-
-	// 创建JWT令牌
-	token, err := createToken(credentials.Username, "user")
+	_, err = tx.Exec("INSERT OR REPLACE INTO agent_credentials (agent_id, secret, previous_secret, token_id, enrolled_at, rotated_at, revoked_at) VALUES (?, ?, NULL, ?, ?, NULL, NULL)",
+		req.AgentID, secret, tokenID, now)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建令牌"})
+		log.Printf("保存专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("提交事务失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
-		"token": token,
-		"user": gin.H{
-			"username": credentials.Username,
-			"role":     "user",
-		},
-	})
+	if err := registerAgentCredential(req.AgentID, secret, "", false); err != nil {
+		log.Printf("加载代理 %s 的专属密钥失败: %v", req.AgentID, err)
+	}
+	log.Printf("代理 %s（%s）已使用注册令牌 %s 完成注册", req.AgentID, req.Hostname, tokenID)
+	c.JSON(http.StatusOK, gin.H{"agent_id": req.AgentID, "secret": secret})
 }
 
-// 获取当前用户信息
-func getCurrentUser(c *gin.Context) {
-	username, exists := c.Get("username")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+// 获取代理专属密钥状态（不返回密钥本身）
+func getAgentCredential(c *gin.Context) {
+	agentID := c.Param("id")
+	var tokenID string
+	var enrolledAt, rotatedAt, revokedAt int64
+	var rotationPending bool
+	err := db.QueryRow("SELECT COALESCE(token_id, ''), enrolled_at, COALESCE(rotated_at, 0), COALESCE(revoked_at, 0), COALESCE(previous_secret, '') != '' FROM agent_credentials WHERE agent_id = ?", agentID).
+		Scan(&tokenID, &enrolledAt, &rotatedAt, &revokedAt, &rotationPending)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, gin.H{"agent_id": agentID, "enrolled": false})
 		return
 	}
-
-	var user User
-	err := db.QueryRow("SELECT username, role, created_at FROM users WHERE username = ?", username).Scan(&user.Username, &user.Role, &user.CreatedAt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取用户信息"})
+		log.Printf("查询代理专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
-
 	c.JSON(http.StatusOK, gin.H{
-		"username":  user.Username,
-		"role":      user.Role,
-		"createdAt": user.CreatedAt,
+		"agent_id":         agentID,
+		"enrolled":         true,
+		"token_id":         tokenID,
+		"enrolled_at":      enrolledAt,
+		"rotated_at":       rotatedAt,
+		"revoked":          revokedAt > 0,
+		"revoked_at":       revokedAt,
+		"rotation_pending": rotationPending,
 	})
 }
 
-// 更新密码
-func updatePassword(c *gin.Context) {
-	username, exists := c.Get("username")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "未授权"})
+// 轮换代理专属密钥，新密钥在代理下次上报时通过WebSocket下发，旧密钥在代理开始使用新密钥前仍然有效
+func rotateAgentCredential(c *gin.Context) {
+	agentID := c.Param("id")
+	var secret string
+	var revokedAt int64
+	err := db.QueryRow("SELECT COALESCE(secret, ''), COALESCE(revoked_at, 0) FROM agent_credentials WHERE agent_id = ?", agentID).Scan(&secret, &revokedAt)
+	if err == sql.ErrNoRows || (err == nil && revokedAt > 0) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "代理未注册或专属密钥已吊销"})
 		return
 	}
-
-	var passwordData struct {
-		CurrentPassword string `json:"current_password" binding:"required"`
-		NewPassword     string `json:"new_password" binding:"required"`
-	}
-
-	if err := c.ShouldBindJSON(&passwordData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
+	if err != nil {
+		log.Printf("查询代理专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
 
-	// 验证当前密码
-	var storedPassword string
-	err := db.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&storedPassword)
+	newSecret, err := randomHex(32)
 	if err != nil {
+		log.Printf("生成专属密钥失败: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
 		return
 	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(passwordData.CurrentPassword))
-	if err != nil { // 密码不正确
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "当前密码不正确"})
+	// 上一次轮换尚未完成时，代理仍在使用最初的旧密钥，保留它而不是未下发成功的中间密钥
+	var previous string
+	db.QueryRow("SELECT COALESCE(previous_secret, '') FROM agent_credentials WHERE agent_id = ?", agentID).Scan(&previous)
+	if previous == "" {
+		previous = secret
+	}
+	now := time.Now().Unix()
+	if _, err := db.Exec("UPDATE agent_credentials SET secret = ?, previous_secret = ?, rotated_at = ? WHERE agent_id = ?", newSecret, previous, now, agentID); err != nil {
+		log.Printf("轮换代理专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "轮换专属密钥失败"})
 		return
 	}
+	if err := registerAgentCredential(agentID, newSecret, previous, false); err != nil {
+		log.Printf("加载代理 %s 的专属密钥失败: %v", agentID, err)
+	}
 
-	// 哈希新密码
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordData.NewPassword), bcrypt.DefaultCost)
+	log.Printf("已轮换代理 %s 的专属密钥", agentID)
+	c.JSON(http.StatusOK, gin.H{"message": "专属密钥已轮换，将在代理下次上报时下发", "agent_id": agentID, "rotated_at": now})
+}
+
+// 吊销代理专属密钥，代理此后的数据将被拒绝，需要新的注册令牌重新注册
+func revokeAgentCredential(c *gin.Context) {
+	agentID := c.Param("id")
+	now := time.Now().Unix()
+	result, err := db.Exec("UPDATE agent_credentials SET secret = NULL, previous_secret = NULL, revoked_at = ? WHERE agent_id = ?", now, agentID)
 	if err != nil {
-		log.Printf("密码哈希错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		log.Printf("吊销代理专属密钥失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "吊销专属密钥失败"})
 		return
 	}
-
-	// 更新密码
-	_, err = db.Exec("UPDATE users SET password = ? WHERE username = ?", string(hashedPassword), username)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新密码失败"})
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "代理未注册"})
 		return
 	}
+	registerAgentCredential(agentID, "", "", true)
 
-	c.JSON(http.StatusOK, gin.H{"message": "密码已更新"})
+	// 断开代理当前的连接
+	clientsMutex.RLock()
+	if client, ok := clients[agentID]; ok {
+		client.conn.Close()
+	}
+	clientsMutex.RUnlock()
+
+	log.Printf("已吊销代理 %s 的专属密钥", agentID)
+	c.JSON(http.StatusOK, gin.H{"message": "专属密钥已吊销", "agent_id": agentID, "revoked_at": now})
 }
 
-// 获取所有用户（仅管理员）
-func getUsers(c *gin.Context) {
-	log.Printf("请求获取用户列表")
-	
-	rows, err := db.Query("SELECT username, role, created_at FROM users ORDER BY created_at DESC")
+// randomHex 生成指定字节数的随机数并以十六进制表示
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken 计算注册令牌的SHA-256哈希，数据库中只保存哈希
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// queryStoredConfig 读取一条代理或分组的期望配置，不存在时返回nil
+func queryStoredConfig(query string, key string) (map[string]interface{}, int64, error) {
+	var data string
+	var updatedAt int64
+	err := db.QueryRow(query, key).Scan(&data, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
 	if err != nil {
-		log.Printf("获取用户列表查询错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取用户列表"})
-		return
+		return nil, 0, err
 	}
-	defer rows.Close()
+	var cfg map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return nil, 0, err
+	}
+	return cfg, updatedAt, nil
+}
 
-	var users []gin.H
-	for rows.Next() {
-		var username, role string
-		var createdAt int64
-		
-		if err := rows.Scan(&username, &role, &createdAt); err != nil {
-			log.Printf("扫描用户数据错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理用户数据错误"})
-			return
+// desiredAgentConfig 合并分组配置和代理配置得到代理的期望配置及其版本，代理配置中的项覆盖分组配置
+func desiredAgentConfig(agentID, group string) (map[string]interface{}, string, error) {
+	desired := make(map[string]interface{})
+	if group != "" {
+		groupConfig, _, err := queryStoredConfig("SELECT config, updated_at FROM group_configs WHERE group_name = ?", group)
+		if err != nil {
+			return nil, "", err
 		}
-		
-		users = append(users, gin.H{
-			"username":  username,
-			"role":      role,
-			"createdAt": createdAt,
-		})
+		mergeConfig(desired, groupConfig)
 	}
-	
-	if err := rows.Err(); err != nil {
-		log.Printf("遍历用户数据错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "处理用户数据错误"})
-		return
+	agentConfig, _, err := queryStoredConfig("SELECT config, updated_at FROM agent_configs WHERE agent_id = ?", agentID)
+	if err != nil {
+		return nil, "", err
 	}
-
-	log.Printf("成功获取用户列表，共 %d 个用户", len(users))
-	c.JSON(http.StatusOK, users)
+	mergeConfig(desired, agentConfig)
+	return desired, configVersion(desired), nil
 }
 
-// 创建用户（仅管理员）
-func createUser(c *gin.Context) {
-	var userData struct {
-		Username string `json:"username" binding:"required"`
-		Password string `json:"password" binding:"required"`
-		Role     string `json:"role" binding:"required"`
+// mergeConfig 把src中的配置项合并到dst，两边都是对象的项逐层合并，其余直接覆盖
+func mergeConfig(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, ok := value.(map[string]interface{})
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		dstMap, ok := dst[key].(map[string]interface{})
+		if !ok {
+			dstMap = make(map[string]interface{})
+			dst[key] = dstMap
+		}
+		mergeConfig(dstMap, srcMap)
 	}
+}
 
-	if err := c.ShouldBindJSON(&userData); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效"})
-		return
+// configVersion 根据配置内容计算版本，内容相同的配置版本相同，没有配置时为空
+func configVersion(cfg map[string]interface{}) string {
+	if len(cfg) == 0 {
+		return ""
 	}
-
-	// 检查角色有效性
-	if userData.Role != "admin" && userData.Role != "user" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "角色必须是 'admin' 或 'user'"})
-		return
+	// 对象的键按字母顺序序列化，相同内容得到相同的结果
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
 	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
 
-	// 检查用户名是否已存在
-	var exists bool
-	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", userData.Username).Scan(&exists)
-	if err != nil && err != sql.ErrNoRows {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
-		return
+// validateRemoteConfig 检查期望配置只包含允许下发的配置项，各项的取值由代理应用时校验
+func validateRemoteConfig(cfg map[string]interface{}) error {
+	for key, value := range cfg {
+		allowed := false
+		for _, k := range remoteConfigKeys {
+			if k == key {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("不允许下发的配置项: %s，可下发的配置项: %s", key, strings.Join(remoteConfigKeys, ", "))
+		}
+		if key == "interval" {
+			n, ok := value.(float64)
+			if !ok || n < 1 || n != float64(int(n)) {
+				return fmt.Errorf("采集间隔必须为正整数")
+			}
+			continue
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return fmt.Errorf("配置项%s必须为对象", key)
+		}
 	}
-
-	if err == nil { // 用户已存在
-		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
-		return
+	if spool, ok := cfg["spool"].(map[string]interface{}); ok {
+		if _, ok := spool["dir"]; ok {
+			return fmt.Errorf("不允许下发的配置项: spool.dir")
+		}
+	}
+	// 外部程序在代理上执行任意命令，StatsD监听地址决定代理开放的端口，只能在代理本机配置
+	if collectors, ok := cfg["collectors"].(map[string]interface{}); ok {
+		if _, ok := collectors["exec"]; ok {
+			return fmt.Errorf("不允许下发的配置项: collectors.exec")
+		}
+		if statsd, ok := collectors["statsd"].(map[string]interface{}); ok {
+			if _, ok := statsd["addr"]; ok {
+				return fmt.Errorf("不允许下发的配置项: collectors.statsd.addr")
+			}
+		}
 	}
+	return nil
+}
 
-	// 哈希密码
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(userData.Password), bcrypt.DefaultCost)
+// fillAgentConfigState 根据代理所属分组计算期望配置版本，并判断代理是否已应用
+func fillAgentConfigState(agent *Agent) {
+	agent.Group = agent.Labels[configGroupLabel]
+	_, version, err := desiredAgentConfig(agent.ID, agent.Group)
 	if err != nil {
-		log.Printf("密码哈希错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		log.Printf("计算代理 %s 的期望配置失败: %v", agent.ID, err)
 		return
 	}
+	agent.DesiredConfigVersion = version
+	agent.ConfigInSync = version == agent.AppliedConfigVersion
+}
 
-	// 开始事务
-	tx, err := db.Begin()
+// pushAgentConfig 代理尚未应用期望配置且本次连接中未下发过该版本时，向代理下发期望配置
+func pushAgentConfig(client *agentConnection, agentID, group string) {
+	desired, version, err := desiredAgentConfig(agentID, group)
 	if err != nil {
-		log.Printf("创建事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+		log.Printf("Failed to load desired config for agent %s: %v", agentID, err)
 		return
 	}
 
-	// 创建用户 - 移除last_login字段
-	_, err = tx.Exec(
-		"INSERT INTO users (username, password, role, created_at) VALUES (?, ?, ?, ?)",
-		userData.Username, string(hashedPassword), userData.Role, time.Now().Unix(),
-	)
-	if err != nil {
-		tx.Rollback()
-		log.Printf("创建用户失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建用户失败"})
+	client.mutex.Lock()
+	skip := version == client.appliedConfig || (client.configPushed && version == client.pushedConfig)
+	client.mutex.Unlock()
+	if skip {
 		return
 	}
 
-	// 提交事务
-	if err := tx.Commit(); err != nil {
-		log.Printf("提交事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+	message := ServerMessage{Type: "config", Version: version}
+	if version != "" {
+		message.Config, err = json.Marshal(desired)
+		if err != nil {
+			log.Printf("Failed to encode desired config for agent %s: %v", agentID, err)
+			return
+		}
+	}
+	if err := client.send(message); err != nil {
+		log.Printf("Failed to send config %q to agent %s: %v", version, agentID, err)
 		return
 	}
 
-	log.Printf("成功创建用户: %s, 角色: %s", userData.Username, userData.Role)
-	c.JSON(http.StatusCreated, gin.H{
-		"username":  userData.Username,
-		"role":      userData.Role,
-		"createdAt": time.Now().Unix(),
-	})
+	client.mutex.Lock()
+	client.pushedConfig = version
+	client.configPushed = true
+	client.mutex.Unlock()
+	log.Printf("Sent config %q to agent %s", version, agentID)
 }
 
-// 删除用户（仅管理员）
-func deleteUser(c *gin.Context) {
-	username := c.Param("username")
-
-	// 检查用户是否存在
-	var exists bool
-	err := db.QueryRow("SELECT 1 FROM users WHERE username = ?", username).Scan(&exists)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
-		} else {
-			log.Printf("检查用户存在性错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+// pushDesiredConfigs 期望配置变化后向在线代理下发，agentID为空时检查所有在线代理
+func pushDesiredConfigs(agentID string) {
+	targets := make(map[string]*agentConnection)
+	clientsMutex.RLock()
+	for id, client := range clients {
+		if agentID == "" || id == agentID {
+			targets[id] = client
 		}
-		return
 	}
+	clientsMutex.RUnlock()
 
-	// 防止删除管理员账户
-	if username == "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "不能删除系统管理员账户"})
-		return
+	for id, client := range targets {
+		var labels string
+		if err := db.QueryRow("SELECT COALESCE(labels, '') FROM agents WHERE id = ?", id).Scan(&labels); err != nil {
+			log.Printf("查询代理 %s 的标签失败: %v", id, err)
+			continue
+		}
+		var agentLabels map[string]string
+		if labels != "" {
+			json.Unmarshal([]byte(labels), &agentLabels)
+		}
+		pushAgentConfig(client, id, agentLabels[configGroupLabel])
 	}
+}
 
-	// 开始事务
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("创建事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
-		return
+// bindRemoteConfig 解析并校验请求中的期望配置
+func bindRemoteConfig(c *gin.Context) (map[string]interface{}, bool) {
+	var cfg map[string]interface{}
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return nil, false
 	}
-
-	// 删除用户
-	result, err := tx.Exec("DELETE FROM users WHERE username = ?", username)
-	if err != nil {
-		tx.Rollback()
-		log.Printf("删除用户错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除用户失败"})
-		return
+	if err := validateRemoteConfig(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+		return nil, false
 	}
+	return cfg, true
+}
 
-	// 检查是否实际删除了用户
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		tx.Rollback()
-		log.Printf("获取受影响行数错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
-		return
-	}
+// 获取代理的期望配置（分组配置与代理配置合并后的结果）以及代理的应用状态
+func getAgentConfig(c *gin.Context) {
+	agentID := c.Param("id")
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
 
-	if rowsAffected == 0 {
-		tx.Rollback()
-		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在或已被删除"})
+	var labels, appliedVersion, configError string
+	var appliedAt int64
+	err := db.QueryRow("SELECT COALESCE(labels, ''), COALESCE(config_version, ''), COALESCE(config_error, ''), COALESCE(config_applied_at, 0) FROM agents WHERE id = ?", agentID).
+		Scan(&labels, &appliedVersion, &configError, &appliedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
 		return
 	}
-
-	// 提交事务
-	if err := tx.Commit(); err != nil {
-		log.Printf("提交事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误"})
+	if err != nil {
+		log.Printf("查询代理配置状态错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
 		return
 	}
+	var agentLabels map[string]string
+	if labels != "" {
+		json.Unmarshal([]byte(labels), &agentLabels)
+	}
+	group := agentLabels[configGroupLabel]
 
-	log.Printf("成功删除用户: %s", username)
-	c.JSON(http.StatusOK, gin.H{"message": "用户已删除"})
-}
-
-// 获取所有代理
-func getAgents(c *gin.Context) {
-	log.Printf("API call: %s %s", c.Request.Method, c.Request.URL.Path)
-	
-	// 执行查询获取所有代理
-	query := "SELECT id, name, hostname, platform, ip_address, last_seen, COALESCE(created_at, 0) as created_at, COALESCE(updated_at, 0) as updated_at FROM agents ORDER BY created_at DESC"
-	
-	log.Printf("执行查询: %s", query)
-	rows, err := db.Query(query)
+	agentConfig, agentConfigUpdatedAt, err := queryStoredConfig("SELECT config, updated_at FROM agent_configs WHERE agent_id = ?", agentID)
 	if err != nil {
-		log.Printf("数据库查询错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取代理列表失败", "detail": "数据库查询出现错误", "message": err.Error()})
+		log.Printf("查询代理期望配置错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取期望配置", "detail": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	var agents []Agent
-	for rows.Next() {
-		var agent Agent
-		var lastSeenUnix sql.NullInt64
-		var createdAtUnix, updatedAtUnix sql.NullInt64
-		
-		err := rows.Scan(
-			&agent.ID, 
-			&agent.Name, 
-			&agent.Hostname, 
-			&agent.Platform, 
-			&agent.IPAddress, 
-			&lastSeenUnix, 
-			&createdAtUnix, 
-			&updatedAtUnix)
-		
+	var groupConfig map[string]interface{}
+	if group != "" {
+		groupConfig, _, err = queryStoredConfig("SELECT config, updated_at FROM group_configs WHERE group_name = ?", group)
 		if err != nil {
-			log.Printf("数据行扫描错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "解析代理数据失败", "detail": "处理数据库结果时出错", "message": err.Error()})
+			log.Printf("查询分组期望配置错误: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取期望配置", "detail": err.Error()})
 			return
 		}
-		
-		// 处理可能为空的时间字段
-		if lastSeenUnix.Valid {
-			agent.LastSeen = time.Unix(lastSeenUnix.Int64, 0)
-			// 检查是否在线 - 如果最后一次通信在10秒内则视为在线
-			agent.IsOnline = time.Since(agent.LastSeen) < 10*time.Second
-		} else {
-			agent.LastSeen = time.Time{}
-			agent.IsOnline = false
-		}
-		
-		if createdAtUnix.Valid {
-			agent.CreatedAt = time.Unix(createdAtUnix.Int64, 0)
-		}
-		
-		if updatedAtUnix.Valid {
-			agent.UpdatedAt = time.Unix(updatedAtUnix.Int64, 0)
-		}
-		
-		// 设置默认值
-		if agent.Name == "" {
-			agent.Name = agent.Hostname
-		}
-		if agent.Platform == "" {
-			agent.Platform = "Unknown"
-		}
-		
-		agents = append(agents, agent)
 	}
-	
-	if err = rows.Err(); err != nil {
-		log.Printf("数据遍历错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取代理列表失败", "detail": "遍历结果集时发生错误", "message": err.Error()})
+	desired, desiredVersion, err := desiredAgentConfig(agentID, group)
+	if err != nil {
+		log.Printf("计算代理期望配置错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取期望配置", "detail": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, agents)
+	c.JSON(http.StatusOK, gin.H{
+		"agent_id":                agentID,
+		"group":                   group,
+		"agent_config":            agentConfig,
+		"agent_config_updated_at": agentConfigUpdatedAt,
+		"group_config":            groupConfig,
+		"desired_config":          desired,
+		"desired_version":         desiredVersion,
+		"applied_version":         appliedVersion,
+		"applied_at":              appliedAt,
+		"in_sync":                 desiredVersion == appliedVersion,
+		"config_error":            configError,
+	})
 }
 
-// 根据ID获取代理
-func getAgentByID(c *gin.Context) {
+// 设置代理的期望配置，整体替换原有配置并立即下发给在线的代理
+func setAgentConfig(c *gin.Context) {
 	agentID := c.Param("id")
-	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
 
-	// 查询代理详情
-	query := "SELECT id, name, hostname, platform, ip_address, last_seen, COALESCE(created_at, 0) as created_at, COALESCE(updated_at, 0) as updated_at FROM agents WHERE id = ?"
-	
-	log.Printf("执行查询: %s", query)
-	
-	var agent Agent
-	var lastSeenUnix sql.NullInt64
-	var createdAtUnix, updatedAtUnix sql.NullInt64
-	
-	err := db.QueryRow(query, agentID).Scan(
-		&agent.ID, 
-		&agent.Name, 
-		&agent.Hostname, 
-		&agent.Platform, 
-		&agent.IPAddress, 
-		&lastSeenUnix, 
-		&createdAtUnix, 
-		&updatedAtUnix)
-		
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("代理不存在: %s", agentID)
-			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
-		} else {
-			log.Printf("获取代理错误: %s, %v", agentID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
-		}
+	cfg, ok := bindRemoteConfig(c)
+	if !ok {
 		return
 	}
-	
-	// 设置LastSeen和在线状态
-	if lastSeenUnix.Valid {
-		agent.LastSeen = time.Unix(lastSeenUnix.Int64, 0)
-		// 将在线状态判断从5分钟改为10秒以减少误导
-		agent.IsOnline = time.Since(agent.LastSeen) < 10*time.Second
-	} else {
-		agent.LastSeen = time.Time{}
-		agent.IsOnline = false
-	}
-	
-	if createdAtUnix.Valid {
-		agent.CreatedAt = time.Unix(createdAtUnix.Int64, 0)
-	}
-	
-	if updatedAtUnix.Valid {
-		agent.UpdatedAt = time.Unix(updatedAtUnix.Int64, 0)
-	}
-	
-	if agent.Name == "" {
-		agent.Name = agent.Hostname
+	if !checkAgentExists(c, agentID) {
+		return
 	}
-	if agent.Platform == "" {
-		agent.Platform = "Unknown"
+
+	data, _ := json.Marshal(cfg)
+	if _, err := db.Exec("INSERT OR REPLACE INTO agent_configs (agent_id, config, updated_at) VALUES (?, ?, ?)", agentID, string(data), time.Now().Unix()); err != nil {
+		log.Printf("保存代理期望配置失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存期望配置失败", "detail": err.Error()})
+		return
 	}
+	pushDesiredConfigs(agentID)
 
-	c.JSON(http.StatusOK, agent)
+	log.Printf("已更新代理 %s 的期望配置", agentID)
+	c.JSON(http.StatusOK, gin.H{"message": "已保存", "agent_id": agentID})
 }
 
-// 更新代理
-func updateAgent(c *gin.Context) {
+// 删除代理的期望配置，代理改为只使用分组配置
+func deleteAgentConfig(c *gin.Context) {
 	agentID := c.Param("id")
-	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
 
-	var updateData struct {
-		Name     string `json:"name"`
-		Hostname string `json:"hostname"`
+	result, err := db.Exec("DELETE FROM agent_configs WHERE agent_id = ?", agentID)
+	if err != nil {
+		log.Printf("删除代理期望配置失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除期望配置失败", "detail": err.Error()})
+		return
 	}
-
-	if err := c.ShouldBindJSON(&updateData); err != nil {
-		log.Printf("无效的请求数据: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "代理没有设置期望配置"})
 		return
 	}
+	pushDesiredConfigs(agentID)
 
-	// 检查代理是否存在
-	var exists bool
-	err := db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	log.Printf("已删除代理 %s 的期望配置", agentID)
+	c.JSON(http.StatusOK, gin.H{"message": "已删除", "agent_id": agentID})
+}
+
+// 获取所有设置了期望配置的代理分组
+func getGroupConfigs(c *gin.Context) {
+	rows, err := db.Query("SELECT group_name, config, updated_at FROM group_configs ORDER BY group_name")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("要更新的代理不存在: %s", agentID)
-			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
-		} else {
-			log.Printf("检查代理存在性错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
-		}
+		log.Printf("查询分组期望配置错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取分组配置", "detail": err.Error()})
 		return
 	}
+	defer rows.Close()
 
-	// 更新代理名称和主机名
-	now := time.Now().Unix()
-	result, err := db.Exec("UPDATE agents SET name = ?, hostname = ?, updated_at = ? WHERE id = ?", updateData.Name, updateData.Hostname, now, agentID)
+	result := []gin.H{}
+	for rows.Next() {
+		var name, data string
+		var updatedAt int64
+		if err := rows.Scan(&name, &data, &updatedAt); err != nil {
+			log.Printf("读取分组期望配置错误: %v", err)
+			continue
+		}
+		var cfg map[string]interface{}
+		json.Unmarshal([]byte(data), &cfg)
+		result = append(result, gin.H{"group": name, "config": cfg, "updated_at": updatedAt})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取分组的期望配置以及组内各代理的应用状态
+func getGroupConfig(c *gin.Context) {
+	group := c.Param("name")
+	log.Printf("API call: %s %s (group: %s)", c.Request.Method, c.Request.URL.Path, group)
+
+	cfg, updatedAt, err := queryStoredConfig("SELECT config, updated_at FROM group_configs WHERE group_name = ?", group)
 	if err != nil {
-		log.Printf("更新代理失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新代理失败", "detail": err.Error()})
+		log.Printf("查询分组期望配置错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取分组配置", "detail": err.Error()})
 		return
 	}
 
-	// 同步写入hostname.json
-	hostnameFile := "hostname.json"
-	hostnameMap := map[string]string{}
-	if data, err := ioutil.ReadFile(hostnameFile); err == nil {
-		_ = json.Unmarshal(data, &hostnameMap)
+	rows, err := db.Query("SELECT id, COALESCE(labels, ''), COALESCE(config_version, ''), COALESCE(config_error, '') FROM agents")
+	if err != nil {
+		log.Printf("查询代理列表错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取分组配置", "detail": err.Error()})
+		return
 	}
-	if updateData.Hostname != "" {
-		hostnameMap[agentID] = updateData.Hostname
-		if data, err := json.MarshalIndent(hostnameMap, "", "  "); err == nil {
-			_ = ioutil.WriteFile(hostnameFile, data, 0644)
+	var members []Agent
+	for rows.Next() {
+		var agent Agent
+		var labels string
+		if err := rows.Scan(&agent.ID, &labels, &agent.AppliedConfigVersion, &agent.ConfigError); err != nil {
+			log.Printf("读取代理数据错误: %v", err)
+			continue
+		}
+		if labels != "" {
+			json.Unmarshal([]byte(labels), &agent.Labels)
+		}
+		if agent.Labels[configGroupLabel] == group {
+			members = append(members, agent)
 		}
 	}
+	rows.Close()
+	if cfg == nil && len(members) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分组不存在", "detail": "没有属于该分组的代理，也没有设置期望配置"})
+		return
+	}
 
-	rowsAffected, _ := result.RowsAffected()
-	log.Printf("已更新代理 %s, 影响行数: %d", agentID, rowsAffected)
-
-	c.JSON(http.StatusOK, gin.H{"message": "代理已更新", "agent_id": agentID})
+	agents := []gin.H{}
+	for _, agent := range members {
+		fillAgentConfigState(&agent)
+		agents = append(agents, gin.H{
+			"agent_id":        agent.ID,
+			"desired_version": agent.DesiredConfigVersion,
+			"applied_version": agent.AppliedConfigVersion,
+			"in_sync":         agent.ConfigInSync,
+			"config_error":    agent.ConfigError,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"group": group, "config": cfg, "updated_at": updatedAt, "agents": agents})
 }
 
-// 删除代理
-func deleteAgent(c *gin.Context) {
-	agentID := c.Param("id")
-	log.Printf("API call: %s %s (id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
+// 设置分组的期望配置，整体替换原有配置并立即下发给组内在线的代理
+func setGroupConfig(c *gin.Context) {
+	group := c.Param("name")
+	log.Printf("API call: %s %s (group: %s)", c.Request.Method, c.Request.URL.Path, group)
 
-	// 检查代理是否存在
-	var exists bool
-	err := db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("要删除的代理不存在: %s", agentID)
-			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
-		} else {
-			log.Printf("检查代理存在性错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
-		}
+	cfg, ok := bindRemoteConfig(c)
+	if !ok {
 		return
 	}
 
-	// 开始事务
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("开始事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+	data, _ := json.Marshal(cfg)
+	if _, err := db.Exec("INSERT OR REPLACE INTO group_configs (group_name, config, updated_at) VALUES (?, ?, ?)", group, string(data), time.Now().Unix()); err != nil {
+		log.Printf("保存分组期望配置失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存期望配置失败", "detail": err.Error()})
 		return
 	}
+	pushDesiredConfigs("")
 
-	// 删除相关的指标
-	result, err := tx.Exec("DELETE FROM metrics WHERE agent_id = ?", agentID)
+	log.Printf("已更新分组 %s 的期望配置", group)
+	c.JSON(http.StatusOK, gin.H{"message": "已保存", "group": group})
+}
+
+// 删除分组的期望配置
+func deleteGroupConfig(c *gin.Context) {
+	group := c.Param("name")
+	log.Printf("API call: %s %s (group: %s)", c.Request.Method, c.Request.URL.Path, group)
+
+	result, err := db.Exec("DELETE FROM group_configs WHERE group_name = ?", group)
 	if err != nil {
-		tx.Rollback()
-		log.Printf("删除代理指标失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理指标失败", "detail": err.Error()})
+		log.Printf("删除分组期望配置失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除期望配置失败", "detail": err.Error()})
 		return
 	}
-	
-	metricsRowsDeleted, _ := result.RowsAffected()
-	log.Printf("已删除代理 %s 的 %d 条指标记录", agentID, metricsRowsDeleted)
-
-	// 删除代理
-	result, err = tx.Exec("DELETE FROM agents WHERE id = ?", agentID)
-	if err != nil {
-		tx.Rollback()
-		log.Printf("删除代理失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除代理失败", "detail": err.Error()})
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分组没有设置期望配置"})
 		return
 	}
-	
-	agentRowsDeleted, _ := result.RowsAffected()
-	if agentRowsDeleted == 0 {
-		tx.Rollback()
-		log.Printf("代理 %s 可能已被删除", agentID)
-		c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "代理可能已被删除"})
+	pushDesiredConfigs("")
+
+	log.Printf("已删除分组 %s 的期望配置", group)
+	c.JSON(http.StatusOK, gin.H{"message": "已删除", "group": group})
+}
+
+// validateCommand 检查命令在白名单中，且只带有该命令允许的参数
+func validateCommand(command string, args map[string]string) error {
+	allowed, ok := diagnosticCommands[command]
+	if !ok {
+		names := make([]string, 0, len(diagnosticCommands))
+		for name := range diagnosticCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("不支持的命令: %s，可用的命令: %s", command, strings.Join(names, ", "))
+	}
+	for name := range args {
+		found := false
+		for _, a := range allowed {
+			if a == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("命令%s不支持参数: %s", command, name)
+		}
+	}
+
+	switch command {
+	case "top_processes":
+		if value := args["limit"]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxCommandTopProcesses {
+				return fmt.Errorf("进程数量必须在1到%d之间: %s", maxCommandTopProcesses, value)
+			}
+		}
+		if value := args["sort"]; value != "" && value != "cpu" && value != "memory" {
+			return fmt.Errorf("sort只能为cpu或memory: %s", value)
+		}
+	case "run_script":
+		if !scriptNamePattern.MatchString(args["name"]) {
+			return fmt.Errorf("无效的脚本名称: %q", args["name"])
+		}
+	}
+	return nil
+}
+
+// handleCommandResult 把代理返回的命令结果交给等待中的请求，只接受发出命令的连接返回的结果
+func handleCommandResult(client *agentConnection, data []byte, key envelopeKey) {
+	var result CommandResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		log.Printf("Failed to parse command result: %v", err)
 		return
 	}
 
-	// 提交事务
-	if err := tx.Commit(); err != nil {
-		log.Printf("提交事务失败: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": err.Error()})
+	commandsMutex.Lock()
+	pending, ok := pendingCommands[result.ID]
+	if ok && pending.client == client && (key.agentID == "" || key.agentID == pending.agentID) {
+		delete(pendingCommands, result.ID)
+	} else {
+		ok = false
+	}
+	commandsMutex.Unlock()
+	if !ok {
+		log.Printf("Ignored unexpected result of command %s from agent %s", result.ID, result.AgentID)
 		return
 	}
-	
-	log.Printf("已成功删除代理 %s 及其所有指标数据", agentID)
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "代理已删除",
-		"agent_id": agentID,
-		"metrics_deleted": metricsRowsDeleted,
-	})
+	log.Printf("Received result of command %s (%s) from agent %s: %s", result.ID, result.Command, pending.agentID, result.Status)
+	pending.result <- result
 }
 
-// 获取代理指标
-func getAgentMetrics(c *gin.Context) {
+// finishCommandAudit 在审计日志中记录命令的最终状态和结果
+func finishCommandAudit(id, status, errMsg string, result json.RawMessage, durationMs int64) {
+	var stored interface{}
+	if len(result) > 0 {
+		stored = string(result)
+	}
+	_, err := db.Exec("UPDATE command_audit SET status = ?, error = ?, result = ?, duration_ms = ?, finished_at = ? WHERE id = ?",
+		status, errMsg, stored, durationMs, time.Now().Unix(), id)
+	if err != nil {
+		log.Printf("更新命令审计日志失败: %v", err)
+	}
+}
+
+// 在代理上执行白名单中的诊断命令并同步等待结果，每次调用都记录到审计日志
+func runAgentCommand(c *gin.Context) {
 	agentID := c.Param("id")
 	log.Printf("API call: %s %s (agent_id: %s)", c.Request.Method, c.Request.URL.Path, agentID)
-	
-	// 获取时间范围参数
-	timeFromStr := c.DefaultQuery("from", "0")
-	timeToStr := c.DefaultQuery("to", fmt.Sprintf("%d", time.Now().Unix()))
-	
-	timeFrom, err := strconv.ParseInt(timeFromStr, 10, 64)
-	if err != nil {
-		log.Printf("无效的from时间参数: %s, %v", timeFromStr, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("from参数格式错误: %v", err)})
+
+	var req struct {
+		Command        string            `json:"command" binding:"required"`
+		Args           map[string]string `json:"args"`
+		TimeoutSeconds int               `json:"timeout_seconds"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
 		return
 	}
-	
-	timeTo, err := strconv.ParseInt(timeToStr, 10, 64)
-	if err != nil {
-		log.Printf("无效的to时间参数: %s, %v", timeToStr, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的时间范围参数", "detail": fmt.Sprintf("to参数格式错误: %v", err)})
+	if err := validateCommand(req.Command, req.Args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": err.Error()})
 		return
 	}
-	
-	// 获取数据限制
-	limitStr := c.DefaultQuery("limit", "100")
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil || limit <= 0 {
-		log.Printf("无效的limit参数: %s, 使用默认值100", limitStr)
-		limit = 100
+	timeout := defaultCommandTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	if timeout > maxCommandTimeout {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": fmt.Sprintf("超时时间不能超过%v", maxCommandTimeout)})
+		return
+	}
+	if !checkAgentExists(c, agentID) {
+		return
 	}
 
-	// 首先检查代理是否存在
-	var exists bool
-	err = db.QueryRow("SELECT 1 FROM agents WHERE id = ?", agentID).Scan(&exists)
+	id, err := randomHex(16)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("要查询的代理不存在: %s", agentID)
-			c.JSON(http.StatusNotFound, gin.H{"error": "代理不存在", "detail": "找不到指定ID的代理"})
-		} else {
-			log.Printf("检查代理存在性错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("检查代理存在性错误: %v", err)})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成命令ID失败"})
 		return
 	}
-	
-	log.Printf("查询代理 %s 的指标, 从 %d 到 %d, 限制 %d 条", agentID, timeFrom, timeTo, limit)
-	
-	// 查询该agent的metrics总记录数
-	var metricsCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ?", agentID).Scan(&metricsCount)
+	requestedBy := "api-key"
+	if username, ok := c.Get("username"); ok {
+		requestedBy = fmt.Sprint(username)
+	}
+	args, _ := json.Marshal(req.Args)
+	requestedAt := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO command_audit (id, agent_id, command, args, requested_by, requested_from, requested_at, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 'pending')`, id, agentID, req.Command, string(args), requestedBy, c.ClientIP(), requestedAt.Unix())
 	if err != nil {
-		log.Printf("查询metrics总数量错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("查询指标数量时出错: %v", err)})
+		log.Printf("写入命令审计日志失败: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "写入审计日志失败", "detail": err.Error()})
 		return
 	}
-	
-	log.Printf("找到 %d 条代理 %s 的指标记录", metricsCount, agentID)
-	
-	// 如果该agent没有任何metrics记录，直接返回空数组
-	if metricsCount == 0 {
-		log.Printf("代理 %s 没有任何指标数据，返回空数组", agentID)
-		c.JSON(http.StatusOK, []map[string]interface{}{})
+
+	clientsMutex.RLock()
+	client := clients[agentID]
+	clientsMutex.RUnlock()
+	if client == nil {
+		finishCommandAudit(id, "offline", "代理不在线", nil, 0)
+		c.JSON(http.StatusConflict, gin.H{"error": "代理不在线", "id": id})
 		return
 	}
-	
-	// 查询指定时间范围内的记录数
-	var rangeCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM metrics WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?", 
-		agentID, timeFrom, timeTo).Scan(&rangeCount)
-	if err != nil {
-		log.Printf("查询时间范围内的metrics数量错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器错误", "detail": fmt.Sprintf("查询时间范围内的指标数量时出错: %v", err)})
+
+	pending := &pendingCommand{agentID: agentID, client: client, result: make(chan CommandResult, 1)}
+	commandsMutex.Lock()
+	pendingCommands[id] = pending
+	commandsMutex.Unlock()
+	defer func() {
+		commandsMutex.Lock()
+		delete(pendingCommands, id)
+		commandsMutex.Unlock()
+	}()
+
+	message := ServerMessage{Type: "command", ID: id, Command: req.Command, Args: req.Args, TimeoutMs: timeout.Milliseconds()}
+	if err := client.send(message); err != nil {
+		finishCommandAudit(id, "failed", err.Error(), nil, 0)
+		c.JSON(http.StatusConflict, gin.H{"error": "无法向代理发送命令", "detail": err.Error(), "id": id})
 		return
 	}
-	
-	log.Printf("时间范围内找到 %d 条代理 %s 的指标记录", rangeCount, agentID)
-	
-	// 如果时间范围内没有记录，返回空数组
-	if rangeCount == 0 {
-		log.Printf("指定时间范围内没有数据，返回空数组")
-		c.JSON(http.StatusOK, []map[string]interface{}{})
-		return
+	log.Printf("已向代理 %s 发送诊断命令 %s (%s)，请求者: %s", agentID, req.Command, id, requestedBy)
+
+	select {
+	case result := <-pending.result:
+		finishCommandAudit(id, result.Status, result.Error, result.Result, result.DurationMs)
+		c.JSON(http.StatusOK, gin.H{
+			"id":          id,
+			"agent_id":    agentID,
+			"command":     req.Command,
+			"status":      result.Status,
+			"error":       result.Error,
+			"duration_ms": result.DurationMs,
+			"result":      result.Result,
+		})
+	case <-time.After(timeout + commandResultGrace):
+		finishCommandAudit(id, "timeout", "等待代理返回结果超时", nil, time.Since(requestedAt).Milliseconds())
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "等待代理返回结果超时", "id": id})
 	}
-	
-	// 查询指标
-	query := `
-		SELECT 
-			timestamp, cpu_usage, 
-			memory_total, memory_used, memory_percent,
-			disk_total, disk_used, disk_percent,
-			network_sent, network_recv,
-			load_avg_1, load_avg_5, load_avg_15,
-			process_count
-		FROM metrics
-		WHERE agent_id = ? AND timestamp >= ? AND timestamp <= ?
-		ORDER BY timestamp DESC
-		LIMIT ?
-	`
-	
-	log.Printf("执行查询: %s", query)
-	rows, err := db.Query(query, agentID, timeFrom, timeTo, limit)
-	
+}
+
+// 获取诊断命令审计日志，可按代理筛选，不包含命令结果
+func getCommandAudit(c *gin.Context) {
+	agentID := c.Query("agent_id")
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数无效", "detail": "limit必须为正整数"})
+			return
+		}
+		limit = n
+	}
+
+	query := `SELECT id, agent_id, command, COALESCE(args, ''), COALESCE(requested_by, ''), COALESCE(requested_from, ''),
+		requested_at, COALESCE(finished_at, 0), status, COALESCE(error, ''), COALESCE(duration_ms, 0) FROM command_audit`
+	var queryArgs []interface{}
+	if agentID != "" {
+		query += " WHERE agent_id = ?"
+		queryArgs = append(queryArgs, agentID)
+	}
+	query += " ORDER BY requested_at DESC, rowid DESC LIMIT ?"
+	queryArgs = append(queryArgs, limit)
+
+	rows, err := db.Query(query, queryArgs...)
 	if err != nil {
-		log.Printf("查询代理指标错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取指标", "detail": fmt.Sprintf("数据库查询失败: %v", err)})
+		log.Printf("查询命令审计日志错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取审计日志", "detail": err.Error()})
 		return
 	}
 	defer rows.Close()
-	
-	var metrics []map[string]interface{}
+
+	result := []gin.H{}
 	for rows.Next() {
-		var (
-			timestamp                                                          int64
-			cpuUsage, memPercent, diskPercent                                 float64
-			loadAvg1, loadAvg5, loadAvg15                                     float64
-			memTotal, memUsed, diskTotal, diskUsed, netSent, netRecv          int64
-			processCount                                                       int
-		)
-		
-		if err := rows.Scan(
-			&timestamp, &cpuUsage,
-			&memTotal, &memUsed, &memPercent,
-			&diskTotal, &diskUsed, &diskPercent,
-			&netSent, &netRecv,
-			&loadAvg1, &loadAvg5, &loadAvg15,
-			&processCount,
-		); err != nil {
-			log.Printf("扫描指标行数据错误: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "处理指标数据错误", "detail": fmt.Sprintf("解析数据行失败: %v", err)})
-			return
-		}
-		
-		log.Printf("行数据: timestamp=%d, cpu=%.2f%%, mem=%.2f%%, disk=%.2f%%", 
-			timestamp, cpuUsage, memPercent, diskPercent)
-		
-		metric := map[string]interface{}{
-			"timestamp":    timestamp,
-			"cpu_usage":    cpuUsage,
-			"memory_info": map[string]interface{}{
-				"total":   memTotal,
-				"used":    memUsed,
-				"percent": memPercent,
-			},
-			"disk_info": map[string]interface{}{
-				"total":   diskTotal,
-				"used":    diskUsed,
-				"percent": diskPercent,
-			},
-			"network_info": map[string]interface{}{
-				"bytes_sent": netSent,
-				"bytes_recv": netRecv,
-			},
-			"load_average": map[string]interface{}{
-				"load1":  loadAvg1,
-				"load5":  loadAvg5,
-				"load15": loadAvg15,
-			},
-			"process_count": processCount,
+		var id, agent, command, args, requestedBy, requestedFrom, status, errMsg string
+		var requestedAt, finishedAt, durationMs int64
+		if err := rows.Scan(&id, &agent, &command, &args, &requestedBy, &requestedFrom, &requestedAt, &finishedAt, &status, &errMsg, &durationMs); err != nil {
+			log.Printf("读取命令审计日志错误: %v", err)
+			continue
 		}
-		
-		metrics = append(metrics, metric)
+		var commandArgs map[string]string
+		json.Unmarshal([]byte(args), &commandArgs)
+		result = append(result, gin.H{
+			"id":             id,
+			"agent_id":       agent,
+			"command":        command,
+			"args":           commandArgs,
+			"requested_by":   requestedBy,
+			"requested_from": requestedFrom,
+			"requested_at":   requestedAt,
+			"finished_at":    finishedAt,
+			"status":         status,
+			"error":          errMsg,
+			"duration_ms":    durationMs,
+		})
 	}
-	
-	if err = rows.Err(); err != nil {
-		log.Printf("指标数据遍历错误: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据遍历错误", "detail": fmt.Sprintf("遍历数据集时发生错误: %v", err)})
+	c.JSON(http.StatusOK, result)
+}
+
+// 获取单条诊断命令的审计记录及其结果
+func getCommandAuditEntry(c *gin.Context) {
+	id := c.Param("id")
+
+	var agent, command, args, requestedBy, requestedFrom, status, errMsg, output string
+	var requestedAt, finishedAt, durationMs int64
+	err := db.QueryRow(`SELECT agent_id, command, COALESCE(args, ''), COALESCE(requested_by, ''), COALESCE(requested_from, ''),
+		requested_at, COALESCE(finished_at, 0), status, COALESCE(error, ''), COALESCE(duration_ms, 0), COALESCE(result, '')
+		FROM command_audit WHERE id = ?`, id).
+		Scan(&agent, &command, &args, &requestedBy, &requestedFrom, &requestedAt, &finishedAt, &status, &errMsg, &durationMs, &output)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "命令记录不存在"})
 		return
 	}
-	
-	log.Printf("成功获取代理 %s 的 %d 条指标记录", agentID, len(metrics))
-	
-	// 如果查询结果为空（理论上不应该发生，因为之前已经检查了），也返回空数组
-	if len(metrics) == 0 {
-		log.Printf("查询结果为空，返回空数组")
-		c.JSON(http.StatusOK, []map[string]interface{}{})
+	if err != nil {
+		log.Printf("查询命令审计日志错误: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "无法获取审计日志", "detail": err.Error()})
 		return
 	}
-	
-	c.JSON(http.StatusOK, metrics)
+
+	var commandArgs map[string]string
+	json.Unmarshal([]byte(args), &commandArgs)
+	var result json.RawMessage
+	if output != "" {
+		result = json.RawMessage(output)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":             id,
+		"agent_id":       agent,
+		"command":        command,
+		"args":           commandArgs,
+		"requested_by":   requestedBy,
+		"requested_from": requestedFrom,
+		"requested_at":   requestedAt,
+		"finished_at":    finishedAt,
+		"status":         status,
+		"error":          errMsg,
+		"duration_ms":    durationMs,
+		"result":         result,
+	})
 }
 
 // 生成模拟指标数据
@@ -2127,6 +6632,109 @@ func sendServerChan(sendKey, title, desp string) ([]byte, error) {
 	return body, nil
 }
 
+// 自定义Webhook推送，以JSON格式POST标题和内容
+func sendCustomWebhook(webhookURL, title, desp string) error {
+	b, _ := json.Marshal(map[string]string{"title": title, "desc": desp})
+	log.Printf("[CustomWebhook] POST %s, body=%s", webhookURL, string(b))
+	resp, err := http.Post(webhookURL, "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		log.Printf("[CustomWebhook] 请求失败: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+	log.Printf("[CustomWebhook] 响应状态: %d", resp.StatusCode)
+	return nil
+}
+
+// 向所有已启用的webhook推送告警
+func sendAlert(webhooks []Webhook, title, desp string) {
+	for _, wh := range webhooks {
+		if !wh.Enabled {
+			continue
+		}
+		if wh.Type == "serverchan" && wh.SendKey != "" {
+			_, _ = sendServerChan(wh.SendKey, title, desp)
+		} else if wh.Type == "custom" && wh.URL != "" {
+			_ = sendCustomWebhook(wh.URL, title, desp)
+		}
+	}
+}
+
+// 检查在线代理关注的systemd单元，进入failed状态时告警，恢复后重置告警状态
+func checkSystemdUnits(agent Agent, webhooks []Webhook) {
+	units, err := queryCurrentSystemdUnits(agent.ID)
+	if err != nil {
+		return
+	}
+	for _, u := range units {
+		if !u.Watched {
+			continue
+		}
+		key := agent.ID + "/" + u.Unit
+		if u.ActiveState != "failed" {
+			unitFailedAlerted[key] = false
+			continue
+		}
+		if !unitFailedAlerted[key] {
+			title := "服务失败告警"
+			desp := fmt.Sprintf("Agent %s(%s) 的服务 %s 已进入failed状态（%s），重启次数：%d", agent.Name, agent.ID, u.Unit, u.SubState, u.Restarts)
+			log.Printf("[服务告警] %s", desp)
+			sendAlert(webhooks, title, desp)
+			unitFailedAlerted[key] = true
+		}
+	}
+}
+
+// 检查在线代理的期望端口是否仍在监听，停止监听时告警，恢复后重置告警状态
+func checkExpectedPorts(agent Agent, webhooks []Webhook) {
+	expected, err := queryExpectedPorts(agent.ID)
+	if err != nil || len(expected) == 0 {
+		return
+	}
+	// 只根据最近一次实际上报的监听端口判断，采集失败、被关闭或超时的上报不包含监听端口，不会据此告警
+	current, reported, err := queryCurrentListeningPorts(agent.ID)
+	if err != nil || !reported {
+		return
+	}
+	for _, p := range expected {
+		key := fmt.Sprintf("%s/%s/%d", agent.ID, p.Protocol, p.Port)
+		if matchExpectedPort(p, current) {
+			portDownAlerted[key] = false
+			continue
+		}
+		if !portDownAlerted[key] {
+			title := "端口停止监听告警"
+			desp := fmt.Sprintf("Agent %s(%s) 的期望端口 %s/%d 已停止监听", agent.Name, agent.ID, p.Protocol, p.Port)
+			if p.Description != "" {
+				desp += fmt.Sprintf("（%s）", p.Description)
+			}
+			log.Printf("[端口告警] %s", desp)
+			sendAlert(webhooks, title, desp)
+			portDownAlerted[key] = true
+		}
+	}
+}
+
+// 检查在线代理的时钟偏移，超过阈值时告警，恢复后重置告警状态
+func checkClockSkew(agent Agent, webhooks []Webhook) {
+	var offsetMs, checkedAt int64
+	err := db.QueryRow("SELECT COALESCE(clock_offset_ms, 0), COALESCE(clock_offset_at, 0) FROM agents WHERE id = ?", agent.ID).Scan(&offsetMs, &checkedAt)
+	if err != nil || checkedAt == 0 {
+		return
+	}
+	if abs64(offsetMs) <= clockSkewThresholdMs() {
+		clockSkewAlerted[agent.ID] = false
+		return
+	}
+	if !clockSkewAlerted[agent.ID] {
+		title := "时钟偏移告警"
+		desp := fmt.Sprintf("Agent %s(%s) 的时钟与服务端相差 %.1f 秒，超过阈值 %d 秒，上报的时间戳已按偏移校正", agent.Name, agent.ID, float64(offsetMs)/1000, clockSkewThresholdMs()/1000)
+		log.Printf("[时钟告警] %s", desp)
+		sendAlert(webhooks, title, desp)
+		clockSkewAlerted[agent.ID] = true
+	}
+}
+
 func alertTask() {
 	for {
 		log.Printf("[alertTask] 开始遍历agent状态...")
@@ -2173,6 +6781,12 @@ func alertTask() {
 				}
 			} else {
 				offlineAlerted[agent.ID] = false
+				// 期望端口判定
+				checkExpectedPorts(agent, webhooks)
+				// systemd单元判定
+				checkSystemdUnits(agent, webhooks)
+				// 时钟偏移判定
+				checkClockSkew(agent, webhooks)
 			}
 			// 高负载判定（10分钟）
 			tenMinAgo := time.Now().Add(-10 * time.Minute).Unix()
@@ -2242,17 +6856,11 @@ func testWebhook(c *gin.Context) {
 		return
 	}
 	if wh.Type == "custom" && wh.URL != "" {
-		body := map[string]string{"title": title, "desc": desp}
-		b, _ := json.Marshal(body)
-		log.Printf("[WebhookTest] POST %s, body=%s", wh.URL, string(b))
-		resp, err := http.Post(wh.URL, "application/json", strings.NewReader(string(b)))
-		if err != nil {
+		if err := sendCustomWebhook(wh.URL, title, desp); err != nil {
 			log.Printf("[WebhookTest] 自定义Webhook推送失败: %v", err)
 			c.JSON(500, gin.H{"error": "自定义Webhook推送失败", "detail": err.Error()})
 			return
 		}
-		defer resp.Body.Close()
-		log.Printf("[WebhookTest] 自定义Webhook响应状态: %d", resp.StatusCode)
 		c.JSON(200, gin.H{"message": "SUCCESS"})
 		return
 	}
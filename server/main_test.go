@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestAcceptSequence(t *testing.T) {
+	agentSequences["agent-1"] = 10
+	defer delete(agentSequences, "agent-1")
+
+	tests := []struct {
+		name          string
+		seq           uint64
+		authenticated bool
+		ok            bool
+	}{
+		{"认证帧不带序列号", 0, true, false},
+		{"旧版帧不带序列号", 0, false, true},
+		{"等于已接受的序列号", 10, true, false},
+		{"小于已接受的序列号", 9, false, false},
+		{"大于已接受的序列号", 11, true, true},
+		{"重放刚接受的序列号", 11, true, false},
+	}
+	for _, tt := range tests {
+		if _, ok := acceptSequence("agent-1", tt.seq, tt.authenticated); ok != tt.ok {
+			t.Errorf("%s: acceptSequence(%d, %v) = %v，期望 %v", tt.name, tt.seq, tt.authenticated, ok, tt.ok)
+		}
+	}
+}
+
+func TestReleaseSequence(t *testing.T) {
+	agentSequences["agent-2"] = 10
+	defer delete(agentSequences, "agent-2")
+
+	// 存储失败时撤销预留，同一序列号可以再次被接受
+	previous, ok := acceptSequence("agent-2", 11, true)
+	if !ok || previous != 10 {
+		t.Fatalf("acceptSequence(11) = %d, %v，期望 10, true", previous, ok)
+	}
+	releaseSequence("agent-2", 11, previous)
+	if _, ok := acceptSequence("agent-2", 11, true); !ok {
+		t.Errorf("撤销预留后序列号11应被接受")
+	}
+
+	// 之后已接受更大的序列号时，撤销不能使序列号回退
+	if _, ok := acceptSequence("agent-2", 12, true); !ok {
+		t.Fatalf("序列号12应被接受")
+	}
+	releaseSequence("agent-2", 11, 10)
+	if _, ok := acceptSequence("agent-2", 12, true); ok {
+		t.Errorf("撤销旧的预留后序列号12仍应被拒绝")
+	}
+}